@@ -18,12 +18,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/99nil/gopkg/server"
 	"github.com/spf13/cobra"
 
 	"github.com/zc2638/review-bot/global"
 	"github.com/zc2638/review-bot/handler"
+	"github.com/zc2638/review-bot/handler/webhook"
 )
 
 var cfgFile string
@@ -42,8 +45,38 @@ func NewServerCommand() *cobra.Command {
 			if err := global.InitCfg(cfg); err != nil {
 				return err
 			}
+			queue := webhook.NewQueue(cfg.Queue.Workers, cfg.Queue.Size, webhook.NewProcessor(global.SCMInstance))
+			queue.SetDeduplication(cfg.Queue.DedupTTL, cfg.Queue.DedupSize)
+			if cfg.Queue.Dir != "" {
+				store, err := webhook.NewFileStore(cfg.Queue.Dir)
+				if err != nil {
+					return err
+				}
+				queue.SetStore(store)
+				deadLetter, err := webhook.NewFileStore(filepath.Join(cfg.Queue.Dir, "failed"))
+				if err != nil {
+					return err
+				}
+				queue.SetDeadLetter(deadLetter)
+			}
+			queue.Start()
+			defer func() {
+				// 等待处理剩余的事件
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				if err := queue.Stop(ctx); err != nil {
+					fmt.Println(err)
+				}
+			}()
+			// 恢复上次未处理完成的事件
+			if n, err := queue.Resume(); err != nil {
+				return err
+			} else if n > 0 {
+				fmt.Println("Resume", n, "pending events")
+			}
+
 			s := server.New(&cfg.Server)
-			s.Handler = handler.New()
+			s.Handler = handler.New(queue)
 			fmt.Println("Listen on", s.Addr)
 			return s.Run(context.Background())
 		},
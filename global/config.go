@@ -15,6 +15,8 @@
 package global
 
 import (
+	"time"
+
 	"github.com/99nil/gopkg/server"
 
 	"github.com/zc2638/review-bot/pkg/scm"
@@ -26,8 +28,38 @@ const JWTSecret = "bot"
 
 type Config struct {
 	Server server.Config `json:"server"`
-	SCM    scm.Config    `json:"scm"`
-	Logger LoggerConfig  `json:"logger"`
+	// SCM is the default scm instance
+	SCM scm.Config `json:"scm"`
+	// SCMs is the additional named scm instances
+	SCMs   []scm.Config `json:"scms"`
+	Logger LoggerConfig `json:"logger"`
+	Cache  CacheConfig  `json:"cache"`
+	Queue  QueueConfig  `json:"queue"`
+	Admin  AdminConfig  `json:"admin"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token of the admin api, empty value disables the admin api
+	Token string `json:"token"`
+}
+
+type QueueConfig struct {
+	// Workers is the number of the workers processing webhook events
+	Workers int `json:"workers"`
+	// Size is the max number of the events waiting to be processed, the webhook is rejected when exceeded
+	Size int `json:"size"`
+	// DedupTTL is the duration of remembering the delivery ids, zero or negative value disables the deduplication
+	DedupTTL time.Duration `json:"dedup_ttl"`
+	// DedupSize is the max number of the delivery ids remembered
+	DedupSize int `json:"dedup_size"`
+	// Dir is the directory persisting the accepted events until they are processed,
+	// the pending events are resumed on startup, empty value disables it
+	Dir string `json:"dir"`
+}
+
+type CacheConfig struct {
+	// ReviewConfigTTL is the expiration of the cached review config, zero or negative value disables the cache
+	ReviewConfigTTL time.Duration `json:"review_config_ttl"`
 }
 
 type LoggerConfig struct {
@@ -37,6 +69,12 @@ type LoggerConfig struct {
 func Environ() *Config {
 	cfg := &Config{}
 	cfg.Server.Port = 2640
-	cfg.SCM.Type = "gitlab"
+	cfg.SCM.Type = scm.TypeGitlab
+	cfg.Cache.ReviewConfigTTL = scm.DefaultReviewConfigTTL
+	cfg.Queue.Workers = 4
+	cfg.Queue.Size = 100
+	cfg.Queue.DedupTTL = time.Hour
+	cfg.Queue.DedupSize = 10000
+	cfg.Queue.Dir = "data/queue"
 	return cfg
 }
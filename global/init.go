@@ -42,21 +42,108 @@ func InitCfg(cfg *Config) (err error) {
 		TimestampFormat:        "2006/01/02 15:04:05",
 	})
 	ctr.InitLogger(logrus.StandardLogger())
-	return initSCM(&cfg.SCM)
+	scm.ReviewConfigCached().SetTTL(cfg.Cache.ReviewConfigTTL)
+	return initSCM(cfg)
 }
 
 func Cfg() *Config {
 	return config
 }
 
-var scmClient scm.Interface
+// Instance is a configured scm instance.
+type Instance struct {
+	Config *scm.Config
+	Client scm.Interface
+}
+
+var (
+	defaultInstance *Instance
+	instances       map[string]*Instance
+)
+
+func initSCM(cfg *Config) error {
+	client, err := newSCM(&cfg.SCM)
+	if err != nil {
+		return err
+	}
+	defaultInstance = &Instance{Config: &cfg.SCM, Client: scm.Named(cfg.SCM.Name, client)}
 
-func initSCM(cfg *scm.Config) error {
-	var err error
-	scmClient, err = scm.NewGitlabClient(cfg)
-	return err
+	instances = make(map[string]*Instance)
+	if cfg.SCM.Name != "" {
+		instances[cfg.SCM.Name] = defaultInstance
+	}
+	for i := range cfg.SCMs {
+		c := &cfg.SCMs[i]
+		if c.Name == "" {
+			return fmt.Errorf("name of scms[%d] is required", i)
+		}
+		if _, ok := instances[c.Name]; ok {
+			return fmt.Errorf("duplicate scm instance: %s", c.Name)
+		}
+		client, err := newSCM(c)
+		if err != nil {
+			return fmt.Errorf("init scm instance(%s) failed: %v", c.Name, err)
+		}
+		instances[c.Name] = &Instance{Config: c, Client: scm.Named(c.Name, client)}
+	}
+	return nil
 }
 
+func newSCM(cfg *scm.Config) (scm.Interface, error) {
+	var (
+		client scm.Interface
+		err    error
+	)
+	switch cfg.Type {
+	case scm.TypeGitlab, "":
+		client, err = scm.NewGitlabClient(cfg)
+	case scm.TypeGithub:
+		client, err = scm.NewGithubClient(cfg)
+	case scm.TypeGitea, scm.TypeForgejo:
+		client, err = scm.NewGiteaClient(cfg)
+	case scm.TypeBitbucket:
+		client, err = scm.NewBitbucketClient(cfg)
+	default:
+		err = fmt.Errorf("unsupported scm type: %s", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scm.NewRetryClient(client, cfg.Retry), nil
+}
+
+// SCM returns the client of the default scm instance.
 func SCM() scm.Interface {
-	return scmClient
+	return defaultInstance.Client
+}
+
+// RetryStats returns the retry counters of the methods by the scm instance name,
+// the default instance without name is named `default`.
+func RetryStats() map[string]map[string]scm.RetryStats {
+	result := make(map[string]map[string]scm.RetryStats)
+	add := func(name string, instance *Instance) {
+		if name == "" {
+			name = "default"
+		}
+		if stats, ok := scm.RetryStatsOf(instance.Client); ok {
+			result[name] = stats
+		}
+	}
+	add(defaultInstance.Config.Name, defaultInstance)
+	for name, instance := range instances {
+		add(name, instance)
+	}
+	return result
+}
+
+// SCMInstance returns the scm instance by name, empty name means the default instance.
+func SCMInstance(name string) (*Instance, error) {
+	if name == "" {
+		return defaultInstance, nil
+	}
+	instance, ok := instances[name]
+	if !ok {
+		return nil, fmt.Errorf("scm instance(%s) not found", name)
+	}
+	return instance, nil
 }
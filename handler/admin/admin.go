@@ -0,0 +1,94 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/99nil/gopkg/ctr"
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+
+	"github.com/zc2638/review-bot/global"
+	"github.com/zc2638/review-bot/handler/webhook"
+)
+
+// New returns the handler of the admin api, which requires the bearer token in admin config.
+func New(queue *webhook.Queue) http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(authorize)
+	mux.Get("/events/failed", listFailed(queue))
+	mux.Post("/events/{id}/replay", replay(queue))
+	mux.Get("/scm/stats", scmStats)
+	return mux
+}
+
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Authorized(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Authorized checks the bearer token in admin config, and writes the error response if the check fails.
+func Authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := global.Cfg().Admin.Token
+	if token == "" {
+		ctr.Forbidden(w, errors.New("admin api is disabled"))
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		ctr.Unauthorized(w, errors.New("invalid admin token"))
+		return false
+	}
+	return true
+}
+
+func listFailed(queue *webhook.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := queue.Failed()
+		if err != nil {
+			ctr.InternalError(w, err)
+			return
+		}
+		ctr.OK(w, jobs)
+	}
+}
+
+func replay(queue *webhook.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := queue.Replay(chi.URLParam(r, "id"))
+		switch err {
+		case nil:
+			ctr.Success(w)
+		case webhook.ErrJobNotFound:
+			ctr.NotFound(w, err)
+		case webhook.ErrQueueFull, webhook.ErrQueueClosed:
+			ctr.ErrorCode(w, err, http.StatusServiceUnavailable)
+		default:
+			ctr.InternalError(w, err)
+		}
+	}
+}
+
+// scmStats returns the call, retry and failure counters of the scm api by instance and method.
+func scmStats(w http.ResponseWriter, _ *http.Request) {
+	ctr.OK(w, global.RetryStats())
+}
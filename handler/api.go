@@ -25,12 +25,13 @@ import (
 	"github.com/go-chi/cors"
 
 	"github.com/zc2638/review-bot/global"
+	"github.com/zc2638/review-bot/handler/admin"
 	"github.com/zc2638/review-bot/handler/home"
 	"github.com/zc2638/review-bot/handler/webhook"
 	"github.com/zc2638/swag"
 )
 
-func New() http.Handler {
+func New(queue *webhook.Queue) http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(
 		middleware.Recoverer,
@@ -46,7 +47,9 @@ func New() http.Handler {
 		mux.Method(e.Method, path, e.Handler.(http.Handler))
 	})
 
-	mux.Post("/webhook", webhook.HandlerEvent(&global.Cfg().SCM, global.SCM()))
+	mux.Post("/webhook", webhook.HandlerEvent(global.SCMInstance, queue))
+	mux.Post("/webhook/{instance}", webhook.HandlerEvent(global.SCMInstance, queue))
+	mux.Mount("/admin", admin.New(queue))
 	mux.Handle("/swagger/json", apiDoc.Handler())
 	mux.Mount("/swagger/ui", swag.UIHandler("/swagger/ui", "/swagger/json", true))
 	return mux
@@ -0,0 +1,501 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zc2638/review-bot/global"
+	"github.com/zc2638/review-bot/handler/webhook"
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/scm/fake"
+	"github.com/zc2638/review-bot/pkg/util"
+)
+
+const (
+	testPid    = "group/project"
+	testSHA    = "da1560886d4f094c3e6c9ef40349f7d38b5d27d7"
+	testSecret = "webhook-secret"
+	testAdmin  = "admin-token"
+)
+
+// setup starts a fake GitLab server and initializes the bot with it.
+func setup(t *testing.T, instances ...scm.Config) (*fake.GitlabServer, http.Handler) {
+	server := newTestServer(t)
+	cfg := global.Environ()
+	cfg.SCM.Host = server.URL
+	cfg.SCM.Token = "token"
+	cfg.SCM.Secret = testSecret
+	cfg.SCMs = instances
+	cfg.Logger.Level = "error"
+	cfg.Admin.Token = testAdmin
+	if err := global.InitCfg(cfg); err != nil {
+		t.Fatalf("InitCfg() error = %v", err)
+	}
+	scm.Cached().Remove(testPid)
+	scm.ReviewConfigCached().Remove(testPid)
+	for _, v := range instances {
+		scm.Cached().Remove(v.Name + ":" + testPid)
+		scm.ReviewConfigCached().Remove(v.Name + ":" + testPid)
+	}
+	queue := webhook.NewQueue(2, 10, webhook.NewProcessor(global.SCMInstance))
+	queue.SetDeduplication(time.Hour, 100)
+	queue.Start()
+	t.Cleanup(func() { _ = queue.Stop(context.Background()) })
+	return server, &testBot{Handler: New(queue), queue: queue}
+}
+
+// testBot waits for the events to be processed after serving the webhook.
+type testBot struct {
+	http.Handler
+	queue *webhook.Queue
+}
+
+func (b *testBot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Handler.ServeHTTP(w, r)
+	b.queue.Wait()
+}
+
+func newTestServer(t *testing.T) *fake.GitlabServer {
+	server := fake.NewGitlabServer()
+	t.Cleanup(server.Close)
+	server.AddProject(testPid, &fake.Project{
+		ReviewConfig: map[string]string{
+			"main": "reviewers:\n  - reviewer1\napprovers:\n  - approver1\n",
+		},
+		Members: []scm.ProjectMember{
+			{ID: 1, Username: "author"},
+			{ID: 2, Username: "reviewer1"},
+			{ID: 3, Username: "approver1"},
+		},
+		PullRequests: map[int]*scm.PullRequest{
+			1: {ID: 1000, IID: 1, Title: "Add something", State: "opened", SHA: testSHA},
+		},
+		Issues: map[int]*scm.Issue{
+			1: {ID: 3000, IID: 1, Title: "Something is broken", State: "opened", AuthorID: 1},
+		},
+	})
+	return server
+}
+
+// postWebhook posts the webhook fixture in testdata to the bot.
+func postWebhook(t *testing.T, h http.Handler, eventType, fixture string) *httptest.ResponseRecorder {
+	return postInstanceWebhook(t, h, "", eventType, fixture)
+}
+
+// postInstanceWebhook posts the webhook fixture with the token of the scm instance.
+func postInstanceWebhook(t *testing.T, h http.Handler, instance, eventType, fixture string) *httptest.ResponseRecorder {
+	auth := &util.JwtAuthInfo{Slug: testPid, Instance: instance, CreatedAt: time.Now()}
+	return postAuthWebhook(t, h, auth, eventType, fixture)
+}
+
+// postAuthWebhook posts the webhook fixture with the token of the auth info signed by the test secret.
+func postAuthWebhook(t *testing.T, h http.Handler, auth *util.JwtAuthInfo, eventType, fixture string) *httptest.ResponseRecorder {
+	auth.Signature = auth.BuildSign(testSecret)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newWebhookRequest(t, auth, eventType, fixture))
+	return w
+}
+
+func newWebhookRequest(t *testing.T, auth *util.JwtAuthInfo, eventType, fixture string) *http.Request {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := util.JwtCreate(util.JwtClaims{Auth: auth}, global.JWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", eventType)
+	req.Header.Set("X-Gitlab-Token", token)
+	return req
+}
+
+func TestWebhook_MergeRequestOpen(t *testing.T) {
+	server, h := setup(t)
+	if w := postWebhook(t, h, "Merge Request Hook", "merge_request_open.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	statuses := server.Requests("POST /statuses/{sha}")
+	if len(statuses) != 1 || statuses[0].Body["state"] != scm.BuildStateRunning {
+		t.Errorf("set commit status requests = %+v, want one running status", statuses)
+	}
+	updates := server.Requests("PUT /merge_requests/{iid}")
+	if len(updates) != 1 || updates[0].Body["add_labels"] != "kind/feature" {
+		t.Errorf("update merge request requests = %+v, want add label kind/feature", updates)
+	}
+	notes := server.Requests("POST /merge_requests/{iid}/notes")
+	if len(notes) != 1 || !strings.Contains(notes[0].Body["body"].(string), "@reviewer1") {
+		t.Errorf("create note requests = %+v, want request review from reviewer1", notes)
+	}
+	if len(server.Requests("POST /labels")) == 0 {
+		t.Errorf("labels are not initialized")
+	}
+	if got := server.Project(testPid).PullRequests[1].Labels; len(got) != 1 || got[0] != "kind/feature" {
+		t.Errorf("merge request labels = %v, want [kind/feature]", got)
+	}
+}
+
+func TestWebhook_MergeRequestNote(t *testing.T) {
+	server, h := setup(t)
+	if w := postWebhook(t, h, "Note Hook", "note_merge_request.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	updates := server.Requests("PUT /merge_requests/{iid}")
+	if len(updates) != 1 || updates[0].Body["add_labels"] != "lgtm" {
+		t.Errorf("update merge request requests = %+v, want add label lgtm", updates)
+	}
+	if len(server.Requests("PUT /merge_requests/{iid}/merge")) != 0 {
+		t.Errorf("merge request should not be merged without approval")
+	}
+}
+
+func TestWebhook_IssueNote(t *testing.T) {
+	server, h := setup(t)
+	if w := postWebhook(t, h, "Note Hook", "note_issue.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	issue := server.Project(testPid).Issues[1]
+	if len(issue.Labels) != 1 || issue.Labels[0] != "kind/bugfix" {
+		t.Errorf("issue labels = %v, want [kind/bugfix]", issue.Labels)
+	}
+	if issue.State != "closed" {
+		t.Errorf("issue state = %s, want closed", issue.State)
+	}
+}
+
+func TestWebhook_PipelineFailed(t *testing.T) {
+	server, h := setup(t)
+	if w := postWebhook(t, h, "Pipeline Hook", "pipeline_failed.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if got := server.Project(testPid).PullRequests[1].Labels; len(got) != 1 || got[0] != "do-not-merge/ci-failed" {
+		t.Errorf("merge request labels = %v, want [do-not-merge/ci-failed]", got)
+	}
+	notes := server.Requests("POST /merge_requests/{iid}/notes")
+	if len(notes) != 1 {
+		t.Fatalf("create note requests = %+v, want one", notes)
+	}
+	body, _ := notes[0].Body["body"].(string)
+	if !strings.Contains(body, "`unit-test`") || strings.Contains(body, "`lint`") {
+		t.Errorf("note = %s, want the failed job unit-test only", body)
+	}
+}
+
+func TestWebhook_Unauthorized(t *testing.T) {
+	server, h := setup(t)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+	req.Header.Set("X-Gitlab-Event", "Note Hook")
+	req.Header.Set("X-Gitlab-Token", "invalid")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("webhook status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := server.Requests(); len(got) != 0 {
+		t.Errorf("requests = %+v, want none", got)
+	}
+}
+
+func TestWebhook_InvalidSignature(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature func(auth *util.JwtAuthInfo) string
+	}{
+		{
+			name:      "empty",
+			signature: func(auth *util.JwtAuthInfo) string { return "" },
+		},
+		{
+			name:      "other secret",
+			signature: func(auth *util.JwtAuthInfo) string { return auth.BuildSign("other") },
+		},
+		{
+			name: "other project",
+			signature: func(auth *util.JwtAuthInfo) string {
+				other := *auth
+				other.Slug = "group/other"
+				return other.BuildSign(testSecret)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, h := setup(t)
+			auth := &util.JwtAuthInfo{Slug: testPid, CreatedAt: time.Now()}
+			auth.Signature = tt.signature(auth)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newWebhookRequest(t, auth, "Merge Request Hook", "merge_request_open.json"))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("webhook status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if got := server.Requests(); len(got) != 0 {
+				t.Errorf("requests = %+v, want none", got)
+			}
+		})
+	}
+}
+
+func TestWebhook_MultipleInstances(t *testing.T) {
+	internal := newTestServer(t)
+	server, h := setup(t, scm.Config{
+		Name:   "internal",
+		Type:   scm.TypeGitlab,
+		Host:   internal.URL,
+		Token:  "token",
+		Secret: testSecret,
+	})
+
+	if w := postInstanceWebhook(t, h, "internal", "Merge Request Hook", "merge_request_open.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := server.Requests(); len(got) != 0 {
+		t.Errorf("default instance requests = %+v, want none", got)
+	}
+	if len(internal.Requests("POST /labels")) == 0 {
+		t.Errorf("labels of the internal instance are not initialized")
+	}
+	if got := internal.Project(testPid).PullRequests[1].Labels; len(got) != 1 || got[0] != "kind/feature" {
+		t.Errorf("merge request labels = %v, want [kind/feature]", got)
+	}
+
+	// the labels are initialized per instance
+	if w := postWebhook(t, h, "Merge Request Hook", "merge_request_open.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(server.Requests("POST /labels")) == 0 {
+		t.Errorf("labels of the default instance are not initialized")
+	}
+
+	if w := postInstanceWebhook(t, h, "unknown", "Note Hook", "note_merge_request.json"); w.Code != http.StatusNotFound {
+		t.Errorf("webhook status of unknown instance = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebhook_Scope(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		auth      util.JwtAuthInfo
+		wantCode  int
+	}{
+		{
+			name:      "group hook",
+			eventType: "Merge Request Hook",
+			auth:      util.JwtAuthInfo{Slug: "group", Scope: util.JwtScopeNamespace},
+			wantCode:  http.StatusAccepted,
+		},
+		{
+			name:      "group hook of other namespace",
+			eventType: "Merge Request Hook",
+			auth:      util.JwtAuthInfo{Slug: "gro", Scope: util.JwtScopeNamespace},
+			wantCode:  http.StatusUnauthorized,
+		},
+		{
+			name:      "project hook of other project",
+			eventType: "Merge Request Hook",
+			auth:      util.JwtAuthInfo{Slug: "group/other"},
+			wantCode:  http.StatusUnauthorized,
+		},
+		{
+			name:      "system hook",
+			eventType: "System Hook",
+			auth:      util.JwtAuthInfo{Scope: util.JwtScopeSystem},
+			wantCode:  http.StatusAccepted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, h := setup(t)
+			tt.auth.CreatedAt = time.Now()
+			if w := postAuthWebhook(t, h, &tt.auth, tt.eventType, "merge_request_open.json"); w.Code != tt.wantCode {
+				t.Fatalf("webhook status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			updated := len(server.Requests("PUT /merge_requests/{iid}")) > 0
+			if want := tt.wantCode == http.StatusAccepted; updated != want {
+				t.Errorf("merge request updated = %v, want %v", updated, want)
+			}
+		})
+	}
+}
+
+func TestSecret_Scope(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		token    string
+		disabled bool
+		wantCode int
+	}{
+		{name: "project secret", query: "namespace=group&name=project", wantCode: http.StatusOK},
+		{name: "group secret without admin token", query: "namespace=group", wantCode: http.StatusUnauthorized},
+		{name: "system secret without admin token", query: "system=true", wantCode: http.StatusUnauthorized},
+		{name: "system secret with invalid admin token", query: "system=true", token: "invalid", wantCode: http.StatusUnauthorized},
+		{name: "group secret", query: "namespace=group", token: testAdmin, wantCode: http.StatusOK},
+		{name: "system secret", query: "system=true", token: testAdmin, wantCode: http.StatusOK},
+		{name: "system secret with admin api disabled", query: "system=true", token: testAdmin, disabled: true, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h := setup(t)
+			if tt.disabled {
+				global.Cfg().Admin.Token = ""
+			}
+			req := httptest.NewRequest(http.MethodGet, "/secret?"+tt.query, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("secret status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhook_WithoutReviewConfig(t *testing.T) {
+	server, h := setup(t)
+	server.Project(testPid).ReviewConfig = map[string]string{}
+
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(t, h, "Note Hook", "note_merge_request.json"); w.Code != http.StatusAccepted {
+			t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+		}
+	}
+	if got := len(server.Requests("GET /repository/files/{file}/raw")); got != 1 {
+		t.Errorf("get review config requests = %d, want 1", got)
+	}
+	if got := server.Requests("GET /merge_requests/{iid}", "PUT /merge_requests/{iid}"); len(got) != 0 {
+		t.Errorf("merge request requests = %+v, want none", got)
+	}
+}
+
+func TestWebhook_ReviewConfigCache(t *testing.T) {
+	server, h := setup(t)
+	rawRequests := func() int {
+		return len(server.Requests("GET /repository/files/{file}/raw"))
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(t, h, "Note Hook", "note_merge_request.json"); w.Code != http.StatusAccepted {
+			t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+		}
+	}
+	if got := rawRequests(); got != 1 {
+		t.Errorf("get review config requests = %d, want 1", got)
+	}
+
+	// reviewer1 is removed from the reviewers
+	server.Project(testPid).ReviewConfig = map[string]string{"main": "reviewers:\n  - approver1\n"}
+	if w := postWebhook(t, h, "Push Hook", "push_review_config.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+	server.ResetRequests()
+	if w := postWebhook(t, h, "Note Hook", "note_merge_request.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := rawRequests(); got != 1 {
+		t.Errorf("get review config requests after push = %d, want 1", got)
+	}
+	if got := server.Requests("PUT /merge_requests/{iid}"); len(got) != 0 {
+		t.Errorf("update merge request requests = %+v, want none after reviewer1 is removed", got)
+	}
+}
+
+func TestWebhook_Deduplication(t *testing.T) {
+	server, h := setup(t)
+	auth := &util.JwtAuthInfo{Slug: testPid, CreatedAt: time.Now()}
+	auth.Signature = auth.BuildSign(testSecret)
+	wantCodes := []int{http.StatusAccepted, http.StatusOK}
+	for _, want := range wantCodes {
+		req := newWebhookRequest(t, auth, "Merge Request Hook", "merge_request_open.json")
+		req.Header.Set("X-Gitlab-Event-UUID", "b8c0f5c2-8d9e-4c38-9a4c-2f8e3c1d7a61")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("webhook status = %d, want %d, body = %s", w.Code, want, w.Body.String())
+		}
+	}
+	if got := server.Requests("POST /merge_requests/{iid}/notes"); len(got) != 1 {
+		t.Errorf("create note requests = %d, want 1", len(got))
+	}
+}
+
+func TestAdmin_ReplayFailedEvent(t *testing.T) {
+	server, h := setup(t)
+	project := server.Project(testPid)
+	pr := project.PullRequests[1]
+	delete(project.PullRequests, 1)
+	if w := postWebhook(t, h, "Merge Request Hook", "merge_request_open.json"); w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	adminRequest := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := adminRequest(http.MethodGet, "/admin/events/failed", "invalid"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("list failed events with invalid token status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := adminRequest(http.MethodGet, "/admin/events/failed", testAdmin)
+	var failed []webhook.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &failed); err != nil {
+		t.Fatalf("list failed events status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(failed) != 1 || failed[0].Attempts != 1 || failed[0].Error == "" || failed[0].PullRequest == nil {
+		t.Fatalf("failed events = %+v, want one failed merge request event", failed)
+	}
+	w = adminRequest(http.MethodGet, "/admin/scm/stats", testAdmin)
+	var stats map[string]map[string]scm.RetryStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("scm stats status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := stats["default"]["GetPullRequest"]; got.Calls == 0 || got.Failures == 0 {
+		t.Errorf("scm stats of GetPullRequest = %+v, want failures", got)
+	}
+
+	server.ResetRequests()
+	project.PullRequests[1] = pr
+	if w := adminRequest(http.MethodPost, "/admin/events/"+failed[0].ID+"/replay", testAdmin); w.Code != http.StatusOK {
+		t.Fatalf("replay status = %d, body = %s", w.Code, w.Body.String())
+	}
+	h.(*testBot).queue.Wait()
+	if statuses := server.Requests("POST /statuses/{sha}"); len(statuses) != 1 {
+		t.Errorf("set commit status requests = %+v, want one", statuses)
+	}
+	if w := adminRequest(http.MethodPost, "/admin/events/"+failed[0].ID+"/replay", testAdmin); w.Code != http.StatusNotFound {
+		t.Errorf("replay again status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
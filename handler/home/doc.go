@@ -36,8 +36,11 @@ func Register(doc *swag.API) {
 			http.MethodGet, "/secret",
 			endpoint.Handler(secret()),
 			endpoint.Summary("生成webhook密钥"),
-			endpoint.Query("namespace", types.String, "仓库中间名称", true),
-			endpoint.Query("name", types.String, "仓库名称", true),
+			endpoint.Description("生成群组和系统webhook密钥时需要在Authorization请求头中携带admin token"),
+			endpoint.Query("namespace", types.String, "仓库中间名称", false),
+			endpoint.Query("name", types.String, "仓库名称，为空时生成群组webhook密钥", false),
+			endpoint.Query("system", types.Boolean, "是否生成系统webhook密钥", false),
+			endpoint.Query("instance", types.String, "scm实例名称，默认为scm配置", false),
 			endpoint.ResponseSuccess(),
 			endpoint.NoSecurity(),
 		),
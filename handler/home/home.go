@@ -31,6 +31,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/zc2638/review-bot/global"
+	"github.com/zc2638/review-bot/handler/admin"
 	"github.com/zc2638/review-bot/pkg/scm"
 	"github.com/zc2638/review-bot/pkg/util"
 )
@@ -43,19 +44,38 @@ func index() http.HandlerFunc {
 
 func secret() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		namespace := r.URL.Query().Get("namespace")
-		name := r.URL.Query().Get("name")
-		if strings.TrimSpace(namespace) == "" ||
-			strings.TrimSpace(name) == "" {
-			ctr.BadRequest(w, errors.New("namespace or name required"))
+		namespace := strings.TrimSpace(r.URL.Query().Get("namespace"))
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		// 未指定name时生成群组webhook密钥，指定system时生成系统webhook密钥
+		scope := util.JwtScopeProject
+		switch {
+		case r.URL.Query().Get("system") == "true":
+			scope = util.JwtScopeSystem
+			namespace, name = "", ""
+		case namespace == "":
+			ctr.BadRequest(w, errors.New("namespace required"))
+			return
+		case name == "":
+			scope = util.JwtScopeNamespace
+		}
+		// 群组和系统webhook密钥可访问多个项目，需要admin token
+		if scope != util.JwtScopeProject && !admin.Authorized(w, r) {
+			return
+		}
+		instanceName := r.URL.Query().Get("instance")
+		instance, err := global.SCMInstance(instanceName)
+		if err != nil {
+			ctr.BadRequest(w, err)
 			return
 		}
 		slug := path.Join(namespace, name)
 		authInfo := &util.JwtAuthInfo{
 			Slug:      slug,
+			Scope:     scope,
+			Instance:  instanceName,
 			CreatedAt: time.Now(),
 		}
-		authInfo.Signature = authInfo.BuildSign(global.Cfg().SCM.Secret)
+		authInfo.Signature = authInfo.BuildSign(instance.Config.Secret)
 		token, err := util.JwtCreate(util.JwtClaims{
 			Auth: authInfo,
 		}, global.JWTSecret)
@@ -186,6 +206,21 @@ func commandHelp() http.HandlerFunc {
                 <td>` + order + `</td>
                 <td><span class="label-item" style="background: ` + v.Color + `;">` + v.Name + `</span></td>
                 <td>` + v.Description + `</td>
+            </tr>` + "\n"
+		}
+		for _, v := range []struct{ order, description string }{
+			{order: "/assign [@user...]", description: "分配处理人，默认为评论者"},
+			{order: "/unassign [@user...]", description: "取消分配处理人，默认为评论者"},
+			{order: "/cc @user...", description: "请求指定用户评审"},
+			{order: "/uncc @user...", description: "取消请求指定用户评审"},
+			{order: "/retest", description: "重新执行最新流水线中失败的任务"},
+			{order: "/test job...", description: "重新执行最新流水线中的指定任务，手动任务则触发执行"},
+			{order: "/rebase", description: "将源分支变基到目标分支"},
+		} {
+			list += `<tr align="center">
+                <td>` + v.order + `</td>
+                <td></td>
+                <td>` + v.description + `</td>
             </tr>` + "\n"
 		}
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
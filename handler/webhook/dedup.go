@@ -0,0 +1,84 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"sync"
+	"time"
+)
+
+// deliveryStore remembers the delivery ids for ttl, at most size ids are kept.
+type deliveryStore struct {
+	mux  sync.Mutex
+	ttl  time.Duration
+	size int
+	// ids is the expiration of the delivery ids
+	ids map[string]time.Time
+	// order is the delivery ids in order of addition, which is also the order of expiration
+	order []string
+}
+
+func newDeliveryStore(ttl time.Duration, size int) *deliveryStore {
+	return &deliveryStore{
+		ttl:  ttl,
+		size: size,
+		ids:  make(map[string]time.Time),
+	}
+}
+
+// Add records the id, it returns false if the id already exists.
+func (s *deliveryStore) Add(id string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	s.evict(now)
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = now.Add(s.ttl)
+	s.order = append(s.order, id)
+	if len(s.order) > s.size {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// Remove forgets the id, so the redelivery can be accepted.
+func (s *deliveryStore) Remove(id string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.ids[id]; !ok {
+		return
+	}
+	delete(s.ids, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *deliveryStore) evict(now time.Time) {
+	for len(s.order) > 0 {
+		id := s.order[0]
+		if now.Before(s.ids[id]) {
+			return
+		}
+		delete(s.ids, id)
+		s.order = s.order[1:]
+	}
+}
@@ -15,19 +15,21 @@
 package event
 
 import (
+	"fmt"
+
 	"github.com/sirupsen/logrus"
-	"github.com/xanzy/go-gitlab"
 
+	"github.com/zc2638/review-bot/pkg/command"
 	"github.com/zc2638/review-bot/pkg/scm"
 	"github.com/zc2638/review-bot/pkg/util"
 )
 
 func NewComment(si scm.Interface, pid string, ref string, prID int) (*Comment, error) {
-	pr, err := si.GetPullRequest(pid, prID)
+	cfg, err := getReviewConfig(si, pid, ref)
 	if err != nil {
 		return nil, err
 	}
-	cfg, err := si.GetReviewConfig(pid, ref)
+	pr, err := getPullRequest(si, cfg, pid, prID)
 	if err != nil {
 		return nil, err
 	}
@@ -59,38 +61,69 @@ func (e *Comment) newMerge() *Merge {
 	}
 }
 
-func (e *Comment) Process(event *gitlab.MergeCommentEvent) error {
-	// 获取评论内容
-	note := event.ObjectAttributes.Note
+func (e *Comment) Process(event *scm.CommentEvent) error {
+	// 解析评论内容中的指令
+	cmds := command.Parse(event.Note)
 
 	var addLabels, removeLabels []string
 
 	// 匹配admin标签
-	if _, ok := util.InStringSlice(e.cfg.Approvers, event.User.Username); ok {
-		label := scm.AdminSet.FuzzyLabelWithKey("FORCE-MERGE", note)
+	if _, ok := util.InStringSlice(e.cfg.Approvers, event.Actor.Username); ok {
+		label := scm.AdminSet.MatchLabelWithKey("FORCE-MERGE", cmds)
 		if label != nil {
-			logrus.Infof("Run force merge by %s on PR(%v) in Repo(%s)", event.User.Username, e.prID, e.pid)
-			return e.newMerge().merge(event.MergeRequest.LastCommit.ID)
+			logrus.Infof("Run force merge by %s on PR(%v) in Repo(%s)", event.Actor.Username, e.prID, e.pid)
+			return e.newMerge().merge(e.lastCommitSHA(event))
 		}
 
-		label = scm.AdminSet.FuzzyLabelWithKey("APPROVE", note)
+		label = scm.AdminSet.MatchLabelWithKey("APPROVE", cmds)
 		if label != nil {
 			addLabels = append(addLabels, label.Name)
 		}
 	}
-	if _, ok := util.InStringSlice(e.cfg.Reviewers, event.User.Username); ok {
-		label := scm.AdminSet.FuzzyLabelWithKey("LGTM", note)
+	if _, ok := util.InStringSlice(e.cfg.Reviewers, event.Actor.Username); ok {
+		label := scm.AdminSet.MatchLabelWithKey("LGTM", cmds)
 		if label != nil {
 			addLabels = append(addLabels, label.Name)
 		}
 	}
 
-	adds, removes := dealCommonLabel(e.cfg, event.Project.PathWithNamespace, note)
+	// 处理 /retest 及 /test，失败时继续处理其他指令，最后返回错误
+	var errs []error
+	if err := e.retest(event, cmds); err != nil {
+		errs = append(errs, fmt.Errorf("retest failed: %v", err))
+	}
+	// 处理 /rebase
+	if err := e.rebase(event, cmds); err != nil {
+		errs = append(errs, fmt.Errorf("rebase failed: %v", err))
+	}
+
+	adds, removes := dealCommonLabel(e.si, e.cfg, e.pid, cmds)
 	addLabels = append(addLabels, adds...)
 	removeLabels = append(removeLabels, removes...)
 
-	if len(addLabels) == 0 && len(removeLabels) == 0 {
-		return nil
+	// 处理 /assign 及 /unassign
+	assignees, assigneeChanged, notMembers := dealAssignees(e.si, e.cfg, e.pid, event.Actor.Username, e.pr.AssigneeIDs, cmds)
+	if len(notMembers) > 0 {
+		if err := e.si.CreatePullRequestComment(e.pid, e.prID, notMembersComment(notMembers)); err != nil {
+			logrus.Warningf("pull request add not members comment failed: %s", err)
+		}
+	}
+
+	// 处理 /cc 及 /uncc
+	reviewers, reviewerChanged, notMembers, notAllowed := dealReviewers(e.si, e.cfg, e.pid, e.pr.ReviewerIDs, cmds)
+	if len(notMembers) > 0 {
+		if err := e.si.CreatePullRequestComment(e.pid, e.prID, notMembersComment(notMembers)); err != nil {
+			logrus.Warningf("pull request add not members comment failed: %s", err)
+		}
+	}
+	if len(notAllowed) > 0 {
+		if err := e.si.CreatePullRequestComment(e.pid, e.prID, notReviewersComment(notAllowed)); err != nil {
+			logrus.Warningf("pull request add not reviewers comment failed: %s", err)
+		}
+	}
+
+	if len(addLabels) == 0 && len(removeLabels) == 0 && !assigneeChanged && !reviewerChanged {
+		return joinErrors(errs...)
 	}
 
 	approveLabelName := scm.RemoveSet.LabelByKey("APPROVE").Name
@@ -98,11 +131,7 @@ func (e *Comment) Process(event *gitlab.MergeCommentEvent) error {
 		if v == approveLabelName {
 			// TODO Don't handle the error for now, continue to execute down.
 			// PREMIUM version supports this feature.
-			if err := e.si.MergePullRequestApprove(
-				event.Project.PathWithNamespace,
-				event.MergeRequest.IID,
-				false,
-			); err != nil {
+			if err := e.si.MergePullRequestApprove(e.pid, e.prID, false); err != nil {
 				logrus.Debugf("Remove approve failed: %v", err)
 			}
 			break
@@ -113,8 +142,34 @@ func (e *Comment) Process(event *gitlab.MergeCommentEvent) error {
 		Labels:       filterLabels(e.pr.Labels, addLabels, removeLabels),
 		AddLabels:    addLabels,
 		RemoveLabels: removeLabels,
-		AssigneeID:   event.MergeRequest.AssigneeID,
-		AssigneeIDs:  event.MergeRequest.AssigneeIDs,
+		AssigneeIDs:  event.AssigneeIDs,
+	}
+	if assigneeChanged {
+		opt.AssigneeIDs = assignees
+		opt.UnassignAll = len(assignees) == 0
+	}
+	if reviewerChanged {
+		opt.ReviewerIDs = reviewers
+		if opt.ReviewerIDs == nil {
+			opt.ReviewerIDs = []int{}
+		}
+	}
+	if err := e.si.UpdatePullRequest(e.pid, e.prID, opt); err != nil {
+		errs = append(errs, err)
+	}
+	return joinErrors(errs...)
+}
+
+// permitted reports whether the user is the author of the pull request, one of the reviewers or approvers.
+func (e *Comment) permitted(user scm.User) bool {
+	return user.ID == e.pr.AuthorID || privileged(e.cfg, user.Username)
+}
+
+// lastCommitSHA returns the last commit of the pull request,
+// some providers do not carry it in the comment event.
+func (e *Comment) lastCommitSHA(event *scm.CommentEvent) string {
+	if event.LastCommitSHA != "" {
+		return event.LastCommitSHA
 	}
-	return e.si.UpdatePullRequest(event.Project.PathWithNamespace, event.MergeRequest.IID, opt)
+	return e.pr.SHA
 }
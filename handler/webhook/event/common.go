@@ -15,34 +15,59 @@
 package event
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/99nil/go/sets"
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/zc2638/review-bot/global"
+	"github.com/zc2638/review-bot/pkg/command"
 	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/util"
 )
 
-func dealCommonLabel(config *scm.ReviewConfig, repo string, content string) (adds []string, removes []string) {
+// getReviewConfig gets the review config of the project from the cache first,
+// the project known to have no review config returns scm.ErrReviewConfigNotFound without requesting.
+func getReviewConfig(si scm.Interface, pid, ref string) (*scm.ReviewConfig, error) {
+	cache := scm.ReviewConfigCached()
+	cacheKey := scm.CacheKey(si, pid)
+	if cfg, ok := cache.Get(cacheKey, ref); ok {
+		if cfg == nil {
+			return nil, scm.ErrReviewConfigNotFound
+		}
+		return cfg, nil
+	}
+	cfg, err := si.GetReviewConfig(pid, ref)
+	if err == nil || err == scm.ErrReviewConfigNotFound {
+		cache.Add(cacheKey, ref, cfg)
+	}
+	return cfg, err
+}
+
+func dealCommonLabel(si scm.Interface, config *scm.ReviewConfig, repo string, cmds command.Commands) (adds []string, removes []string) {
 	// 匹配common标签
-	labels := scm.AddSet.FuzzyLabels(content)
+	labels := scm.AddSet.MatchLabels(cmds)
 	for _, v := range labels {
 		adds = append(adds, v.Name)
 	}
-	labels = scm.RemoveSet.FuzzyLabels(content)
+	labels = scm.RemoveSet.MatchLabels(cmds)
+	for _, v := range labels {
+		removes = append(removes, v.Name)
+	}
+	// 匹配取消指令，如 /hold cancel、/lgtm cancel
+	labels = append(scm.AddSet.CancelLabels(cmds), scm.AdminSet.CancelLabels(cmds)...)
 	for _, v := range labels {
 		removes = append(removes, v.Name)
 	}
 
 	// 匹配custom标签
-	labels = scm.CustomSet.FuzzyLabels(content)
+	labels = scm.CustomSet.MatchLabels(cmds)
 	for _, v := range labels {
 		adds = append(adds, v.Name)
 	}
 	// 匹配移除custom标签
-	labels = scm.CustomSet.FuzzyLabelsWithPrefix("remove", content)
+	labels = scm.CustomSet.MatchLabelsWithPrefix("remove", cmds)
 	for _, v := range labels {
 		removes = append(removes, v.Name)
 	}
@@ -54,20 +79,19 @@ func dealCommonLabel(config *scm.ReviewConfig, repo string, content string) (add
 	// 匹配配置内的custom标签
 	// 匹配移除配置内的custom标签
 	var currentLabels []scm.Label
+	cacheKey := scm.CacheKey(si, repo)
 	for _, v := range config.CustomLabels {
-		removeOrder := strings.TrimPrefix(v.Order, "/")
-		removeOrder = "/remove-" + removeOrder
-		if strings.Contains(content, removeOrder) {
+		if v.MatchWithPrefix("remove", cmds) {
 			removes = append(removes, v.Name)
 		}
-		if strings.Contains(content, v.Order) {
+		if v.Match(cmds) {
 			adds = append(adds, v.Name)
 		}
 
-		if !scm.RepoCached().IsExist(repo, v.Name) {
+		if !scm.RepoCached().IsExist(cacheKey, v.Name) {
 			if currentLabels == nil {
 				var err error
-				currentLabels, err = global.SCM().ListLabels(repo)
+				currentLabels, err = si.ListLabels(repo)
 				if err != nil {
 					logrus.Warningf("Sync custom labels failed: %s", err)
 					return
@@ -83,20 +107,265 @@ func dealCommonLabel(config *scm.ReviewConfig, repo string, content string) (add
 			}
 			if !exists {
 				// label创建失败暂不处理
-				if err := global.SCM().CreateLabel(repo, &v); err != nil {
+				if err := si.CreateLabel(repo, &v); err != nil {
 					logrus.Warningf("Create label failed: %s", err)
 					continue
 				}
 			}
-			scm.RepoCached().Add(repo, v.Name)
+			scm.RepoCached().Add(cacheKey, v.Name)
 		}
 	}
 	return
 }
 
+// getPullRequest gets the pull request, the admin labels of the pull request whose labels are emulated by the title
+// are rebuilt from the comments and approvals, because the title can be edited by the author.
+func getPullRequest(si scm.Interface, cfg *scm.ReviewConfig, pid string, prID int) (*scm.PullRequest, error) {
+	pr, err := si.GetPullRequest(pid, prID)
+	if err != nil || !pr.TitleLabels {
+		return pr, err
+	}
+	comments, err := si.ListPullRequestComments(pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	pr.Labels = replayLabels(pr.Labels, comments, pr.ApprovedBy, cfg)
+	return pr, nil
+}
+
+// replayLabels replaces the admin labels with the ones replayed from the comments and approvals,
+// the do-not-merge labels added by the comments are kept even if they are removed from the title.
+func replayLabels(labels []string, comments []scm.Comment, approvedBy []string, cfg *scm.ReviewConfig) []string {
+	var removes, adds []string
+	for _, v := range scm.AdminSet.Labels() {
+		removes = append(removes, v.Name)
+	}
+
+	reviewers, approvers := reviewUsers(comments, cfg)
+	for _, username := range approvedBy {
+		if _, ok := util.InStringSlice(cfg.Approvers, username); ok {
+			approvers = append(approvers, username)
+		}
+	}
+	if len(reviewers) > 0 {
+		adds = append(adds, scm.AdminSet.LabelByKey("LGTM").Name)
+	}
+	if len(approvers) > 0 {
+		adds = append(adds, scm.AdminSet.LabelByKey("APPROVE").Name)
+	}
+
+	holds := sets.NewString()
+	for _, comment := range comments {
+		cmds := command.Parse(comment.Body)
+		for _, v := range scm.AddSet.MatchLabels(cmds) {
+			holds.Add(v.Name)
+		}
+		for _, v := range append(scm.RemoveSet.MatchLabels(cmds), scm.AddSet.CancelLabels(cmds)...) {
+			holds.Remove(v.Name)
+		}
+	}
+	adds = append(adds, holds.List()...)
+	return filterLabels(filterLabels(labels, nil, removes), adds, nil)
+}
+
 func filterLabels(exists []string, adds []string, removes []string) []string {
 	s := sets.NewString(exists...)
 	s.Add(adds...)
 	s.Remove(removes...)
 	return s.List()
 }
+
+// initLabels creates the labels used by the bot if not exist.
+func initLabels(si scm.Interface, pid string) error {
+	cache := scm.Cached()
+	cacheKey := scm.CacheKey(si, pid)
+	if exists := cache.IsExist(cacheKey); exists {
+		return nil
+	}
+
+	labels, err := si.ListLabels(pid)
+	if err != nil {
+		return err
+	}
+
+	var allLabels []scm.Label
+	allLabels = append(allLabels, scm.AdminSet.Labels()...)
+	allLabels = append(allLabels, scm.AddSet.Labels()...)
+	allLabels = append(allLabels, scm.CustomSet.Labels()...)
+	allLabels = append(allLabels, scm.AutoSet.Labels()...)
+	for _, v := range allLabels {
+		var exists bool
+		for _, label := range labels {
+			if v.Name == label.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			// label创建失败暂不处理
+			_ = si.CreateLabel(pid, &v)
+		}
+	}
+
+	cache.Add(cacheKey)
+	return nil
+}
+
+// getMembers returns the project members of the names, the unknown names are skipped.
+func getMembers(si scm.Interface, pid string, names []string) map[string]scm.ProjectMember {
+	// 成员按项目缓存，其它项目的成员不能视为当前项目的成员
+	cacheKey := func(name string) string {
+		return scm.CacheKey(si, pid+":"+name)
+	}
+
+	var projectMembers []scm.ProjectMember
+	members := make(map[string]scm.ProjectMember)
+	for _, name := range names {
+		if member, ok := scm.UserCached().Get(cacheKey(name)); ok {
+			members[name] = member
+			continue
+		}
+		if projectMembers == nil {
+			// TODO 无需处理错误，错误时会返回nil
+			projectMembers, _ = si.ListProjectMembers(pid)
+			for _, v := range projectMembers {
+				scm.UserCached().Add(cacheKey(v.Username), v)
+			}
+		}
+		if member, ok := scm.UserCached().Get(cacheKey(name)); ok {
+			members[name] = member
+		}
+	}
+	return members
+}
+
+// privileged reports whether the user is one of the reviewers or approvers.
+func privileged(cfg *scm.ReviewConfig, username string) bool {
+	if _, ok := util.InStringSlice(cfg.Reviewers, username); ok {
+		return true
+	}
+	_, ok := util.InStringSlice(cfg.Approvers, username)
+	return ok
+}
+
+// memberOperation adds or removes the project member of the name.
+type memberOperation struct {
+	name string
+	add  bool
+}
+
+// applyMembers applies the operations to the user ids in order.
+// It returns the new ids, whether the ids are changed and the names which are not project members.
+func applyMembers(
+	si scm.Interface, pid string, current []int, operations []memberOperation,
+) (ids []int, changed bool, notMembers []string) {
+	names := make([]string, 0, len(operations))
+	for _, op := range operations {
+		names = append(names, op.name)
+	}
+	members := getMembers(si, pid, names)
+
+	ids = append([]int(nil), current...)
+	for _, op := range operations {
+		member, ok := members[op.name]
+		if !ok {
+			if _, exists := util.InStringSlice(notMembers, op.name); !exists {
+				notMembers = append(notMembers, op.name)
+			}
+			continue
+		}
+		index := -1
+		for i, id := range ids {
+			if id == member.ID {
+				index = i
+				break
+			}
+		}
+		switch {
+		case op.add && index < 0:
+			ids = append(ids, member.ID)
+			changed = true
+		case !op.add && index >= 0:
+			ids = append(ids[:index:index], ids[index+1:]...)
+			changed = true
+		}
+	}
+	return ids, changed, notMembers
+}
+
+// dealAssignees applies the `/assign` and `/unassign` commands to the current assignees in order,
+// the commands without arguments mean the commenter.
+// Project members can assign or unassign themselves, reviewers and approvers can assign or unassign the others.
+// It returns the new assignees, whether the assignees are changed and the names which are not project members.
+func dealAssignees(
+	si scm.Interface, cfg *scm.ReviewConfig, pid, username string, current []int, cmds command.Commands,
+) (assignees []int, changed bool, notMembers []string) {
+	var operations []memberOperation
+	for _, cmd := range cmds {
+		if cmd.Name != "assign" && cmd.Name != "unassign" {
+			continue
+		}
+		users := cmd.Usernames()
+		if len(users) == 0 {
+			users = []string{username}
+		}
+		for _, name := range users {
+			if name != username && !privileged(cfg, username) {
+				logrus.Infof("User(%s) is not allowed to %s others in project(%s)", username, cmd.Name, pid)
+				continue
+			}
+			operations = append(operations, memberOperation{name: name, add: cmd.Name == "assign"})
+		}
+	}
+	if len(operations) == 0 {
+		return current, false, nil
+	}
+	return applyMembers(si, pid, current, operations)
+}
+
+func notMembersComment(names []string) string {
+	return "@" + strings.Join(names, " @") + " 不是项目成员，相关指令未生效。"
+}
+
+// dealReviewers applies the `/cc` and `/uncc` commands to the current reviewers in order.
+// Only the reviewers and approvers can be requested to review, unless `cc_any_member` is enabled.
+func dealReviewers(
+	si scm.Interface, cfg *scm.ReviewConfig, pid string, current []int, cmds command.Commands,
+) (reviewers []int, changed bool, notMembers, notAllowed []string) {
+	var operations []memberOperation
+	for _, cmd := range cmds {
+		if cmd.Name != "cc" && cmd.Name != "uncc" {
+			continue
+		}
+		for _, name := range cmd.Usernames() {
+			if cmd.Name == "cc" && !cfg.PRConfig.CCAnyMember && !privileged(cfg, name) {
+				if _, exists := util.InStringSlice(notAllowed, name); !exists {
+					notAllowed = append(notAllowed, name)
+				}
+				continue
+			}
+			operations = append(operations, memberOperation{name: name, add: cmd.Name == "cc"})
+		}
+	}
+	if len(operations) == 0 {
+		return current, false, nil, notAllowed
+	}
+	reviewers, changed, notMembers = applyMembers(si, pid, current, operations)
+	return reviewers, changed, notMembers, notAllowed
+}
+
+func notReviewersComment(names []string) string {
+	return "@" + strings.Join(names, " @") + " 不是项目的 reviewers 或 approvers，无法请求评审。"
+}
+
+// joinErrors joins the errors into one, nil is returned without errors.
+func joinErrors(errs ...error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,1177 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/scm/fake"
+)
+
+const testReviewConfig = `
+reviewers:
+  - reviewer1
+approvers:
+  - approver1
+pullrequest:
+  squash_with_title: true
+`
+
+const testSHA = "0123456789abcdef"
+
+// newTestProject creates a project with an opened pull request.
+// The caches of scm are global, so every test case should use a unique pid.
+func newTestProject(pid string, labels ...string) *fake.Client {
+	scm.Cached().Remove(pid)
+	scm.ReviewConfigCached().Remove(pid)
+	client := fake.New()
+	client.AddProject(pid, &fake.Project{
+		ReviewConfig: map[string]string{"": testReviewConfig},
+		Members: []scm.ProjectMember{
+			{ID: 1, Username: "author"},
+			{ID: 2, Username: "reviewer1"},
+			{ID: 3, Username: "approver1"},
+		},
+		PullRequests: map[int]*scm.PullRequest{
+			1: {IID: 1, Title: "Title", State: "opened", Labels: labels, SHA: testSHA, AuthorID: 1},
+		},
+	})
+	return client
+}
+
+func TestMerge_Process(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     []string
+		event      scm.PullRequestEvent
+		wantErr    bool
+		wantLabels []string
+		wantStatus scm.BuildState
+		wantMerge  *scm.MergePullRequest
+	}{
+		{
+			name: "open",
+			event: scm.PullRequestEvent{
+				Action:      scm.EventActionOpen,
+				Actor:       scm.User{ID: 1, Username: "author"},
+				AuthorID:    1,
+				Description: "/kind bug",
+			},
+			wantLabels: []string{"kind/bugfix"},
+			wantStatus: scm.BuildStateRunning,
+		},
+		{
+			name:   "update without approved",
+			labels: []string{"lgtm"},
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionUpdate,
+				Labels: []string{"lgtm"},
+			},
+			wantLabels: []string{"lgtm"},
+			wantStatus: scm.BuildStateRunning,
+		},
+		{
+			name:   "update with do-not-merge",
+			labels: []string{"approved", "do-not-merge/hold", "lgtm"},
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionUpdate,
+				Labels: []string{"do-not-merge/hold", "lgtm", "approved"},
+			},
+			wantLabels: []string{"approved", "do-not-merge/hold", "lgtm"},
+			wantStatus: scm.BuildStateRunning,
+		},
+		{
+			name:   "update to merge",
+			labels: []string{"approved", "kind/bugfix", "lgtm"},
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionUpdate,
+				Labels: []string{"lgtm", "approved"},
+			},
+			wantLabels: []string{"approved", "kind/bugfix", "lgtm"},
+			wantStatus: scm.BuildStateSuccess,
+			wantMerge: &scm.MergePullRequest{
+				Squash:                    true,
+				SquashCommitMessage:       "fix:Title",
+				ShouldRemoveSourceBranch:  true,
+				MergeWhenPipelineSucceeds: true,
+			},
+		},
+		{
+			name:   "update with new commits",
+			labels: []string{"approved", "kind/bugfix", "lgtm"},
+			event: scm.PullRequestEvent{
+				Action:     scm.EventActionUpdate,
+				Labels:     []string{"lgtm", "approved"},
+				NewCommits: true,
+			},
+			wantLabels: []string{"approved", "kind/bugfix"},
+			wantStatus: scm.BuildStateRunning,
+		},
+		{
+			name:   "close",
+			labels: []string{"approved", "kind/bugfix", "lgtm"},
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionClose,
+			},
+			wantLabels: []string{"kind/bugfix"},
+			wantStatus: scm.BuildStateCanceled,
+		},
+		{
+			name:   "reopen",
+			labels: []string{"kind/bugfix"},
+			event: scm.PullRequestEvent{
+				Action:      scm.EventActionReopen,
+				Actor:       scm.User{ID: 1, Username: "author"},
+				AuthorID:    1,
+				Description: "/kind bug",
+			},
+			wantLabels: []string{"kind/bugfix"},
+			wantStatus: scm.BuildStateRunning,
+		},
+		{
+			name: "approve by approver",
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionApproved,
+				Actor:  scm.User{ID: 3, Username: "approver1"},
+			},
+			wantLabels: []string{"approved"},
+		},
+		{
+			name:   "unapprove by approver",
+			labels: []string{"approved", "lgtm"},
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionUnapproved,
+				Actor:  scm.User{ID: 3, Username: "approver1"},
+			},
+			wantLabels: []string{"lgtm"},
+		},
+		{
+			name: "approve by reviewer",
+			event: scm.PullRequestEvent{
+				Action: scm.EventActionApproved,
+				Actor:  scm.User{ID: 2, Username: "reviewer1"},
+			},
+			wantErr: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("merge/process-%d", i)
+			client := newTestProject(pid, tt.labels...)
+			tt.event.Repository = scm.Repository{FullName: pid}
+			tt.event.Number = 1
+			tt.event.LastCommitSHA = testSHA
+
+			e, err := NewMerge(client, pid, "main", 1, "http://bot")
+			if err != nil {
+				t.Fatalf("NewMerge() error = %v", err)
+			}
+			if err := e.Process(&tt.event); (err != nil) != tt.wantErr {
+				t.Fatalf("Process() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			project := client.Project(pid)
+			pr := project.PullRequests[1]
+			if tt.wantLabels != nil && !reflect.DeepEqual(pr.Labels, tt.wantLabels) {
+				t.Errorf("Process() labels = %v, want %v", pr.Labels, tt.wantLabels)
+			}
+			if got := project.Statuses[testSHA]; got != tt.wantStatus {
+				t.Errorf("Process() status = %v, want %v", got, tt.wantStatus)
+			}
+			if got := project.Merges[1]; !reflect.DeepEqual(got, tt.wantMerge) {
+				t.Errorf("Process() merge = %+v, want %+v", got, tt.wantMerge)
+			}
+		})
+	}
+}
+
+func TestMerge_Process_CloseUpdate(t *testing.T) {
+	for _, state := range []string{"closed", "merged"} {
+		t.Run(state, func(t *testing.T) {
+			pid := "merge/close-update-" + state
+			client := newTestProject(pid, "approved", "kind/bugfix", "lgtm")
+			project := client.Project(pid)
+			project.PullRequests[1].State = state
+
+			event := scm.PullRequestEvent{
+				Action:        scm.EventActionClose,
+				Repository:    scm.Repository{FullName: pid},
+				Number:        1,
+				LastCommitSHA: testSHA,
+			}
+			e, err := NewMerge(client, pid, "main", 1, "http://bot")
+			if err != nil {
+				t.Fatalf("NewMerge() error = %v", err)
+			}
+			if err := e.Process(&event); err != nil {
+				t.Fatalf("Process() close error = %v", err)
+			}
+
+			// 关闭时移除label触发的更新事件
+			event.Action = scm.EventActionUpdate
+			event.Labels = []string{"lgtm", "approved"}
+			e, err = NewMerge(client, pid, "main", 1, "http://bot")
+			if err != nil {
+				t.Fatalf("NewMerge() error = %v", err)
+			}
+			if err := e.Process(&event); err != nil {
+				t.Fatalf("Process() update error = %v", err)
+			}
+			if got := project.Statuses[testSHA]; got != scm.BuildStateCanceled {
+				t.Errorf("Process() status = %v, want %v", got, scm.BuildStateCanceled)
+			}
+			if got := project.Merges[1]; got != nil {
+				t.Errorf("Process() merge = %+v, want none", got)
+			}
+		})
+	}
+}
+
+func TestMerge_Process_TitleLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		notes      []scm.Comment
+		approvedBy []string
+		wantMerge  bool
+	}{
+		{
+			name: "forged by the author",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm\n/approve", Author: scm.User{ID: 1, Username: "author"}},
+			},
+		},
+		{
+			name: "reviewed by comments",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm", Author: scm.User{ID: 2, Username: "reviewer1"}},
+				{ID: 2, Body: "/approve", Author: scm.User{ID: 3, Username: "approver1"}},
+			},
+			wantMerge: true,
+		},
+		{
+			name: "approved on the provider",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm", Author: scm.User{ID: 2, Username: "reviewer1"}},
+			},
+			approvedBy: []string{"author", "approver1"},
+			wantMerge:  true,
+		},
+		{
+			name: "approved by the author on the provider",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm", Author: scm.User{ID: 2, Username: "reviewer1"}},
+			},
+			approvedBy: []string{"author"},
+		},
+		{
+			name: "hold removed from the title",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm\n/hold", Author: scm.User{ID: 2, Username: "reviewer1"}},
+				{ID: 2, Body: "/approve", Author: scm.User{ID: 3, Username: "approver1"}},
+			},
+		},
+		{
+			name: "hold canceled",
+			notes: []scm.Comment{
+				{ID: 1, Body: "/lgtm\n/hold", Author: scm.User{ID: 2, Username: "reviewer1"}},
+				{ID: 2, Body: "/approve\n/hold cancel", Author: scm.User{ID: 3, Username: "approver1"}},
+			},
+			wantMerge: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("merge/title-labels-%d", i)
+			// the author sets the admin labels in the title
+			client := newTestProject(pid, "approved", "lgtm")
+			project := client.Project(pid)
+			project.PullRequests[1].TitleLabels = true
+			project.PullRequests[1].ApprovedBy = tt.approvedBy
+			project.Notes[1] = tt.notes
+
+			e, err := NewMerge(client, pid, "main", 1, "http://bot")
+			if err != nil {
+				t.Fatalf("NewMerge() error = %v", err)
+			}
+			event := &scm.PullRequestEvent{
+				Action:        scm.EventActionUpdate,
+				Actor:         scm.User{ID: 1, Username: "author"},
+				Repository:    scm.Repository{FullName: pid},
+				Number:        1,
+				LastCommitSHA: testSHA,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			if got := project.Merges[1] != nil; got != tt.wantMerge {
+				t.Errorf("Process() merged = %v, want %v", got, tt.wantMerge)
+			}
+		})
+	}
+}
+
+func TestMerge_Process_OpenComment(t *testing.T) {
+	pid := "merge/open-comment"
+	client := newTestProject(pid)
+	e, err := NewMerge(client, pid, "main", 1, "http://bot")
+	if err != nil {
+		t.Fatalf("NewMerge() error = %v", err)
+	}
+	event := &scm.PullRequestEvent{
+		Action:        scm.EventActionOpen,
+		Actor:         scm.User{ID: 1, Username: "author"},
+		Repository:    scm.Repository{FullName: pid},
+		Number:        1,
+		AuthorID:      1,
+		LastCommitSHA: testSHA,
+	}
+	if err := e.Process(event); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	comments := client.Project(pid).Comments[1]
+	if len(comments) != 1 {
+		t.Fatalf("Process() comments = %v, want 1 comment", comments)
+	}
+	if !strings.Contains(comments[0], "@reviewer1") {
+		t.Errorf("Process() comment does not request reviewer1: %s", comments[0])
+	}
+	if len(client.Calls("CreateLabel")) == 0 {
+		t.Errorf("Process() labels are not initialized")
+	}
+}
+
+func TestMerge_Process_ResetApproved(t *testing.T) {
+	pid := "merge/reset-approved"
+	client := newTestProject(pid, "approved", "lgtm")
+	client.Project(pid).ReviewConfig[""] = testReviewConfig + "  reset_approved_on_push: true\n"
+	e, err := NewMerge(client, pid, "main", 1, "http://bot")
+	if err != nil {
+		t.Fatalf("NewMerge() error = %v", err)
+	}
+	event := &scm.PullRequestEvent{
+		Action:        scm.EventActionUpdate,
+		Repository:    scm.Repository{FullName: pid},
+		Number:        1,
+		LastCommitSHA: testSHA,
+		NewCommits:    true,
+	}
+	if err := e.Process(event); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	project := client.Project(pid)
+	if labels := project.PullRequests[1].Labels; len(labels) != 0 {
+		t.Errorf("Process() labels = %v, want empty", labels)
+	}
+	comments := project.Comments[1]
+	if len(comments) != 1 || !strings.Contains(comments[0], "`lgtm`、`approved`") {
+		t.Errorf("Process() comments = %v, want the reset comment", comments)
+	}
+}
+
+func TestMerge_Process_Merged(t *testing.T) {
+	pid := "merge/merged"
+	client := newTestProject(pid, "approved", "lgtm")
+	project := client.Project(pid)
+	project.PullRequests[1].State = "merged"
+	project.PullRequests[1].MergeCommitSHA = "fedcba9876543210"
+	project.ReviewConfig[""] = "reviewers:\n  - reviewer1\n  - reviewer2\napprovers:\n  - approver1\n  - approver2\n"
+	project.Notes[1] = []scm.Comment{
+		{ID: 1, Body: "/lgtm", Author: scm.User{ID: 1, Username: "author"}},
+		{ID: 2, Body: "looks good\n/lgtm", Author: scm.User{ID: 2, Username: "reviewer1"}},
+		{ID: 3, Body: "/approve", Author: scm.User{ID: 3, Username: "approver1"}},
+		// the lgtm is reset by the new commits
+		{ID: 4, Body: "检测到新的 commits 推送，已移除 `lgtm`，请重新 review。", Author: scm.User{ID: 9, Username: "bot"}},
+		{ID: 5, Body: "/lgtm", Author: scm.User{ID: 4, Username: "reviewer2"}},
+		{ID: 6, Body: "/approve", Author: scm.User{ID: 5, Username: "approver2"}},
+		{ID: 7, Body: "/approve cancel", Author: scm.User{ID: 3, Username: "approver1"}},
+		{ID: 8, Body: "/approve", Author: scm.User{ID: 5, Username: "approver2"}},
+	}
+	e, err := NewMerge(client, pid, "main", 1, "http://bot")
+	if err != nil {
+		t.Fatalf("NewMerge() error = %v", err)
+	}
+	event := &scm.PullRequestEvent{
+		Action:        scm.EventActionMerge,
+		Repository:    scm.Repository{FullName: pid},
+		Number:        1,
+		LastCommitSHA: testSHA,
+	}
+	if err := e.Process(event); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	comments := project.Comments[1]
+	if len(comments) != 1 {
+		t.Fatalf("Process() comments = %v, want 1 comment", comments)
+	}
+	for _, want := range []string{"代码审查人员): @reviewer2  ", "请求审批人员): @approver2  ", "fedcba9876543210"} {
+		if !strings.Contains(comments[0], want) {
+			t.Errorf("Process() comment = %s, want contains %s", comments[0], want)
+		}
+	}
+}
+
+func TestMerge_ProcessPipeline(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      []string
+		event       scm.PipelineEvent
+		wantLabels  []string
+		wantMerge   bool
+		wantComment bool
+	}{
+		{
+			name:        "failed",
+			labels:      []string{"lgtm"},
+			event:       scm.PipelineEvent{Status: scm.PipelineStatusFailed, SHA: testSHA},
+			wantLabels:  []string{"do-not-merge/ci-failed", "lgtm"},
+			wantComment: true,
+		},
+		{
+			name:       "failed again",
+			labels:     []string{"do-not-merge/ci-failed", "lgtm"},
+			event:      scm.PipelineEvent{Status: scm.PipelineStatusFailed, SHA: testSHA},
+			wantLabels: []string{"do-not-merge/ci-failed", "lgtm"},
+		},
+		{
+			name:       "succeeded to merge",
+			labels:     []string{"approved", "do-not-merge/ci-failed", "lgtm"},
+			event:      scm.PipelineEvent{Status: scm.PipelineStatusSuccess, SHA: testSHA},
+			wantLabels: []string{"approved", "lgtm"},
+			wantMerge:  true,
+		},
+		{
+			name:       "succeeded without approved",
+			labels:     []string{"do-not-merge/ci-failed", "lgtm"},
+			event:      scm.PipelineEvent{Status: scm.PipelineStatusSuccess, SHA: testSHA},
+			wantLabels: []string{"lgtm"},
+		},
+		{
+			name:       "outdated",
+			labels:     []string{"lgtm"},
+			event:      scm.PipelineEvent{Status: scm.PipelineStatusFailed, SHA: "outdated"},
+			wantLabels: []string{"lgtm"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("merge/pipeline-%d", i)
+			client := newTestProject(pid, tt.labels...)
+			e, err := NewMerge(client, pid, "main", 1, "http://bot")
+			if err != nil {
+				t.Fatalf("NewMerge() error = %v", err)
+			}
+			if err := e.ProcessPipeline(&tt.event); err != nil {
+				t.Fatalf("ProcessPipeline() error = %v", err)
+			}
+
+			project := client.Project(pid)
+			if got := project.PullRequests[1].Labels; !reflect.DeepEqual(got, tt.wantLabels) {
+				t.Errorf("ProcessPipeline() labels = %v, want %v", got, tt.wantLabels)
+			}
+			if got := project.Merges[1] != nil; got != tt.wantMerge {
+				t.Errorf("ProcessPipeline() merged = %v, want %v", got, tt.wantMerge)
+			}
+			if got := len(project.Comments[1]) > 0; got != tt.wantComment {
+				t.Errorf("ProcessPipeline() commented = %v, want %v", got, tt.wantComment)
+			}
+		})
+	}
+}
+
+func TestComment_Process(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      []string
+		user        string
+		note        string
+		wantLabels  []string
+		wantUpdate  bool
+		wantMerged  bool
+		wantApprove bool
+	}{
+		{
+			name:       "lgtm by reviewer",
+			user:       "reviewer1",
+			note:       "/lgtm",
+			wantLabels: []string{"lgtm"},
+			wantUpdate: true,
+		},
+		{
+			name:       "lgtm by others",
+			user:       "author",
+			note:       "/lgtm",
+			wantUpdate: false,
+		},
+		{
+			name:       "lgtm in code and quote",
+			user:       "reviewer1",
+			note:       "> /lgtm\n```\n/lgtm\n```\n/holdup",
+			wantUpdate: false,
+		},
+		{
+			name:       "lgtm cancel",
+			labels:     []string{"do-not-merge/hold", "lgtm"},
+			user:       "author",
+			note:       "/lgtm cancel\n/hold cancel\n/kind bug",
+			wantLabels: []string{"kind/bugfix"},
+			wantUpdate: true,
+		},
+		{
+			name:       "approve by approver",
+			user:       "approver1",
+			note:       "/approve",
+			wantLabels: []string{"approved"},
+			wantUpdate: true,
+		},
+		{
+			name:       "common labels",
+			labels:     []string{"do-not-merge/hold"},
+			user:       "author",
+			note:       "/remove-hold\n/kind feature",
+			wantLabels: []string{"kind/feature"},
+			wantUpdate: true,
+		},
+		{
+			name:        "remove approve",
+			labels:      []string{"approved", "lgtm"},
+			user:        "author",
+			note:        "/remove-approve",
+			wantLabels:  []string{"lgtm"},
+			wantUpdate:  true,
+			wantApprove: true,
+		},
+		{
+			name:       "force merge by approver",
+			user:       "approver1",
+			note:       "/force-merge",
+			wantMerged: true,
+		},
+		{
+			name:       "force merge by others",
+			user:       "reviewer1",
+			note:       "/force-merge",
+			wantUpdate: false,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("comment/process-%d", i)
+			client := newTestProject(pid, tt.labels...)
+			e, err := NewComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewComment() error = %v", err)
+			}
+			event := &scm.CommentEvent{
+				Actor:      scm.User{Username: tt.user},
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       tt.note,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			project := client.Project(pid)
+			if got := len(client.Calls("UpdatePullRequest")) > 0; got != tt.wantUpdate {
+				t.Errorf("Process() updated = %v, want %v", got, tt.wantUpdate)
+			}
+			if tt.wantLabels != nil && !reflect.DeepEqual(project.PullRequests[1].Labels, tt.wantLabels) {
+				t.Errorf("Process() labels = %v, want %v", project.PullRequests[1].Labels, tt.wantLabels)
+			}
+			if got := project.Merges[1] != nil; got != tt.wantMerged {
+				t.Errorf("Process() merged = %v, want %v", got, tt.wantMerged)
+			}
+			if got := len(client.Calls("MergePullRequestApprove")) > 0; got != tt.wantApprove {
+				t.Errorf("Process() unapproved = %v, want %v", got, tt.wantApprove)
+			}
+		})
+	}
+}
+
+func TestComment_Process_Assign(t *testing.T) {
+	tests := []struct {
+		name          string
+		assignees     []int
+		user          string
+		note          string
+		wantAssignees []int
+		wantUpdate    bool
+		wantComment   string
+	}{
+		{
+			name:          "assign self",
+			user:          "author",
+			note:          "/assign",
+			wantAssignees: []int{1},
+			wantUpdate:    true,
+		},
+		{
+			name:          "assign others by reviewer",
+			assignees:     []int{1},
+			user:          "reviewer1",
+			note:          "/assign @reviewer1 @approver1",
+			wantAssignees: []int{1, 2, 3},
+			wantUpdate:    true,
+		},
+		{
+			name:          "assign others by author",
+			user:          "author",
+			note:          "/assign @reviewer1",
+			wantAssignees: []int{},
+			wantUpdate:    false,
+		},
+		{
+			name:          "unassign",
+			assignees:     []int{1, 2, 3},
+			user:          "approver1",
+			note:          "/unassign @author\n/unassign",
+			wantAssignees: []int{2},
+			wantUpdate:    true,
+		},
+		{
+			name:          "unassign all",
+			assignees:     []int{1},
+			user:          "author",
+			note:          "/unassign",
+			wantAssignees: []int{},
+			wantUpdate:    true,
+		},
+		{
+			name:          "not member",
+			assignees:     []int{1},
+			user:          "reviewer1",
+			note:          "/assign @someone",
+			wantAssignees: []int{1},
+			wantUpdate:    false,
+			wantComment:   "@someone 不是项目成员",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("comment/assign-%d", i)
+			client := newTestProject(pid)
+			project := client.Project(pid)
+			project.Assignees[1] = tt.assignees
+			e, err := NewComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewComment() error = %v", err)
+			}
+			event := &scm.CommentEvent{
+				Actor:      scm.User{Username: tt.user},
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       tt.note,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			if got := len(client.Calls("UpdatePullRequest")) > 0; got != tt.wantUpdate {
+				t.Errorf("Process() updated = %v, want %v", got, tt.wantUpdate)
+			}
+			if got := append([]int{}, project.Assignees[1]...); !reflect.DeepEqual(got, tt.wantAssignees) {
+				t.Errorf("Process() assignees = %v, want %v", got, tt.wantAssignees)
+			}
+			comments := project.Comments[1]
+			if tt.wantComment == "" && len(comments) != 0 {
+				t.Errorf("Process() comments = %v, want none", comments)
+			}
+			if tt.wantComment != "" && (len(comments) != 1 || !strings.Contains(comments[0], tt.wantComment)) {
+				t.Errorf("Process() comments = %v, want %s", comments, tt.wantComment)
+			}
+		})
+	}
+}
+
+func TestGetMembers(t *testing.T) {
+	client := newTestProject("members/a")
+	project := client.Project("members/a")
+	project.Members = append(project.Members, scm.ProjectMember{ID: 4, Username: "someone"})
+	client.AddProject("members/b", &fake.Project{
+		Members: []scm.ProjectMember{{ID: 1, Username: "author"}},
+	})
+
+	if got := getMembers(client, "members/a", []string{"author", "someone"}); len(got) != 2 {
+		t.Errorf("getMembers() of members/a = %v, want 2 members", got)
+	}
+	got := getMembers(client, "members/b", []string{"author", "someone"})
+	if _, ok := got["someone"]; ok || len(got) != 1 {
+		t.Errorf("getMembers() of members/b = %v, want only author", got)
+	}
+}
+
+func TestComment_Process_CC(t *testing.T) {
+	tests := []struct {
+		name          string
+		reviewers     []int
+		anyMember     bool
+		note          string
+		wantReviewers []int
+		wantUpdate    bool
+		wantComment   string
+	}{
+		{
+			name:          "cc",
+			note:          "/cc @reviewer1 @approver1",
+			wantReviewers: []int{2, 3},
+			wantUpdate:    true,
+		},
+		{
+			name:          "cc exists",
+			reviewers:     []int{2},
+			note:          "/cc @reviewer1",
+			wantReviewers: []int{2},
+			wantUpdate:    false,
+		},
+		{
+			name:          "uncc",
+			reviewers:     []int{2, 3},
+			note:          "/uncc @reviewer1",
+			wantReviewers: []int{3},
+			wantUpdate:    true,
+		},
+		{
+			name:          "uncc all",
+			reviewers:     []int{2},
+			note:          "/uncc @reviewer1",
+			wantReviewers: []int{},
+			wantUpdate:    true,
+		},
+		{
+			name:          "cc not reviewer",
+			note:          "/cc @author",
+			wantReviewers: []int{},
+			wantUpdate:    false,
+			wantComment:   "@author 不是项目的 reviewers 或 approvers",
+		},
+		{
+			name:          "cc any member",
+			anyMember:     true,
+			note:          "/cc @author",
+			wantReviewers: []int{1},
+			wantUpdate:    true,
+		},
+		{
+			name:          "cc not member",
+			anyMember:     true,
+			note:          "/cc @someone",
+			wantReviewers: []int{},
+			wantUpdate:    false,
+			wantComment:   "@someone 不是项目成员",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("comment/cc-%d", i)
+			client := newTestProject(pid)
+			project := client.Project(pid)
+			project.Reviewers[1] = tt.reviewers
+			if tt.anyMember {
+				project.ReviewConfig[""] = testReviewConfig + "  cc_any_member: true\n"
+			}
+			e, err := NewComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewComment() error = %v", err)
+			}
+			event := &scm.CommentEvent{
+				Actor:      scm.User{Username: "author"},
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       tt.note,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			if got := len(client.Calls("UpdatePullRequest")) > 0; got != tt.wantUpdate {
+				t.Errorf("Process() updated = %v, want %v", got, tt.wantUpdate)
+			}
+			if got := append([]int{}, project.Reviewers[1]...); !reflect.DeepEqual(got, tt.wantReviewers) {
+				t.Errorf("Process() reviewers = %v, want %v", got, tt.wantReviewers)
+			}
+			comments := project.Comments[1]
+			if tt.wantComment == "" && len(comments) != 0 {
+				t.Errorf("Process() comments = %v, want none", comments)
+			}
+			if tt.wantComment != "" && (len(comments) != 1 || !strings.Contains(comments[0], tt.wantComment)) {
+				t.Errorf("Process() comments = %v, want %s", comments, tt.wantComment)
+			}
+		})
+	}
+}
+
+func TestComment_Process_Retest(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		user        scm.User
+		note        string
+		wantStatus  map[string]scm.BuildState
+		wantRetries int
+		wantComment string
+	}{
+		{
+			name:   "retest",
+			status: scm.BuildStateFailed,
+			user:   scm.User{ID: 1, Username: "author"},
+			note:   "/retest",
+			wantStatus: map[string]scm.BuildState{
+				"build": scm.BuildStateSuccess,
+				"test":  scm.BuildStatePending,
+				"e2e":   scm.BuildStatePending,
+				"lint":  scm.BuildStateManual,
+			},
+			wantRetries: 1,
+		},
+		{
+			name:        "retest succeeded pipeline",
+			status:      scm.BuildStateSuccess,
+			user:        scm.User{ID: 2, Username: "reviewer1"},
+			note:        "/retest",
+			wantComment: "无需重新执行",
+		},
+		{
+			name:   "test jobs",
+			status: scm.BuildStateFailed,
+			user:   scm.User{ID: 3, Username: "approver1"},
+			note:   "/test build lint\n/test build",
+			wantStatus: map[string]scm.BuildState{
+				"build": scm.BuildStatePending,
+				"test":  scm.BuildStateFailed,
+				"e2e":   scm.BuildStateCanceled,
+				"lint":  scm.BuildStatePending,
+			},
+			wantRetries: 2,
+		},
+		{
+			name:        "test unknown job",
+			status:      scm.BuildStateFailed,
+			user:        scm.User{ID: 1, Username: "author"},
+			note:        "/test unknown",
+			wantComment: "未找到任务：`unknown`",
+		},
+		{
+			name:   "not permitted",
+			status: scm.BuildStateFailed,
+			user:   scm.User{ID: 4, Username: "someone"},
+			note:   "/retest",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("comment/retest-%d", i)
+			client := newTestProject(pid)
+			project := client.Project(pid)
+			project.Pipelines[1] = []scm.Pipeline{
+				{ID: 11, SHA: testSHA, Status: tt.status},
+				{ID: 10, Status: scm.BuildStateFailed},
+			}
+			project.Jobs[11] = []scm.Job{
+				{ID: 1, Name: "build", Status: scm.BuildStateSuccess},
+				{ID: 2, Name: "test", Status: scm.BuildStateFailed},
+				{ID: 3, Name: "e2e", Status: scm.BuildStateCanceled},
+				{ID: 4, Name: "lint", Status: scm.BuildStateManual},
+			}
+			e, err := NewComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewComment() error = %v", err)
+			}
+			event := &scm.CommentEvent{
+				Actor:      tt.user,
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       tt.note,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			retries := len(client.Calls("RetryPipeline")) + len(client.Calls("RetryJob")) + len(client.Calls("PlayJob"))
+			if retries != tt.wantRetries {
+				t.Errorf("Process() retried %d times, want %d", retries, tt.wantRetries)
+			}
+			for _, job := range project.Jobs[11] {
+				if want, ok := tt.wantStatus[job.Name]; ok && job.Status != want {
+					t.Errorf("Process() job(%s) status = %s, want %s", job.Name, job.Status, want)
+				}
+			}
+			comments := project.Comments[1]
+			if tt.wantComment == "" && len(comments) != 0 {
+				t.Errorf("Process() comments = %v, want none", comments)
+			}
+			if tt.wantComment != "" && (len(comments) != 1 || !strings.Contains(comments[0], tt.wantComment)) {
+				t.Errorf("Process() comments = %v, want %s", comments, tt.wantComment)
+			}
+		})
+	}
+}
+
+func TestComment_Process_CommandError(t *testing.T) {
+	pid := "comment/command-error"
+	client := newTestProject(pid)
+	client.Project(pid).Pipelines[1] = []scm.Pipeline{{ID: 11, SHA: testSHA, Status: scm.BuildStateFailed}}
+	client.SetError("RetryPipeline", errors.New("retry pipeline failed"))
+	e, err := NewComment(client, pid, "main", 1)
+	if err != nil {
+		t.Fatalf("NewComment() error = %v", err)
+	}
+	event := &scm.CommentEvent{
+		Actor:      scm.User{ID: 2, Username: "reviewer1"},
+		Repository: scm.Repository{FullName: pid},
+		Number:     1,
+		Note:       "/retest\n/lgtm",
+	}
+	if err := e.Process(event); err == nil || !strings.Contains(err.Error(), "retry pipeline failed") {
+		t.Fatalf("Process() error = %v, want the retest error", err)
+	}
+	// 重新执行失败时其他指令仍然生效
+	if got := client.Project(pid).PullRequests[1].Labels; !reflect.DeepEqual(got, []string{"lgtm"}) {
+		t.Errorf("Process() labels = %v, want [lgtm]", got)
+	}
+}
+
+func TestComment_Process_Rebase(t *testing.T) {
+	interval, timeout := rebasePollInterval, rebaseTimeout
+	rebasePollInterval, rebaseTimeout = time.Millisecond, 10*time.Millisecond
+	defer func() { rebasePollInterval, rebaseTimeout = interval, timeout }()
+
+	tests := []struct {
+		name        string
+		user        scm.User
+		staleError  string
+		mergeError  string
+		pending     bool
+		err         error
+		wantRebase  bool
+		wantComment string
+	}{
+		{
+			name:        "rebase",
+			user:        scm.User{ID: 1, Username: "author"},
+			wantRebase:  true,
+			wantComment: "已将 `feature` 变基到 `main`",
+		},
+		{
+			name:        "merge error before rebase",
+			user:        scm.User{ID: 1, Username: "author"},
+			staleError:  "Rebase failed. Please rebase locally",
+			wantRebase:  true,
+			wantComment: "已将 `feature` 变基到 `main`",
+		},
+		{
+			name:        "conflict",
+			user:        scm.User{ID: 2, Username: "reviewer1"},
+			mergeError:  "Rebase failed. Please rebase locally",
+			wantRebase:  true,
+			wantComment: "Rebase failed. Please rebase locally",
+		},
+		{
+			name:        "conflict with the merge error before rebase",
+			user:        scm.User{ID: 1, Username: "author"},
+			staleError:  "Rebase failed. Please rebase locally",
+			mergeError:  "Rebase failed. Please rebase locally",
+			wantRebase:  true,
+			wantComment: "变基失败",
+		},
+		{
+			name:        "timeout",
+			user:        scm.User{ID: 1, Username: "author"},
+			pending:     true,
+			wantRebase:  true,
+			wantComment: "变基等待超时",
+		},
+		{
+			name:        "conflict reported by provider",
+			user:        scm.User{ID: 3, Username: "approver1"},
+			err:         scm.ErrRebaseConflict,
+			wantRebase:  true,
+			wantComment: "变基失败",
+		},
+		{
+			name:        "not supported",
+			user:        scm.User{ID: 1, Username: "author"},
+			err:         scm.ErrNotSupported,
+			wantRebase:  true,
+			wantComment: "不支持变基",
+		},
+		{
+			name: "not permitted",
+			user: scm.User{ID: 4, Username: "someone"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("comment/rebase-%d", i)
+			client := newTestProject(pid)
+			project := client.Project(pid)
+			project.PullRequests[1].SourceBranch = "feature"
+			project.PullRequests[1].TargetBranch = "main"
+			project.PullRequests[1].MergeError = tt.staleError
+			if tt.mergeError != "" {
+				project.RebaseErrors[1] = tt.mergeError
+			}
+			project.RebasePending[1] = tt.pending
+			client.SetError("RebasePullRequest", tt.err)
+			e, err := NewComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewComment() error = %v", err)
+			}
+			event := &scm.CommentEvent{
+				Actor:      tt.user,
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       "/rebase",
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			if got := len(client.Calls("RebasePullRequest")) > 0; got != tt.wantRebase {
+				t.Errorf("Process() rebased = %v, want %v", got, tt.wantRebase)
+			}
+			if project.PullRequests[1].RebaseInProgress != tt.pending {
+				t.Errorf("Process() reported before the rebase finished")
+			}
+			comments := project.Comments[1]
+			if tt.wantComment == "" && len(comments) != 0 {
+				t.Errorf("Process() comments = %v, want none", comments)
+			}
+			if tt.wantComment != "" && (len(comments) != 1 || !strings.Contains(comments[0], tt.wantComment)) {
+				t.Errorf("Process() comments = %v, want %s", comments, tt.wantComment)
+			}
+		})
+	}
+}
+
+func TestIssueComment_Process(t *testing.T) {
+	tests := []struct {
+		name          string
+		state         string
+		assignees     []int
+		user          scm.User
+		note          string
+		wantLabels    []string
+		wantState     string
+		wantAssignees []int
+		wantUpdate    bool
+	}{
+		{
+			name:       "kind",
+			user:       scm.User{ID: 4, Username: "someone"},
+			note:       "/kind bug",
+			wantLabels: []string{"kind/bugfix"},
+			wantUpdate: true,
+		},
+		{
+			name:       "close by author",
+			user:       scm.User{ID: 1, Username: "author"},
+			note:       "/close",
+			wantState:  "closed",
+			wantUpdate: true,
+		},
+		{
+			name:       "close by reviewer",
+			user:       scm.User{ID: 2, Username: "reviewer1"},
+			note:       "/close",
+			wantState:  "closed",
+			wantUpdate: true,
+		},
+		{
+			name:       "close by others",
+			user:       scm.User{ID: 4, Username: "someone"},
+			note:       "/close",
+			wantState:  "opened",
+			wantUpdate: false,
+		},
+		{
+			name:       "reopen by approver",
+			state:      "closed",
+			user:       scm.User{ID: 3, Username: "approver1"},
+			note:       "/reopen",
+			wantState:  "opened",
+			wantUpdate: true,
+		},
+		{
+			name:          "assign self",
+			user:          scm.User{ID: 1, Username: "author"},
+			note:          "/assign",
+			wantAssignees: []int{1},
+			wantUpdate:    true,
+		},
+		{
+			name:          "assign others by reviewer",
+			assignees:     []int{1},
+			user:          scm.User{ID: 2, Username: "reviewer1"},
+			note:          "/assign @approver1 @someone",
+			wantAssignees: []int{1, 3},
+			wantUpdate:    true,
+		},
+		{
+			name:       "assign others by author",
+			user:       scm.User{ID: 1, Username: "author"},
+			note:       "/assign @reviewer1",
+			wantUpdate: false,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid := fmt.Sprintf("issue/process-%d", i)
+			client := newTestProject(pid)
+			state := tt.state
+			if state == "" {
+				state = "opened"
+			}
+			project := client.Project(pid)
+			project.Issues[1] = &scm.Issue{IID: 1, Title: "Issue", State: state, AuthorID: 1, AssigneeIDs: tt.assignees}
+
+			e, err := NewIssueComment(client, pid, "main", 1)
+			if err != nil {
+				t.Fatalf("NewIssueComment() error = %v", err)
+			}
+			event := &scm.IssueCommentEvent{
+				Actor:      tt.user,
+				Repository: scm.Repository{FullName: pid},
+				Number:     1,
+				Note:       tt.note,
+			}
+			if err := e.Process(event); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			issue := project.Issues[1]
+			if got := len(client.Calls("UpdateIssue")) > 0; got != tt.wantUpdate {
+				t.Errorf("Process() updated = %v, want %v", got, tt.wantUpdate)
+			}
+			if tt.wantLabels != nil && !reflect.DeepEqual(issue.Labels, tt.wantLabels) {
+				t.Errorf("Process() labels = %v, want %v", issue.Labels, tt.wantLabels)
+			}
+			if tt.wantState != "" && issue.State != tt.wantState {
+				t.Errorf("Process() state = %v, want %v", issue.State, tt.wantState)
+			}
+			if tt.wantAssignees != nil && !reflect.DeepEqual(issue.AssigneeIDs, tt.wantAssignees) {
+				t.Errorf("Process() assignees = %v, want %v", issue.AssigneeIDs, tt.wantAssignees)
+			}
+		})
+	}
+}
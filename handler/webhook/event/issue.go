@@ -0,0 +1,99 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/command"
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+func NewIssueComment(si scm.Interface, pid string, ref string, issueID int) (*IssueComment, error) {
+	cfg, err := getReviewConfig(si, pid, ref)
+	if err != nil {
+		return nil, err
+	}
+	issue, err := si.GetIssue(pid, issueID)
+	if err != nil {
+		return nil, err
+	}
+	return &IssueComment{
+		si:      si,
+		cfg:     cfg,
+		issue:   issue,
+		pid:     pid,
+		issueID: issueID,
+	}, nil
+}
+
+// IssueComment handles the commands in the comment of the issue.
+type IssueComment struct {
+	si    scm.Interface
+	cfg   *scm.ReviewConfig
+	issue *scm.Issue
+
+	pid     string
+	issueID int
+}
+
+func (e *IssueComment) Process(event *scm.IssueCommentEvent) error {
+	cmds := command.Parse(event.Note)
+	username := event.Actor.Username
+	opt := &scm.UpdateIssue{}
+
+	// 匹配common及custom标签
+	_ = initLabels(e.si, e.pid)
+	addLabels, removeLabels := dealCommonLabel(e.si, e.cfg, e.pid, cmds)
+
+	// issue创建者、reviewers及approvers可以关闭或重新打开issue
+	if cmds.Has("close") && e.issue.State != "closed" {
+		if e.canChangeState(event) {
+			opt.StateEvent = scm.IssueStateEventClose
+		} else {
+			logrus.Infof("User(%s) is not allowed to close issue(%s#%d)", username, e.pid, e.issueID)
+		}
+	}
+	if cmds.Has("reopen") && e.issue.State == "closed" {
+		if e.canChangeState(event) {
+			opt.StateEvent = scm.IssueStateEventReopen
+		} else {
+			logrus.Infof("User(%s) is not allowed to reopen issue(%s#%d)", username, e.pid, e.issueID)
+		}
+	}
+
+	assignees, assigneeChanged, notMembers := dealAssignees(e.si, e.cfg, e.pid, username, e.issue.AssigneeIDs, cmds)
+	if len(notMembers) > 0 {
+		if err := e.si.CreateIssueComment(e.pid, e.issueID, notMembersComment(notMembers)); err != nil {
+			logrus.Warningf("issue add not members comment failed: %s", err)
+		}
+	}
+	if assigneeChanged {
+		opt.AssigneeIDs = assignees
+		opt.UnassignAll = len(assignees) == 0
+	}
+
+	if len(addLabels) == 0 && len(removeLabels) == 0 && opt.StateEvent == "" && !assigneeChanged {
+		return nil
+	}
+	opt.Labels = filterLabels(e.issue.Labels, addLabels, removeLabels)
+	opt.AddLabels = addLabels
+	opt.RemoveLabels = removeLabels
+	return e.si.UpdateIssue(e.pid, e.issueID, opt)
+}
+
+func (e *IssueComment) canChangeState(event *scm.IssueCommentEvent) bool {
+	return event.Actor.ID == e.issue.AuthorID || privileged(e.cfg, event.Actor.Username)
+}
@@ -21,20 +21,18 @@ import (
 	"github.com/zc2638/review-bot/pkg/util"
 
 	"github.com/sirupsen/logrus"
-	"github.com/xanzy/go-gitlab"
 	"golang.org/x/sync/errgroup"
 
-	"github.com/zc2638/review-bot/global"
-
+	"github.com/zc2638/review-bot/pkg/command"
 	"github.com/zc2638/review-bot/pkg/scm"
 )
 
 func NewMerge(si scm.Interface, pid string, ref string, prID int, host string) (*Merge, error) {
-	pr, err := si.GetPullRequest(pid, prID)
+	cfg, err := getReviewConfig(si, pid, ref)
 	if err != nil {
 		return nil, err
 	}
-	cfg, err := si.GetReviewConfig(pid, ref)
+	pr, err := getPullRequest(si, cfg, pid, prID)
 	if err != nil {
 		return nil, err
 	}
@@ -58,26 +56,30 @@ type Merge struct {
 	host string
 }
 
-func (e *Merge) Process(event *gitlab.MergeEvent) error {
+func (e *Merge) Process(event *scm.PullRequestEvent) error {
 	// 处理merge事件
 	var err error
-	switch event.ObjectAttributes.Action {
-	case "merge", "close", "reopen":
-	case "open":
+	switch event.Action {
+	case scm.EventActionMerge:
+		err = e.merged()
+	case scm.EventActionClose:
+		err = e.close(event)
+	case scm.EventActionOpen, scm.EventActionReopen:
+		// 重新打开时重新执行初始化
 		err = e.open(event)
-	case "update":
+	case scm.EventActionUpdate:
 		err = e.update(event)
-	case "approved":
+	case scm.EventActionApproved:
 		err = e.approve(event, true)
-	case "unapproved":
+	case scm.EventActionUnapproved:
 		err = e.approve(event, false)
 	}
 	return err
 }
 
-func (e *Merge) approve(event *gitlab.MergeEvent, approved bool) error {
-	if _, ok := util.InStringSlice(e.cfg.Approvers, event.User.Username); !ok {
-		return fmt.Errorf("this user(%s) does not have the approve permission, the operation is prohibited", event.User.Username)
+func (e *Merge) approve(event *scm.PullRequestEvent, approved bool) error {
+	if _, ok := util.InStringSlice(e.cfg.Approvers, event.Actor.Username); !ok {
+		return fmt.Errorf("this user(%s) does not have the approve permission, the operation is prohibited", event.Actor.Username)
 	}
 
 	label := scm.AdminSet.LabelByKey("APPROVE").Name
@@ -93,24 +95,20 @@ func (e *Merge) approve(event *gitlab.MergeEvent, approved bool) error {
 	return e.si.UpdatePullRequest(e.pid, e.prID, opt)
 }
 
-func (e *Merge) open(event *gitlab.MergeEvent) error {
+func (e *Merge) open(event *scm.PullRequestEvent) error {
 	// 初始化所有需要的label
-	_ = e.initLabels()
+	_ = initLabels(e.si, e.pid)
 
 	var eg errgroup.Group
 	eg.Go(func() error {
 		// TODO 需要检查pipeline是否存在，所以暂不处理错误
 		// 添加review check流程
-		return e.si.UpdateBuildStatus(
-			event.Project.PathWithNamespace,
-			event.ObjectAttributes.LastCommit.ID,
-			scm.BuildStateRunning,
-		)
+		return e.si.UpdateBuildStatus(e.pid, event.LastCommitSHA, scm.BuildStateRunning)
 	})
 
 	eg.Go(func() error {
 		// 更新labels
-		adds, removes := dealCommonLabel(e.cfg, e.pid, event.ObjectAttributes.Description)
+		adds, removes := dealCommonLabel(e.si, e.cfg, e.pid, command.Parse(event.Description))
 		if len(adds) == 0 {
 			return nil
 		}
@@ -125,8 +123,7 @@ func (e *Merge) open(event *gitlab.MergeEvent) error {
 	})
 
 	eg.Go(func() error {
-		// TODO 暂时忽略错误，需要处理，比如重复尝试5次
-		// 添加自动评论
+		// 添加自动评论，失败时返回错误，scm客户端仅在限流时重试
 		err := e.addAutoComment(event)
 		if err != nil {
 			logrus.Warningf("open pull request add auto comment failed: %s", err)
@@ -136,37 +133,192 @@ func (e *Merge) open(event *gitlab.MergeEvent) error {
 	return eg.Wait()
 }
 
-func (e *Merge) update(event *gitlab.MergeEvent) error {
-	// TODO 更新commit自动移除LGTM
+func (e *Merge) update(event *scm.PullRequestEvent) error {
+	// 关闭时移除label也会触发更新事件，已关闭或已合并的pull request不再处理
+	if !opened(e.pr.State) {
+		return nil
+	}
+	// 推送新的commit后，之前的review已失效
+	if event.NewCommits {
+		removed, err := e.resetReview(event)
+		if err != nil || removed {
+			return err
+		}
+	}
+
+	// 事件中的labels可能已过期，以最新读取的pull request为准
+	if !mergeable(e.pr.Labels) {
+		// 尝试添加review check流程，如果存在报错则忽略
+		_ = e.si.UpdateBuildStatus(e.pid, event.LastCommitSHA, scm.BuildStateRunning)
+		return nil
+	}
+	// 当label满足lgtm和approved的时，执行分支合并
+	return e.merge(event.LastCommitSHA)
+}
+
+// opened reports whether the pull request is open, GitLab uses `opened` and the others use `open`.
+func opened(state string) bool {
+	return state == "opened" || state == "open"
+}
 
-	// 当label存在do-not-merge时，禁止合并
+// mergeable reports whether the labels contain lgtm and approved, and no do-not-merge.
+func mergeable(labels []string) bool {
 	var lgtmExists, approvedExists bool
-	for _, v := range event.Labels {
-		if strings.Contains(v.Name, scm.DoNotMerge) {
-			approvedExists = false
-			break
+	for _, v := range labels {
+		// 当label存在do-not-merge时，禁止合并
+		if strings.Contains(v, scm.DoNotMerge) {
+			return false
 		}
 		label := scm.AdminSet.LabelByKey("LGTM")
-		if label != nil && v.Name == label.Name {
+		if label != nil && v == label.Name {
 			lgtmExists = true
 		}
 		label = scm.AdminSet.LabelByKey("APPROVE")
-		if label != nil && v.Name == label.Name {
+		if label != nil && v == label.Name {
 			approvedExists = true
 		}
 	}
+	return lgtmExists && approvedExists
+}
 
-	// 尝试添加review check流程，如果存在报错则忽略
-	if !lgtmExists || !approvedExists {
-		_ = global.SCM().UpdateBuildStatus(
-			event.Project.PathWithNamespace,
-			event.ObjectAttributes.LastCommit.ID,
-			scm.BuildStateRunning,
-		)
+// existLabels returns the names of the admin labels by keys which the pull request has.
+func (e *Merge) existLabels(keys ...string) []string {
+	var result []string
+	for _, key := range keys {
+		label := scm.AdminSet.LabelByKey(key)
+		if label == nil {
+			continue
+		}
+		if _, ok := util.InStringSlice(e.pr.Labels, label.Name); ok {
+			result = append(result, label.Name)
+		}
+	}
+	return result
+}
+
+// resetReviewPrefix is the prefix of the comment on the review reset by new commits.
+const resetReviewPrefix = "检测到新的 commits 推送，已移除 "
+
+// resetReview removes the lgtm label (and approved if configured) of the pull request,
+// it returns true if any label is removed.
+func (e *Merge) resetReview(event *scm.PullRequestEvent) (bool, error) {
+	keys := []string{"LGTM"}
+	if e.cfg.PRConfig.ResetApprovedOnPush {
+		keys = append(keys, "APPROVE")
+	}
+	removes := e.existLabels(keys...)
+	if len(removes) == 0 {
+		return false, nil
+	}
+
+	opt := &scm.UpdatePullRequest{
+		Labels:       filterLabels(e.pr.Labels, nil, removes),
+		RemoveLabels: removes,
+	}
+	e.completeAssignees(event, opt)
+	if err := e.si.UpdatePullRequest(e.pid, e.prID, opt); err != nil {
+		return false, err
+	}
+	// 重置review check流程
+	_ = e.si.UpdateBuildStatus(e.pid, event.LastCommitSHA, scm.BuildStateRunning)
+
+	content := resetReviewPrefix + "`" + strings.Join(removes, "`、`") + "`，请重新 review。"
+	if err := e.si.CreatePullRequestComment(e.pid, e.prID, content); err != nil {
+		logrus.Warningf("reset review add comment failed: %s", err)
+	}
+	return true, nil
+}
+
+// close removes the review labels and cancels the review check of the closed pull request.
+func (e *Merge) close(event *scm.PullRequestEvent) error {
+	// 取消review check流程，如果存在报错则忽略
+	_ = e.si.UpdateBuildStatus(e.pid, event.LastCommitSHA, scm.BuildStateCanceled)
+
+	removes := e.existLabels("LGTM", "APPROVE")
+	if len(removes) == 0 {
 		return nil
 	}
-	// 当label满足lgtm和approved的时，执行分支合并
-	return e.merge(event.ObjectAttributes.LastCommit.ID)
+	opt := &scm.UpdatePullRequest{
+		Labels:       filterLabels(e.pr.Labels, nil, removes),
+		RemoveLabels: removes,
+	}
+	e.completeAssignees(event, opt)
+	return e.si.UpdatePullRequest(e.pid, e.prID, opt)
+}
+
+// merged posts the summary of the merged pull request.
+func (e *Merge) merged() error {
+	comments, err := e.si.ListPullRequestComments(e.pid, e.prID)
+	if err != nil {
+		return err
+	}
+	reviewers, approvers := reviewUsers(comments, e.cfg)
+	return e.si.CreatePullRequestComment(e.pid, e.prID, mergedComment(reviewers, approvers, e.pr.MergeCommitSHA))
+}
+
+// reviewUsers replays the comments in order and returns the users whose lgtm and approval are kept,
+// the cancel and remove commands and the review reset on new commits clear the previous ones.
+func reviewUsers(comments []scm.Comment, cfg *scm.ReviewConfig) (reviewers, approvers []string) {
+	lgtm := scm.AdminSet.LabelByKey("LGTM").Name
+	approved := scm.AdminSet.LabelByKey("APPROVE").Name
+	add := func(users []string, candidates []string, username string) []string {
+		if _, ok := util.InStringSlice(candidates, username); !ok {
+			return users
+		}
+		if _, ok := util.InStringSlice(users, username); ok {
+			return users
+		}
+		return append(users, username)
+	}
+
+	for _, comment := range comments {
+		var removes []string
+		if strings.HasPrefix(comment.Body, resetReviewPrefix) {
+			// 新的commits推送后移除的标签
+			for _, name := range []string{lgtm, approved} {
+				if strings.Contains(comment.Body, "`"+name+"`") {
+					removes = append(removes, name)
+				}
+			}
+		} else {
+			cmds := command.Parse(comment.Body)
+			username := comment.Author.Username
+			if scm.AdminSet.MatchLabelWithKey("LGTM", cmds) != nil {
+				reviewers = add(reviewers, cfg.Reviewers, username)
+			}
+			if scm.AdminSet.MatchLabelWithKey("APPROVE", cmds) != nil ||
+				scm.AdminSet.MatchLabelWithKey("FORCE-MERGE", cmds) != nil {
+				approvers = add(approvers, cfg.Approvers, username)
+			}
+			for _, v := range append(scm.RemoveSet.MatchLabels(cmds), scm.AdminSet.CancelLabels(cmds)...) {
+				removes = append(removes, v.Name)
+			}
+		}
+		// 标签被移除后，之前的lgtm及approve不再生效
+		if _, ok := util.InStringSlice(removes, lgtm); ok {
+			reviewers = nil
+		}
+		if _, ok := util.InStringSlice(removes, approved); ok {
+			approvers = nil
+		}
+	}
+	return reviewers, approvers
+}
+
+func mergedComment(reviewers, approvers []string, commitSHA string) string {
+	users := func(names []string) string {
+		if len(names) == 0 {
+			return "无"
+		}
+		return "@" + strings.Join(names, " @")
+	}
+	content := "合并完成！  \n" +
+		"Reviewers(代码审查人员): " + users(reviewers) + "  \n" +
+		"Approvers(请求审批人员): " + users(approvers) + "  \n"
+	if commitSHA != "" {
+		content += "合并后的 commit: " + commitSHA + "  \n"
+	}
+	return content
 }
 
 func (e *Merge) merge(lastCommitID string) error {
@@ -210,65 +362,20 @@ func (e *Merge) merge(lastCommitID string) error {
 	return e.si.MergePullRequest(e.pid, e.prID, opt)
 }
 
-func (e *Merge) initLabels() error {
-	cache := scm.Cached()
-	if exists := cache.IsExist(e.pid); exists {
-		return nil
-	}
-
-	labels, err := e.si.ListLabels(e.pid)
-	if err != nil {
-		return err
-	}
-
-	var allLabels []scm.Label
-	allLabels = append(allLabels, scm.AdminSet.Labels()...)
-	allLabels = append(allLabels, scm.AddSet.Labels()...)
-	allLabels = append(allLabels, scm.CustomSet.Labels()...)
-	for _, v := range allLabels {
-		var exists bool
-		for _, label := range labels {
-			if v.Name == label.Name {
-				exists = true
-				break
-			}
-		}
-		if !exists {
-			// label创建失败暂不处理
-			_ = e.si.CreateLabel(e.pid, &v)
-		}
-	}
-
-	cache.Add(e.pid)
-	return nil
+func (e *Merge) completeAssignees(event *scm.PullRequestEvent, opt *scm.UpdatePullRequest) {
+	opt.AssigneeIDs = event.AssigneeIDs
 }
 
-func (e *Merge) completeAssignees(event *gitlab.MergeEvent, opt *scm.UpdatePullRequest) {
-	getAssigneeIDs := func(event *gitlab.MergeEvent) []int {
-		var ids []int
-		for _, v := range event.Assignees {
-			ids = append(ids, v.ID)
-		}
-		return ids
-	}
-	if event.Assignees != nil {
-		opt.AssigneeIDs = getAssigneeIDs(event)
-	}
-	if event.Assignee != nil {
-		opt.AssigneeID = event.Assignee.ID
-	}
-}
-
-func (e *Merge) addAutoComment(event *gitlab.MergeEvent) error {
-	repo := event.Project.PathWithNamespace
-	id := event.ObjectAttributes.IID
-	authorID := event.ObjectAttributes.AuthorID
+func (e *Merge) addAutoComment(event *scm.PullRequestEvent) error {
+	repo := event.Repository.FullName
+	id := event.Number
+	authorID := event.AuthorID
 
 	count := 0
 	reviewers := make([]string, 0, 2)
 
 	// 获取reviewers的用户id
-	members := e.getMembers(e.cfg.Reviewers)
+	members := getMembers(e.si, e.pid, e.cfg.Reviewers)
 	for _, v := range members {
 		if v.ID == authorID {
 			// 跳过 请求提交者 进行review
@@ -296,7 +403,7 @@ func (e *Merge) addAutoComment(event *gitlab.MergeEvent) error {
 		commitMsg = "合并后的 commit 信息为 描述中`<!-- title --><!-- end title -->`之间的内容"
 	}
 
-	content := `您好 ` + event.User.Username + `，请求创建成功！  
+	content := `您好 ` + event.Actor.Username + `，请求创建成功！  
 ` + reviewContent + `  
 
 请注意，合并时将会压缩所有 commits ，` + commitMsg + `。  
@@ -306,27 +413,5 @@ Reviewers(代码审查人员)可以通过评论` + "`/lgtm`" + `来表示审查
 Approvers(请求审批人员)可以通过评论` + "`/approve`" + `来表示审批通过。  
 Approvers(请求审批人员)可以通过评论` + "`/force-merge`" + `来进行强制合并。  
 `
-	return global.SCM().CreatePullRequestComment(repo, id, content)
-}
-
-func (e *Merge) getMembers(names []string) map[string]scm.ProjectMember {
-	var projectMembers []scm.ProjectMember
-	members := make(map[string]scm.ProjectMember)
-	for _, name := range names {
-		if member, ok := scm.UserCached().Get(name); ok {
-			members[name] = member
-			continue
-		}
-		if projectMembers == nil {
-			// TODO 无需处理错误，错误时会返回nil
-			projectMembers, _ = e.si.ListProjectMembers(e.pid)
-			for _, v := range projectMembers {
-				scm.UserCached().Add(v.Username, v)
-			}
-		}
-		if member, ok := scm.UserCached().Get(name); ok {
-			members[name] = member
-		}
-	}
-	return members
+	return e.si.CreatePullRequestComment(repo, id, content)
 }
@@ -0,0 +1,82 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/util"
+)
+
+// ProcessPipeline handles the finished pipeline of the pull request,
+// the failed pipeline blocks the merge, and the succeeded one unblocks it and merges the pull request if mergeable.
+func (e *Merge) ProcessPipeline(event *scm.PipelineEvent) error {
+	// 忽略旧commit的流水线
+	if event.SHA != "" && e.pr.SHA != "" && event.SHA != e.pr.SHA {
+		logrus.Debugf("Skip the outdated pipeline of pull request(%s!%d)", e.pid, e.prID)
+		return nil
+	}
+	label := scm.AutoSet.LabelByKey("CI-FAILED").Name
+	_, exists := util.InStringSlice(e.pr.Labels, label)
+
+	switch event.Status {
+	case scm.PipelineStatusFailed:
+		// 已禁止合并时不再重复评论，避免重试及多次失败刷屏
+		if exists {
+			return nil
+		}
+		_ = initLabels(e.si, e.pid)
+		opt := &scm.UpdatePullRequest{
+			Labels:    filterLabels(e.pr.Labels, []string{label}, nil),
+			AddLabels: []string{label},
+		}
+		if err := e.si.UpdatePullRequest(e.pid, e.prID, opt); err != nil {
+			return err
+		}
+		return e.si.CreatePullRequestComment(e.pid, e.prID, pipelineFailedComment(event))
+	case scm.PipelineStatusSuccess:
+		if !exists {
+			return nil
+		}
+		labels := filterLabels(e.pr.Labels, nil, []string{label})
+		opt := &scm.UpdatePullRequest{
+			Labels:       labels,
+			RemoveLabels: []string{label},
+		}
+		if err := e.si.UpdatePullRequest(e.pid, e.prID, opt); err != nil {
+			return err
+		}
+		// 流水线恢复后重新检查是否可以合并
+		if mergeable(labels) {
+			return e.merge(event.SHA)
+		}
+	}
+	return nil
+}
+
+func pipelineFailedComment(event *scm.PipelineEvent) string {
+	pipeline := "流水线"
+	if event.WebURL != "" {
+		pipeline = "[流水线](" + event.WebURL + ")"
+	}
+	content := pipeline + " 执行失败，已禁止合并。"
+	if len(event.FailedJobs) > 0 {
+		content += "  \n失败的任务：`" + strings.Join(event.FailedJobs, "`、`") + "`"
+	}
+	return content
+}
@@ -0,0 +1,44 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+// NewPush creates the processor of push events, configPath is the path of the review config file.
+func NewPush(si scm.Interface, configPath string) *Push {
+	return &Push{
+		si:         si,
+		configPath: configPath,
+	}
+}
+
+type Push struct {
+	si         scm.Interface
+	configPath string
+}
+
+func (e *Push) Process(event *scm.PushEvent) error {
+	// 默认分支的review配置变更时，清理缓存
+	if event.Branch == event.Repository.DefaultBranch && event.Touches(e.configPath) {
+		pid := event.Repository.FullName
+		scm.ReviewConfigCached().Remove(scm.CacheKey(e.si, pid))
+		logrus.Debugf("Review config of project(%s) is changed, cache is cleared", pid)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/command"
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+// 变基进度的轮询间隔及超时时间
+var (
+	rebasePollInterval = 2 * time.Second
+	rebaseTimeout      = time.Minute
+)
+
+// rebase handles the `/rebase` command, it starts the rebase and comments the result after the rebase finishes.
+// The author, reviewers and approvers are permitted.
+func (e *Comment) rebase(event *scm.CommentEvent, cmds command.Commands) error {
+	if !cmds.Has("rebase") {
+		return nil
+	}
+	if !e.permitted(event.Actor) {
+		logrus.Infof("User(%s) is not allowed to rebase PR(%v) in Repo(%s)", event.Actor.Username, e.prID, e.pid)
+		return nil
+	}
+
+	// 变基是否成功以源分支的最新提交是否变化判断，GitLab变基失败时会保留相同的合并错误
+	sha := e.pr.SHA
+	logrus.Infof("Rebase PR(%v) in Repo(%s) by %s", e.prID, e.pid, event.Actor.Username)
+	err := e.si.RebasePullRequest(e.pid, e.prID)
+	switch err {
+	case nil:
+	case scm.ErrNotSupported:
+		return e.si.CreatePullRequestComment(e.pid, e.prID, "当前平台不支持变基。")
+	case scm.ErrRebaseConflict:
+		return e.si.CreatePullRequestComment(e.pid, e.prID, rebaseFailedComment(""))
+	default:
+		if cerr := e.si.CreatePullRequestComment(e.pid, e.prID, "变基请求失败，请稍后重试。"); cerr != nil {
+			logrus.Warningf("pull request add rebase failed comment failed: %s", cerr)
+		}
+		return err
+	}
+	return e.reportRebase(sha)
+}
+
+// reportRebase waits for the rebase to finish and comments the result,
+// the rebase succeeds if the head sha is changed or there is no merge error.
+func (e *Comment) reportRebase(sha string) error {
+	pr, err := e.waitRebase()
+	if err != nil {
+		return err
+	}
+	if pr == nil {
+		logrus.Warningf("Wait for the rebase of PR(%v) in Repo(%s) timeout", e.prID, e.pid)
+		return e.si.CreatePullRequestComment(e.pid, e.prID, "变基等待超时，请稍后查看合并请求的状态。")
+	}
+	if pr.SHA == sha && pr.MergeError != "" {
+		return e.si.CreatePullRequestComment(e.pid, e.prID, rebaseFailedComment(pr.MergeError))
+	}
+	return e.si.CreatePullRequestComment(e.pid, e.prID, fmt.Sprintf("已将 `%s` 变基到 `%s`。", pr.SourceBranch, pr.TargetBranch))
+}
+
+// waitRebase polls the pull request until the rebase is finished, it returns nil on timeout.
+func (e *Comment) waitRebase() (*scm.PullRequest, error) {
+	deadline := time.Now().Add(rebaseTimeout)
+	for {
+		pr, err := e.si.GetPullRequest(e.pid, e.prID)
+		if err != nil {
+			return nil, err
+		}
+		if !pr.RebaseInProgress {
+			return pr, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		time.Sleep(rebasePollInterval)
+	}
+}
+
+func rebaseFailedComment(reason string) string {
+	content := "变基失败，请在本地变基并解决冲突后推送。"
+	if reason != "" {
+		content += "  \n" + reason
+	}
+	return content
+}
@@ -0,0 +1,123 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/command"
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/util"
+)
+
+// retest handles the `/retest` and `/test <job>...` commands on the latest pipeline of the pull request,
+// `/retest` retries the failed jobs, `/test` retries the named jobs or plays them if they are manual.
+// The author, reviewers and approvers are permitted.
+func (e *Comment) retest(event *scm.CommentEvent, cmds command.Commands) error {
+	retest := cmds.Has("retest")
+	var names []string
+	for _, cmd := range cmds.Filter("test") {
+		names = append(names, cmd.Args...)
+	}
+	if !retest && len(names) == 0 {
+		return nil
+	}
+	if !e.permitted(event.Actor) {
+		logrus.Infof("User(%s) is not allowed to retest PR(%v) in Repo(%s)", event.Actor.Username, e.prID, e.pid)
+		return nil
+	}
+
+	pipelines, err := e.si.ListPullRequestPipelines(e.pid, e.prID)
+	if err == scm.ErrNotSupported {
+		return e.si.CreatePullRequestComment(e.pid, e.prID, "当前平台不支持重新执行流水线。")
+	}
+	if err != nil {
+		return err
+	}
+	if len(pipelines) == 0 {
+		return e.si.CreatePullRequestComment(e.pid, e.prID, "未找到合并请求的流水线。")
+	}
+	pipeline := pipelines[0]
+
+	var replies []string
+	if retest {
+		if pipeline.Status == scm.BuildStateFailed || pipeline.Status == scm.BuildStateCanceled {
+			logrus.Infof("Retry pipeline(%d) by %s on PR(%v) in Repo(%s)", pipeline.ID, event.Actor.Username, e.prID, e.pid)
+			if err := e.si.RetryPipeline(e.pid, pipeline.ID); err != nil {
+				return err
+			}
+		} else {
+			replies = append(replies, "最新的流水线没有失败的任务，无需重新执行。")
+		}
+	}
+	if len(names) > 0 {
+		notFound, err := e.retryJobs(event.Actor.Username, pipeline.ID, names)
+		if err != nil {
+			return err
+		}
+		if len(notFound) > 0 {
+			replies = append(replies, "最新的流水线中未找到任务：`"+strings.Join(notFound, "`、`")+"`")
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	return e.si.CreatePullRequestComment(e.pid, e.prID, strings.Join(replies, "  \n"))
+}
+
+// retryJobs retries or plays the jobs of the pipeline by names, the running jobs are skipped,
+// and returns the names not found.
+func (e *Comment) retryJobs(username string, pipelineID int, names []string) ([]string, error) {
+	jobs, err := e.si.ListPipelineJobs(e.pid, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	var notFound []string
+	for _, name := range names {
+		var job *scm.Job
+		for i := range jobs {
+			if jobs[i].Name == name {
+				job = &jobs[i]
+				break
+			}
+		}
+		if job == nil {
+			if _, exists := util.InStringSlice(notFound, name); !exists {
+				notFound = append(notFound, name)
+			}
+			continue
+		}
+
+		switch job.Status {
+		case scm.BuildStateManual:
+			logrus.Infof("Play job(%s) by %s on PR(%v) in Repo(%s)", name, username, e.prID, e.pid)
+			err = e.si.PlayJob(e.pid, job.ID)
+		case scm.BuildStateCreated, scm.BuildStatePending, scm.BuildStateRunning:
+			logrus.Debugf("Skip the running job(%s) on PR(%v) in Repo(%s)", name, e.prID, e.pid)
+			continue
+		default:
+			logrus.Infof("Retry job(%s) by %s on PR(%v) in Repo(%s)", name, username, e.prID, e.pid)
+			err = e.si.RetryJob(e.pid, job.ID)
+		}
+		if err != nil {
+			return notFound, err
+		}
+		// 同名任务只执行一次
+		job.Status = scm.BuildStatePending
+	}
+	return notFound, nil
+}
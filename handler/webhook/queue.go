@@ -0,0 +1,402 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+var (
+	ErrQueueFull   = errors.New("event queue is full")
+	ErrQueueClosed = errors.New("event queue is closed")
+	ErrDuplicate   = errors.New("duplicate event delivery")
+)
+
+// Job is a validated webhook event waiting to be processed.
+type Job struct {
+	// ID is the unique id of the job, it is generated when enqueued
+	ID string `json:"id,omitempty"`
+	// DeliveryID is the unique id of the webhook delivery, it may be empty
+	DeliveryID string `json:"delivery_id"`
+	// Instance is the name of the scm instance
+	Instance string `json:"instance"`
+	// Host is the address of the bot
+	Host        string                `json:"host"`
+	PullRequest *scm.PullRequestEvent `json:"pull_request,omitempty"`
+	Comment     *scm.CommentEvent     `json:"comment,omitempty"`
+	Push        *scm.PushEvent        `json:"push,omitempty"`
+	Pipeline    *scm.PipelineEvent    `json:"pipeline,omitempty"`
+	// IssueComment is the comment event of the issue
+	IssueComment *scm.IssueCommentEvent `json:"issue_comment,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+
+	// Attempts is the number of the processing times
+	Attempts int `json:"attempts,omitempty"`
+	// Error is the error of the last failed processing
+	Error    string     `json:"error,omitempty"`
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+var jobSeq uint64
+
+// newJobID returns the id in order of creation.
+func newJobID() string {
+	return fmt.Sprintf("%019d-%06d", time.Now().UnixNano(), atomic.AddUint64(&jobSeq, 1)%1000000)
+}
+
+// Repository returns the repository of the event.
+func (j *Job) Repository() scm.Repository {
+	switch {
+	case j.PullRequest != nil:
+		return j.PullRequest.Repository
+	case j.Comment != nil:
+		return j.Comment.Repository
+	case j.Push != nil:
+		return j.Push.Repository
+	case j.Pipeline != nil:
+		return j.Pipeline.Repository
+	case j.IssueComment != nil:
+		return j.IssueComment.Repository
+	}
+	return scm.Repository{}
+}
+
+// Key returns the key of the pull request or issue which the event belongs to,
+// the jobs with the same key are processed serially, empty key means no order is required.
+func (j *Job) Key() string {
+	repo := j.Repository()
+	switch {
+	case j.PullRequest != nil:
+		return pullRequestKey(j.Instance, repo.FullName, j.PullRequest.Number)
+	case j.Comment != nil:
+		return pullRequestKey(j.Instance, repo.FullName, j.Comment.Number)
+	case j.Pipeline != nil:
+		return pullRequestKey(j.Instance, repo.FullName, j.Pipeline.Number)
+	case j.IssueComment != nil:
+		return issueKey(j.Instance, repo.FullName, j.IssueComment.Number)
+	}
+	return ""
+}
+
+// ProcessFunc processes the job.
+type ProcessFunc func(job *Job) error
+
+// Queue is a bounded job queue consumed by a fixed number of workers.
+// The jobs with the same key are processed serially, the job whose key is being processed waits
+// behind the running one without occupying a worker, so that the other keys proceed in parallel.
+type Queue struct {
+	process ProcessFunc
+	workers int
+	jobs    chan *Job
+	dedup   *deliveryStore
+	store   Store
+	// deadLetter keeps the failed jobs
+	deadLetter Store
+
+	mux       sync.RWMutex
+	replayMux sync.Mutex
+	closed    bool
+	pending   sync.WaitGroup
+	done      sync.WaitGroup
+
+	keyMux sync.Mutex
+	// running is the jobs waiting behind the running job by key
+	running map[string][]*Job
+	waiting int
+}
+
+// NewQueue creates the queue, size is the max number of the jobs waiting to be processed.
+func NewQueue(workers, size int, process ProcessFunc) *Queue {
+	if workers <= 0 {
+		workers = 1
+	}
+	// 队列长度为0时所有任务都会被拒绝
+	if size <= 0 {
+		size = 1
+	}
+	return &Queue{
+		process:    process,
+		workers:    workers,
+		jobs:       make(chan *Job, size),
+		deadLetter: NewMemoryStore(),
+		running:    make(map[string][]*Job),
+	}
+}
+
+// SetDeduplication drops the jobs with the same delivery id in ttl, at most size ids are remembered.
+// It should be called before Start.
+func (q *Queue) SetDeduplication(ttl time.Duration, size int) {
+	if ttl <= 0 || size <= 0 {
+		q.dedup = nil
+		return
+	}
+	q.dedup = newDeliveryStore(ttl, size)
+}
+
+// SetStore persists the accepted jobs in the store until they are processed.
+// It should be called before Start.
+func (q *Queue) SetStore(store Store) {
+	q.store = store
+}
+
+// SetDeadLetter keeps the failed jobs in the store, the jobs are kept in memory by default.
+// It should be called before Start.
+func (q *Queue) SetDeadLetter(store Store) {
+	q.deadLetter = store
+}
+
+// Start starts the workers.
+func (q *Queue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.done.Add(1)
+		go func() {
+			defer q.done.Done()
+			for job := range q.jobs {
+				q.dispatch(job)
+			}
+		}()
+	}
+}
+
+// dispatch runs the job and the jobs waiting behind it,
+// or leaves the job to the worker running the same key.
+func (q *Queue) dispatch(job *Job) {
+	key := job.Key()
+	if key == "" {
+		q.run(job)
+		return
+	}
+	if !q.acquire(key, job) {
+		return
+	}
+	for ; job != nil; job = q.next(key) {
+		q.run(job)
+	}
+}
+
+// acquire marks the key running, it returns false and keeps the job waiting if the key is running.
+func (q *Queue) acquire(key string, job *Job) bool {
+	q.keyMux.Lock()
+	defer q.keyMux.Unlock()
+	if waiting, ok := q.running[key]; ok {
+		q.running[key] = append(waiting, job)
+		q.waiting++
+		return false
+	}
+	q.running[key] = nil
+	return true
+}
+
+// next returns the next job waiting for the key, the key is released if there is none.
+func (q *Queue) next(key string) *Job {
+	q.keyMux.Lock()
+	defer q.keyMux.Unlock()
+	waiting := q.running[key]
+	if len(waiting) == 0 {
+		delete(q.running, key)
+		return nil
+	}
+	q.running[key] = waiting[1:]
+	q.waiting--
+	return waiting[0]
+}
+
+func (q *Queue) run(job *Job) {
+	defer q.pending.Done()
+	job.Attempts++
+	err := q.safeProcess(job)
+	if err == nil {
+		q.removeStored(job.ID)
+		return
+	}
+
+	logrus.Errorf("Process event of project(%s) failed: %v", job.Repository().FullName, err)
+	failedAt := time.Now()
+	job.Error = err.Error()
+	job.FailedAt = &failedAt
+	if err := q.deadLetter.Save(job); err != nil {
+		// 保留在store中，重启后重新处理
+		logrus.Errorf("Save failed event %s failed: %v", job.ID, err)
+		return
+	}
+	q.removeStored(job.ID)
+}
+
+func (q *Queue) safeProcess(job *Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return q.process(job)
+}
+
+func (q *Queue) removeStored(id string) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.Remove(id); err != nil {
+		logrus.Errorf("Remove stored event %s failed: %v", id, err)
+	}
+}
+
+// Resume enqueues the jobs left in the store by the last run, it blocks until all of them are enqueued.
+// It should be called after Start and before accepting new jobs.
+func (q *Queue) Resume() (int, error) {
+	if q.store == nil {
+		return 0, nil
+	}
+	jobs, err := q.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	for i, job := range jobs {
+		if q.closed {
+			return i, ErrQueueClosed
+		}
+		if q.dedup != nil && job.DeliveryID != "" {
+			q.dedup.Add(job.DeliveryID)
+		}
+		q.pending.Add(1)
+		q.jobs <- job
+	}
+	return len(jobs), nil
+}
+
+// Enqueue adds the job to the queue without blocking, it returns ErrQueueFull when the queue is full,
+// and ErrDuplicate when the delivery has been accepted.
+func (q *Queue) Enqueue(job *Job) error {
+	return q.enqueue(job, true)
+}
+
+func (q *Queue) enqueue(job *Job, deduplicate bool) error {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	dedup := deduplicate && q.dedup != nil && job.DeliveryID != ""
+	if dedup && !q.dedup.Add(job.DeliveryID) {
+		return ErrDuplicate
+	}
+	if job.ID == "" {
+		job.ID = newJobID()
+	}
+	if q.store != nil {
+		if err := q.store.Save(job); err != nil {
+			if dedup {
+				q.dedup.Remove(job.DeliveryID)
+			}
+			return fmt.Errorf("save event failed: %v", err)
+		}
+	}
+	q.pending.Add(1)
+	// 等待中的任务同样计入队列长度
+	if q.Len() >= cap(q.jobs) {
+		return q.reject(job, dedup)
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return q.reject(job, dedup)
+	}
+}
+
+// reject rolls back the job not accepted by the full queue.
+func (q *Queue) reject(job *Job, dedup bool) error {
+	q.pending.Done()
+	q.removeStored(job.ID)
+	if dedup {
+		// 允许provider重新投递
+		q.dedup.Remove(job.DeliveryID)
+	}
+	return ErrQueueFull
+}
+
+// Failed returns the failed jobs in the dead letter store.
+func (q *Queue) Failed() ([]*Job, error) {
+	return q.deadLetter.List()
+}
+
+// Replay moves the failed job back to the queue, the delivery deduplication is skipped.
+func (q *Queue) Replay(id string) error {
+	q.replayMux.Lock()
+	defer q.replayMux.Unlock()
+	job, err := q.deadLetter.Get(id)
+	if err != nil {
+		return err
+	}
+	// 先移出，避免再次失败时覆盖新的记录
+	if err := q.deadLetter.Remove(id); err != nil {
+		return err
+	}
+	failed := *job
+	job.Error = ""
+	job.FailedAt = nil
+	if err := q.enqueue(job, false); err != nil {
+		if saveErr := q.deadLetter.Save(&failed); saveErr != nil {
+			logrus.Errorf("Restore failed event %s failed: %v", id, saveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of the jobs waiting to be processed.
+func (q *Queue) Len() int {
+	q.keyMux.Lock()
+	defer q.keyMux.Unlock()
+	return len(q.jobs) + q.waiting
+}
+
+// Wait blocks until all the enqueued jobs are processed.
+func (q *Queue) Wait() {
+	q.pending.Wait()
+}
+
+// Stop stops accepting jobs and waits for the workers to process the remaining jobs until ctx is done.
+func (q *Queue) Stop(ctx context.Context) error {
+	q.mux.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop event queue with %d jobs remaining: %v", q.Len(), ctx.Err())
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+func TestQueue(t *testing.T) {
+	var processed int32
+	block := make(chan struct{})
+	queue := NewQueue(1, 2, func(job *Job) error {
+		<-block
+		atomic.AddInt32(&processed, 1)
+		return nil
+	})
+	queue.Start()
+
+	newJob := func() *Job {
+		return &Job{Comment: &scm.CommentEvent{Repository: scm.Repository{FullName: "group/project"}}}
+	}
+	// the worker holds one job, the queue holds two jobs
+	if err := queue.Enqueue(newJob()); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	for queue.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(newJob()); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	if err := queue.Enqueue(newJob()); err != ErrQueueFull {
+		t.Fatalf("Enqueue() error = %v, want %v", err, ErrQueueFull)
+	}
+
+	close(block)
+	queue.Wait()
+	if got := atomic.LoadInt32(&processed); got != 3 {
+		t.Errorf("processed = %d, want 3", got)
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := queue.Enqueue(newJob()); err != ErrQueueClosed {
+		t.Errorf("Enqueue() error = %v, want %v", err, ErrQueueClosed)
+	}
+}
+
+func TestQueue_Size(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		queue := NewQueue(1, size, func(job *Job) error { return nil })
+		queue.Start()
+		job := &Job{Comment: &scm.CommentEvent{Repository: scm.Repository{FullName: "group/project"}}}
+		if err := queue.Enqueue(job); err != nil {
+			t.Errorf("NewQueue(size = %d) Enqueue() error = %v", size, err)
+		}
+		queue.Wait()
+		if err := queue.Stop(context.Background()); err != nil {
+			t.Fatalf("Stop() error = %v", err)
+		}
+	}
+}
+
+func TestQueue_Key(t *testing.T) {
+	block := make(chan struct{})
+	var (
+		mux   sync.Mutex
+		order []string
+	)
+	queue := NewQueue(2, 10, func(job *Job) error {
+		if job.Comment.Note == "block" {
+			<-block
+		}
+		mux.Lock()
+		order = append(order, job.Comment.Note)
+		mux.Unlock()
+		return nil
+	})
+	queue.Start()
+	defer func() { _ = queue.Stop(context.Background()) }()
+
+	newJob := func(number int, note string) *Job {
+		return &Job{Comment: &scm.CommentEvent{
+			Repository: scm.Repository{FullName: "group/project"},
+			Number:     number,
+			Note:       note,
+		}}
+	}
+	for _, job := range []*Job{newJob(1, "block"), newJob(1, "1-2"), newJob(1, "1-3"), newJob(2, "2-1")} {
+		if err := queue.Enqueue(job); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	// the other pull request is not blocked by the running one, even if the same key waits in the queue
+	deadline := time.Now().Add(time.Second)
+	for {
+		mux.Lock()
+		got := append([]string(nil), order...)
+		mux.Unlock()
+		if reflect.DeepEqual(got, []string{"2-1"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("processed = %v, want [2-1] while the first pull request is blocked", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := queue.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2 waiting jobs", got)
+	}
+
+	close(block)
+	queue.Wait()
+	if want := []string{"2-1", "block", "1-2", "1-3"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("processed = %v, want %v", order, want)
+	}
+}
+
+func TestQueue_Panic(t *testing.T) {
+	var processed int32
+	queue := NewQueue(1, 2, func(job *Job) error {
+		if atomic.AddInt32(&processed, 1) == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+	queue.Start()
+	defer func() { _ = queue.Stop(context.Background()) }()
+
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(&Job{}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	queue.Wait()
+	if got := atomic.LoadInt32(&processed); got != 2 {
+		t.Errorf("processed = %d, want 2", got)
+	}
+}
+
+func TestQueue_Deduplication(t *testing.T) {
+	block := make(chan struct{})
+	queue := NewQueue(1, 1, func(job *Job) error {
+		<-block
+		return nil
+	})
+	queue.SetDeduplication(time.Hour, 10)
+	queue.Start()
+	defer func() { _ = queue.Stop(context.Background()) }()
+
+	if err := queue.Enqueue(&Job{DeliveryID: "1"}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := queue.Enqueue(&Job{DeliveryID: "1"}); err != ErrDuplicate {
+		t.Fatalf("Enqueue() error = %v, want %v", err, ErrDuplicate)
+	}
+	for queue.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := queue.Enqueue(&Job{DeliveryID: "2"}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	// the delivery rejected by the full queue can be redelivered
+	if err := queue.Enqueue(&Job{DeliveryID: "3"}); err != ErrQueueFull {
+		t.Fatalf("Enqueue() error = %v, want %v", err, ErrQueueFull)
+	}
+	close(block)
+	queue.Wait()
+	if err := queue.Enqueue(&Job{DeliveryID: "3"}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	// the jobs without delivery id are not deduplicated
+	for i := 0; i < 2; i++ {
+		queue.Wait()
+		if err := queue.Enqueue(&Job{}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	queue.Wait()
+}
+
+func TestDeliveryStore(t *testing.T) {
+	store := newDeliveryStore(time.Hour, 2)
+	for _, id := range []string{"1", "2", "3"} {
+		if !store.Add(id) {
+			t.Fatalf("Add(%s) = false, want true", id)
+		}
+	}
+	// "1" is evicted by the size limit
+	if !store.Add("1") {
+		t.Errorf("Add(1) = false, want true after eviction")
+	}
+	if store.Add("3") {
+		t.Errorf("Add(3) = true, want false")
+	}
+
+	// the removed id neither counts against the size nor evicts the readded one
+	store = newDeliveryStore(time.Hour, 2)
+	store.Add("1")
+	store.Remove("1")
+	store.Add("2")
+	store.Add("1")
+	if store.Add("1") || store.Add("2") {
+		t.Errorf("Add() = true, want false for the ids kept after removal")
+	}
+
+	store = newDeliveryStore(time.Millisecond, 10)
+	store.Add("1")
+	time.Sleep(5 * time.Millisecond)
+	if !store.Add("1") {
+		t.Errorf("Add(1) = false, want true after expiration")
+	}
+}
+
+func TestQueue_Store(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job left by the last run
+	if err := store.Save(&Job{ID: newJobID(), DeliveryID: "pending"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var processed []string
+	queue := NewQueue(1, 1, func(job *Job) error {
+		processed = append(processed, job.DeliveryID)
+		if job.DeliveryID == "failed" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	queue.SetDeduplication(time.Hour, 10)
+	queue.SetStore(store)
+	queue.Start()
+	defer func() { _ = queue.Stop(context.Background()) }()
+	if n, err := queue.Resume(); err != nil || n != 1 {
+		t.Fatalf("Resume() = %d, %v, want 1", n, err)
+	}
+	queue.Wait()
+	if err := queue.Enqueue(&Job{DeliveryID: "failed"}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	queue.Wait()
+	if jobs, err := store.List(); err != nil || len(jobs) != 0 {
+		t.Errorf("List() = %v, %v, want empty", jobs, err)
+	}
+
+	failed, err := queue.Failed()
+	if err != nil || len(failed) != 1 || failed[0].Attempts != 1 || failed[0].Error != "failed" {
+		t.Fatalf("Failed() = %+v, %v, want one failed job", failed, err)
+	}
+	// the replay skips the deduplication and keeps the attempts
+	if err := queue.Replay(failed[0].ID); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	queue.Wait()
+	if err := queue.Replay("unknown"); err != ErrJobNotFound {
+		t.Errorf("Replay() error = %v, want %v", err, ErrJobNotFound)
+	}
+	failed, _ = queue.Failed()
+	if len(failed) != 1 || failed[0].Attempts != 2 {
+		t.Errorf("Failed() = %+v, want the job failed twice", failed)
+	}
+	if want := []string{"pending", "failed", "failed"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed = %v, want %v", processed, want)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrJobNotFound = errors.New("event not found")
+
+// Store keeps the jobs by id.
+type Store interface {
+	// Save adds or updates the job, the id of the job is required
+	Save(job *Job) error
+	// Get returns ErrJobNotFound if the job does not exist
+	Get(id string) (*Job, error)
+	// Remove ignores the job that does not exist
+	Remove(id string) error
+	// List returns the jobs in order of id
+	List() ([]*Job, error)
+}
+
+const storeExt = ".json"
+
+// FileStore persists the jobs in a directory, one file per job.
+type FileStore struct {
+	dir string
+}
+
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore creates the store in dir.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create store dir failed: %v", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Save(job *Job) error {
+	if job.ID == "" {
+		return errors.New("event id is required")
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名，避免异常退出时留下不完整的文件
+	f, err := ioutil.TempFile(s.dir, "."+job.ID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path(job.ID))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *FileStore) Get(id string) (*Job, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	job.ID = id
+	return job, nil
+}
+
+func (s *FileStore) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) List() ([]*Job, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != storeExt {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	jobs := make([]*Job, 0, len(names))
+	for _, name := range names {
+		job, err := s.Get(strings.TrimSuffix(name, storeExt))
+		if err == ErrJobNotFound {
+			continue
+		}
+		if err != nil {
+			// 保留文件以便排查
+			logrus.Errorf("Read stored event %s failed: %v", name, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+storeExt)
+}
+
+// MemoryStore keeps the jobs in memory, they are lost on restart.
+type MemoryStore struct {
+	mux  sync.RWMutex
+	jobs map[string]*Job
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]*Job)}
+}
+
+func (s *MemoryStore) Save(job *Job) error {
+	if job.ID == "" {
+		return errors.New("event id is required")
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	copied := *job
+	s.jobs[job.ID] = &copied
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Job, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	copied := *job
+	return &copied, nil
+}
+
+func (s *MemoryStore) Remove(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]*Job, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		copied := *job
+		jobs = append(jobs, &copied)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
@@ -15,14 +15,20 @@
 package webhook
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/99nil/gopkg/ctr"
+	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
-	"github.com/xanzy/go-gitlab"
+	"github.com/sirupsen/logrus"
 
 	"github.com/zc2638/review-bot/global"
 	"github.com/zc2638/review-bot/handler/webhook/event"
@@ -30,18 +36,12 @@ import (
 	"github.com/zc2638/review-bot/pkg/util"
 )
 
-func HandlerEvent(cfg *scm.Config, si scm.Interface) http.HandlerFunc {
+// InstanceFunc returns the scm instance by name, empty name means the default instance.
+type InstanceFunc func(name string) (*global.Instance, error)
+
+// HandlerEvent validates the webhook and enqueues it, the event is processed asynchronously.
+func HandlerEvent(instanceFn InstanceFunc, queue *Queue) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-Gitlab-Token")
-		claims, err := util.JwtParse(token, global.JWTSecret)
-		if err != nil {
-			ctr.Unauthorized(w, errors.New("Signature Token Invalid"))
-			return
-		}
-		if claims.Auth.CheckSign(cfg.Secret) {
-			ctr.Unauthorized(w, errors.New("Signature Invalid"))
-			return
-		}
 		defer r.Body.Close()
 		data, err := ioutil.ReadAll(
 			io.LimitReader(r.Body, 10000000),
@@ -50,38 +50,212 @@ func HandlerEvent(cfg *scm.Config, si scm.Interface) http.HandlerFunc {
 			ctr.InternalError(w, err)
 			return
 		}
-		webhook, err := gitlab.ParseWebhook(gitlab.HookEventType(r), data)
+		name := instanceName(r)
+		instance, err := instanceFn(name)
+		if err != nil {
+			ctr.NotFound(w, err)
+			return
+		}
+		cfg := instance.Config
+		auth, err := verify(cfg, r, data)
+		if err != nil {
+			ctr.Unauthorized(w, err)
+			return
+		}
+		webhook, err := scm.ParseWebhook(cfg.Type, r, data)
 		if err != nil {
 			ctr.BadRequest(w, err)
 			return
 		}
+
+		job := &Job{
+			DeliveryID: scm.DeliveryID(cfg.Type, r),
+			Instance:   name,
+			Host:       requestHost(r),
+			CreatedAt:  time.Now(),
+		}
 		switch e := webhook.(type) {
-		case *gitlab.MergeEvent:
-			var scheme = "http"
-			if r.URL != nil && r.URL.Scheme != "" {
-				scheme = r.URL.Scheme
+		case *scm.PullRequestEvent:
+			job.PullRequest = e
+		case *scm.CommentEvent:
+			job.Comment = e
+		case *scm.PushEvent:
+			job.Push = e
+		case *scm.PipelineEvent:
+			job.Pipeline = e
+		case *scm.IssueCommentEvent:
+			job.IssueComment = e
+		default:
+			// 不关注的事件
+			ctr.Success(w)
+			return
+		}
+		// 群组及系统的webhook会发送所有项目的事件
+		repo := job.Repository()
+		if auth != nil && !auth.Match(repo.FullName) {
+			ctr.Unauthorized(w, fmt.Errorf("token is not allowed for project(%s)", repo.FullName))
+			return
+		}
+
+		err = queue.Enqueue(job)
+		if err == ErrDuplicate {
+			logrus.Infof("Skip the duplicate delivery(%s) of project(%s)", job.DeliveryID, repo.FullName)
+			ctr.Success(w)
+			return
+		}
+		if err != nil {
+			// 队列已满时让provider稍后重试
+			w.Header().Set("Retry-After", "10")
+			ctr.ErrorCode(w, err, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("accepted"))
+	}
+}
+
+// NewProcessor returns the function processing the jobs.
+// The events of the same pull request are processed serially by the queue, and the pull request is read
+// when processed, so that the labels are computed from the latest state.
+func NewProcessor(instanceFn InstanceFunc) ProcessFunc {
+	return func(job *Job) error {
+		instance, err := instanceFn(job.Instance)
+		if err != nil {
+			return err
+		}
+		si := instance.Client
+		repo := job.Repository()
+
+		switch {
+		case job.PullRequest != nil:
+			e := job.PullRequest
+			mergeEvent, err := event.NewMerge(si, repo.FullName, repo.DefaultBranch, e.Number, job.Host)
+			if err == scm.ErrReviewConfigNotFound {
+				logrus.Debugf("Skip the event of project(%s) without review config", repo.FullName)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return mergeEvent.Process(e)
+		case job.Comment != nil:
+			e := job.Comment
+			commentEvent, err := event.NewComment(si, repo.FullName, repo.DefaultBranch, e.Number)
+			if err == scm.ErrReviewConfigNotFound {
+				logrus.Debugf("Skip the event of project(%s) without review config", repo.FullName)
+				return nil
 			}
-			host := fmt.Sprintf("%s://%s", scheme, r.Host)
-			mergeEvent, err := event.NewMerge(
-				si, e.Project.PathWithNamespace, e.Project.DefaultBranch, e.ObjectAttributes.IID, host)
 			if err != nil {
-				ctr.InternalError(w, err)
-				return
+				return err
+			}
+			return commentEvent.Process(e)
+		case job.Pipeline != nil:
+			e := job.Pipeline
+			mergeEvent, err := event.NewMerge(si, repo.FullName, repo.DefaultBranch, e.Number, job.Host)
+			if err == scm.ErrReviewConfigNotFound {
+				logrus.Debugf("Skip the event of project(%s) without review config", repo.FullName)
+				return nil
 			}
-			err = mergeEvent.Process(e)
-		case *gitlab.MergeCommentEvent:
-			commentEvent, err := event.NewComment(
-				si, e.Project.PathWithNamespace, e.Project.DefaultBranch, e.MergeRequest.IID)
 			if err != nil {
-				ctr.InternalError(w, err)
-				return
+				return err
+			}
+			return mergeEvent.ProcessPipeline(e)
+		case job.IssueComment != nil:
+			e := job.IssueComment
+			issueEvent, err := event.NewIssueComment(si, repo.FullName, repo.DefaultBranch, e.Number)
+			if err == scm.ErrReviewConfigNotFound {
+				logrus.Debugf("Skip the event of project(%s) without review config", repo.FullName)
+				return nil
 			}
-			err = commentEvent.Process(e)
+			if err != nil {
+				return err
+			}
+			return issueEvent.Process(e)
+		case job.Push != nil:
+			return event.NewPush(si, scm.ReviewConfigPath(instance.Config.Type)).Process(job.Push)
 		}
-		if err != nil {
-			ctr.InternalError(w, err)
-			return
+		return nil
+	}
+}
+
+func pullRequestKey(instance, pid string, number int) string {
+	return fmt.Sprintf("%s:%s!%d", instance, pid, number)
+}
+
+func issueKey(instance, pid string, number int) string {
+	return fmt.Sprintf("%s:%s#%d", instance, pid, number)
+}
+
+// instanceName returns the name of the scm instance which the webhook belongs to,
+// it is read from the url path, the X-Gitlab-Instance header or the gitlab webhook token in order.
+func instanceName(r *http.Request) string {
+	if name := chi.URLParam(r, "instance"); name != "" {
+		return name
+	}
+	if name := r.Header.Get("X-Gitlab-Instance"); name != "" {
+		return name
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		claims, err := util.JwtParse(token, global.JWTSecret)
+		if err == nil && claims.Auth != nil {
+			return claims.Auth.Instance
 		}
-		ctr.Success(w)
 	}
+	return ""
+}
+
+func requestHost(r *http.Request) string {
+	var scheme = "http"
+	if r.URL != nil && r.URL.Scheme != "" {
+		scheme = r.URL.Scheme
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// verify checks the webhook request is sent by the provider,
+// it returns the auth info of the gitlab webhook token.
+func verify(cfg *scm.Config, r *http.Request, payload []byte) (*util.JwtAuthInfo, error) {
+	switch cfg.Type {
+	case scm.TypeGithub:
+		if !checkSignature(r.Header.Get("X-Hub-Signature-256"), "sha256=", cfg.Secret, payload) {
+			return nil, errors.New("Signature Invalid")
+		}
+	case scm.TypeGitea, scm.TypeForgejo:
+		if !checkSignature(r.Header.Get("X-Gitea-Signature"), "", cfg.Secret, payload) {
+			return nil, errors.New("Signature Invalid")
+		}
+	case scm.TypeBitbucket:
+		// the test connection of webhook settings carries no signature
+		if r.Header.Get("X-Event-Key") == "diagnostics:ping" {
+			return nil, nil
+		}
+		if !checkSignature(r.Header.Get("X-Hub-Signature"), "sha256=", cfg.Secret, payload) {
+			return nil, errors.New("Signature Invalid")
+		}
+	default:
+		token := r.Header.Get("X-Gitlab-Token")
+		claims, err := util.JwtParse(token, global.JWTSecret)
+		if err != nil || claims.Auth == nil {
+			return nil, errors.New("Signature Token Invalid")
+		}
+		if !claims.Auth.CheckSign(cfg.Secret) {
+			return nil, errors.New("Signature Invalid")
+		}
+		return claims.Auth, nil
+	}
+	return nil, nil
+}
+
+// checkSignature verifies the hex encoded hmac-sha256 signature of the payload.
+func checkSignature(signature, prefix, secret string, payload []byte) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
 }
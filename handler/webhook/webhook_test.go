@@ -0,0 +1,54 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCheckSignature(t *testing.T) {
+	payload := []byte(`{"action":"opened"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write(payload)
+	sign := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		signature string
+		prefix    string
+		secret    string
+		want      bool
+	}{
+		{name: "valid", signature: "sha256=" + sign, prefix: "sha256=", secret: "secret", want: true},
+		{name: "valid without prefix", signature: sign, secret: "secret", want: true},
+		{name: "bad prefix", signature: "sha1=" + sign, prefix: "sha256=", secret: "secret"},
+		{name: "missing prefix", signature: sign, prefix: "sha256=", secret: "secret"},
+		{name: "bad hex", signature: "sha256=" + sign[:len(sign)-1] + "z", prefix: "sha256=", secret: "secret"},
+		{name: "empty signature", signature: "", secret: "secret"},
+		{name: "empty signature with prefix", signature: "sha256=", prefix: "sha256=", secret: "secret"},
+		{name: "wrong secret", signature: "sha256=" + sign, prefix: "sha256=", secret: "other"},
+		{name: "truncated", signature: "sha256=" + sign[:32], prefix: "sha256=", secret: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkSignature(tt.signature, tt.prefix, tt.secret, payload); got != tt.want {
+				t.Errorf("checkSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command parses the slash commands in the comments, e.g. `/kind bug`, `/assign @a @b`, `/lgtm cancel`.
+package command
+
+import "strings"
+
+// ArgCancel is the argument to cancel the command, e.g. `/lgtm cancel`.
+const ArgCancel = "cancel"
+
+// Command is a slash command at the beginning of a line.
+type Command struct {
+	// Name is the lower case name without the leading slash, e.g. kind
+	Name string
+	Args []string
+}
+
+// Parse returns the commands in the content in order.
+// Only the lines starting with a slash are recognised, the fenced code blocks and `>` quotes are ignored.
+func Parse(content string) Commands {
+	var (
+		result Commands
+		fence  string
+	)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if fence != "" {
+			// 代码块以相同或更长的标记结束
+			if strings.HasPrefix(line, fence) && strings.Trim(line, fence[:1]) == "" {
+				fence = ""
+			}
+			continue
+		}
+		if marker := fenceMarker(line); marker != "" {
+			fence = marker
+			continue
+		}
+		if cmd, ok := parseLine(line); ok {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+// fenceMarker returns the opening marker if the line starts a fenced code block.
+func fenceMarker(line string) string {
+	for _, c := range []string{"`", "~"} {
+		n := len(line) - len(strings.TrimLeft(line, c))
+		if n >= 3 {
+			return strings.Repeat(c, n)
+		}
+	}
+	return ""
+}
+
+func parseLine(line string) (Command, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return Command{}, false
+	}
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "/"))
+	if name == "" {
+		return Command{}, false
+	}
+	// 排除路径等非指令内容，如 /usr/bin
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return Command{}, false
+		}
+	}
+	return Command{Name: name, Args: fields[1:]}, true
+}
+
+// Match reports whether the command is the order, e.g. `/kind bug` matches the order `/kind bug`.
+// The arguments of the order must all be in the command,
+// and the command with arguments does not match the order without arguments, e.g. `/lgtm cancel` does not match `/lgtm`.
+func (c Command) Match(order string) bool {
+	cmd, ok := parseLine(order)
+	if !ok || cmd.Name != c.Name {
+		return false
+	}
+	// 取消指令不匹配原指令，如 /kind bug cancel
+	if c.canceled() && !cmd.canceled() {
+		return false
+	}
+	if len(cmd.Args) == 0 {
+		return len(c.Args) == 0
+	}
+	for _, arg := range cmd.Args {
+		if !c.hasArg(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Cancel reports whether the command cancels the order, e.g. `/lgtm cancel` cancels `/lgtm`.
+func (c Command) Cancel(order string) bool {
+	if !c.canceled() {
+		return false
+	}
+	return Command{Name: c.Name, Args: c.Args[:len(c.Args)-1]}.Match(order)
+}
+
+func (c Command) canceled() bool {
+	return len(c.Args) > 0 && strings.EqualFold(c.Args[len(c.Args)-1], ArgCancel)
+}
+
+func (c Command) hasArg(arg string) bool {
+	for _, v := range c.Args {
+		if strings.EqualFold(v, arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Usernames returns the arguments as usernames, the leading `@` and the separating commas are trimmed.
+func (c Command) Usernames() []string {
+	var result []string
+	for _, arg := range c.Args {
+		for _, v := range strings.Split(arg, ",") {
+			if v = strings.TrimPrefix(strings.TrimSpace(v), "@"); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
+// Commands is the parsed commands of the content.
+type Commands []Command
+
+// Filter returns the commands with the name.
+func (cs Commands) Filter(name string) Commands {
+	var result Commands
+	for _, c := range cs {
+		if c.Name == name {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// Has reports whether there is any command with the name.
+func (cs Commands) Has(name string) bool {
+	return len(cs.Filter(name)) > 0
+}
+
+// Match reports whether any command matches the order.
+func (cs Commands) Match(order string) bool {
+	for _, c := range cs {
+		if c.Match(order) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel reports whether any command cancels the order.
+func (cs Commands) Cancel(order string) bool {
+	for _, c := range cs {
+		if c.Cancel(order) {
+			return true
+		}
+	}
+	return false
+}
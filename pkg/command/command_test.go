@@ -0,0 +1,109 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Commands
+	}{
+		{
+			name:    "commands at line start",
+			content: "looks good\n/lgtm\n  /kind bug feature\r\n/assign @a, @b",
+			want: Commands{
+				{Name: "lgtm", Args: []string{}},
+				{Name: "kind", Args: []string{"bug", "feature"}},
+				{Name: "assign", Args: []string{"@a,", "@b"}},
+			},
+		},
+		{
+			name:    "not at line start",
+			content: "please /lgtm\n`/lgtm`",
+		},
+		{
+			name:    "quote",
+			content: "> /lgtm\n>/approve",
+		},
+		{
+			name:    "fenced code",
+			content: "```\n/lgtm\n```\n~~~~sh\n/approve\n~~~\n~~~~\n/hold",
+			want:    Commands{{Name: "hold", Args: []string{}}},
+		},
+		{
+			name:    "unclosed fenced code",
+			content: "```\n/lgtm",
+		},
+		{
+			name:    "not command",
+			content: "/\n/usr/bin/env\n//lgtm",
+		},
+		{
+			name:    "upper case",
+			content: "/LGTM",
+			want:    Commands{{Name: "lgtm", Args: []string{}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommand_Match(t *testing.T) {
+	tests := []struct {
+		content string
+		order   string
+		want    bool
+		cancel  bool
+	}{
+		{content: "/lgtm", order: "/lgtm", want: true},
+		{content: "/lgtm cancel", order: "/lgtm", want: false, cancel: true},
+		{content: "/hold", order: "/hold cancel", want: false},
+		{content: "/holdup", order: "/hold", want: false},
+		{content: "/kind bug", order: "/kind bug", want: true},
+		{content: "/kind bugfix-later", order: "/kind bug", want: false},
+		{content: "/kind feature bug", order: "/kind bug", want: true},
+		{content: "/kind", order: "/kind bug", want: false},
+		{content: "/remove-kind bug", order: "/kind bug", want: false},
+		{content: "/kind bug cancel", order: "/kind bug", want: false, cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content+" "+tt.order, func(t *testing.T) {
+			cmds := Parse(tt.content)
+			if got := cmds.Match(tt.order); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+			if got := cmds.Cancel(tt.order); got != tt.cancel {
+				t.Errorf("Cancel() = %v, want %v", got, tt.cancel)
+			}
+		})
+	}
+}
+
+func TestCommand_Usernames(t *testing.T) {
+	cmd := Parse("/assign @a, @b,c @").Filter("assign")[0]
+	if got, want := cmd.Usernames(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Usernames() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,536 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const bitbucketPageSize = 100
+
+type bitbucketClient struct {
+	config *Config
+	client *restClient
+}
+
+// NewBitbucketClient returns the client of Bitbucket Server / Data Center.
+// The pid of Bitbucket is `<project key>/<repository slug>`.
+func NewBitbucketClient(cfg *Config) (Interface, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", "Bearer "+cfg.Token)
+	return &bitbucketClient{
+		config: cfg,
+		client: newRestClient(cfg.Host, header),
+	}, nil
+}
+
+type bitbucketUser struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Slug         string `json:"slug"`
+	DisplayName  string `json:"displayName"`
+	EmailAddress string `json:"emailAddress"`
+}
+
+type bitbucketRef struct {
+	ID           string `json:"id"`
+	DisplayID    string `json:"displayId"`
+	LatestCommit string `json:"latestCommit"`
+	Repository   struct {
+		ID      int    `json:"id"`
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+}
+
+type bitbucketParticipant struct {
+	User     bitbucketUser `json:"user"`
+	Role     string        `json:"role"`
+	Approved bool          `json:"approved"`
+	Status   string        `json:"status"`
+}
+
+type bitbucketPullRequest struct {
+	ID          int                    `json:"id"`
+	Version     int                    `json:"version"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	State       string                 `json:"state"`
+	Draft       bool                   `json:"draft"`
+	CreatedDate int64                  `json:"createdDate"`
+	UpdatedDate int64                  `json:"updatedDate"`
+	FromRef     bitbucketRef           `json:"fromRef"`
+	ToRef       bitbucketRef           `json:"toRef"`
+	Author      bitbucketParticipant   `json:"author"`
+	Reviewers   []bitbucketParticipant `json:"reviewers"`
+	Properties  struct {
+		MergeCommit struct {
+			ID string `json:"id"`
+		} `json:"mergeCommit"`
+	} `json:"properties"`
+}
+
+type bitbucketComment struct {
+	ID          int           `json:"id"`
+	Text        string        `json:"text"`
+	Author      bitbucketUser `json:"author"`
+	CreatedDate int64         `json:"createdDate"`
+}
+
+type bitbucketPage struct {
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+// SplitTitleLabels splits the title tags like `[lgtm] [kind/bugfix] title` into labels and the real title.
+// Bitbucket has no labels, so the labels of the pull request are emulated by the title tags.
+func SplitTitleLabels(title string) ([]string, string) {
+	var labels []string
+	title = strings.TrimSpace(title)
+	for strings.HasPrefix(title, "[") {
+		end := strings.Index(title, "]")
+		if end < 0 {
+			break
+		}
+		if label := strings.TrimSpace(title[1:end]); label != "" {
+			labels = append(labels, label)
+		}
+		title = strings.TrimSpace(title[end+1:])
+	}
+	return labels, title
+}
+
+// titleLabels returns the labels of the title tags without the admin labels,
+// the title can be edited by the author, so the admin labels in it are never trusted.
+func titleLabels(title string) ([]string, string) {
+	labels, title := SplitTitleLabels(title)
+	result := make([]string, 0, len(labels))
+	for _, v := range labels {
+		if AdminSet.Label(v) == nil {
+			result = append(result, v)
+		}
+	}
+	return result, title
+}
+
+// JoinTitleLabels is the reverse of SplitTitleLabels.
+func JoinTitleLabels(labels []string, title string) string {
+	var b strings.Builder
+	for _, v := range labels {
+		b.WriteString("[" + v + "] ")
+	}
+	b.WriteString(title)
+	return b.String()
+}
+
+// patchLabels appends the adds not exist and drops the removes, the order of the labels is kept.
+func patchLabels(labels, adds, removes []string) []string {
+	result := make([]string, 0, len(labels)+len(adds))
+	for _, v := range append(append([]string(nil), labels...), adds...) {
+		if containsString(result, v) || containsString(removes, v) {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+func bitbucketProjectPath(pid string) string {
+	parts := strings.SplitN(pid, "/", 2)
+	return "/rest/api/1.0/projects/" + url.PathEscape(parts[0])
+}
+
+func bitbucketRepoPath(pid string) string {
+	parts := strings.SplitN(pid, "/", 2)
+	if len(parts) < 2 {
+		return bitbucketProjectPath(pid)
+	}
+	return bitbucketProjectPath(pid) + "/repos/" + url.PathEscape(parts[1])
+}
+
+func bitbucketTime(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
+
+// ListLabels always returns empty, the labels only exist in the title of the pull requests.
+func (s *bitbucketClient) ListLabels(_ string) ([]Label, error) {
+	return nil, nil
+}
+
+// CreateLabel does nothing, the labels only exist in the title of the pull requests.
+func (s *bitbucketClient) CreateLabel(_ string, _ *Label) error {
+	return nil
+}
+
+func (s *bitbucketClient) getPullRequest(pid string, prID int) (*bitbucketPullRequest, error) {
+	var pr bitbucketPullRequest
+	uri := fmt.Sprintf("%s/pull-requests/%d", bitbucketRepoPath(pid), prID)
+	if _, err := s.client.do(http.MethodGet, uri, nil, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+func (s *bitbucketClient) GetPullRequest(pid string, prID int) (*PullRequest, error) {
+	pr, err := s.getPullRequest(pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		reviewerIDs []int
+		approvedBy  []string
+	)
+	for _, v := range pr.Reviewers {
+		reviewerIDs = append(reviewerIDs, v.User.ID)
+		if v.Approved {
+			approvedBy = append(approvedBy, v.User.Name)
+		}
+	}
+	labels, title := titleLabels(pr.Title)
+	return &PullRequest{
+		ID:              pr.ID,
+		IID:             pr.ID,
+		TargetBranch:    pr.ToRef.DisplayID,
+		SourceBranch:    pr.FromRef.DisplayID,
+		ProjectID:       pr.ToRef.Repository.ID,
+		Title:           title,
+		State:           strings.ToLower(pr.State),
+		CreatedAt:       bitbucketTime(pr.CreatedDate),
+		UpdatedAt:       bitbucketTime(pr.UpdatedDate),
+		SourceProjectID: pr.FromRef.Repository.ID,
+		TargetProjectID: pr.ToRef.Repository.ID,
+		Labels:          labels,
+		Description:     pr.Description,
+		WorkInProgress:  pr.Draft,
+		SHA:             pr.FromRef.LatestCommit,
+		MergeCommitSHA:  pr.Properties.MergeCommit.ID,
+		ReviewerIDs:     reviewerIDs,
+		AuthorID:        pr.Author.User.ID,
+		TitleLabels:     true,
+		ApprovedBy:      approvedBy,
+	}, nil
+}
+
+func (s *bitbucketClient) UpdatePullRequest(pid string, prID int, data *UpdatePullRequest) error {
+	pr, err := s.getPullRequest(pid, prID)
+	if err != nil {
+		return err
+	}
+	labels, title := SplitTitleLabels(pr.Title)
+	if data.Title != "" {
+		title = data.Title
+	}
+	if data.Labels != nil {
+		labels = data.Labels
+	} else {
+		labels = patchLabels(labels, data.AddLabels, data.RemoveLabels)
+	}
+	description := pr.Description
+	if data.Description != "" {
+		description = data.Description
+	}
+
+	// the reviewers will be removed if they are not carried
+	names := make([]string, 0, len(pr.Reviewers))
+	for _, v := range pr.Reviewers {
+		names = append(names, v.User.Name)
+	}
+	if data.ReviewerIDs != nil {
+		if names, err = s.usernames(pid, data.ReviewerIDs); err != nil {
+			return err
+		}
+	}
+	reviewers := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		reviewers = append(reviewers, map[string]interface{}{
+			"user": map[string]string{"name": name},
+		})
+	}
+	in := map[string]interface{}{
+		"version":     pr.Version,
+		"title":       JoinTitleLabels(labels, title),
+		"description": description,
+		"reviewers":   reviewers,
+	}
+	if data.TargetBranch != "" {
+		in["toRef"] = map[string]string{"id": "refs/heads/" + data.TargetBranch}
+	}
+	// Bitbucket has no assignees, AssigneeID, AssigneeIDs and UnassignAll are ignored
+	logrus.Debugf("UpdatePullRequest options: %+v", in)
+	_, err = s.client.do(http.MethodPut, fmt.Sprintf("%s/pull-requests/%d", bitbucketRepoPath(pid), prID), in, nil)
+	return err
+}
+
+func (s *bitbucketClient) CreatePullRequestComment(pid string, prID int, comment string) error {
+	if comment == "" {
+		return nil
+	}
+	in := map[string]string{"text": comment}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("%s/pull-requests/%d/comments", bitbucketRepoPath(pid), prID), in, nil)
+	return err
+}
+
+// ListPullRequestComments returns the top level comments of the pull request,
+// they are read from the activities which are in reverse chronological order.
+func (s *bitbucketClient) ListPullRequestComments(pid string, prID int) ([]Comment, error) {
+	var result []Comment
+	start := 0
+	for {
+		var page struct {
+			bitbucketPage
+			Values []struct {
+				Action        string           `json:"action"`
+				CommentAction string           `json:"commentAction"`
+				Comment       bitbucketComment `json:"comment"`
+			} `json:"values"`
+		}
+		uri := fmt.Sprintf("%s/pull-requests/%d/activities?limit=%d&start=%d", bitbucketRepoPath(pid), prID, bitbucketPageSize, start)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Values {
+			if v.Action != "COMMENTED" || v.CommentAction != "ADDED" {
+				continue
+			}
+			result = append(result, Comment{
+				ID:   v.Comment.ID,
+				Body: v.Comment.Text,
+				Author: User{
+					ID:       v.Comment.Author.ID,
+					Username: v.Comment.Author.Name,
+					Name:     v.Comment.Author.DisplayName,
+					Email:    v.Comment.Author.EmailAddress,
+				},
+				CreatedAt: bitbucketTime(v.Comment.CreatedDate),
+			})
+		}
+		if page.IsLastPage {
+			break
+		}
+		start = page.NextPageStart
+	}
+	// 按创建时间正序排列
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result, nil
+}
+
+func (s *bitbucketClient) MergePullRequest(pid string, prID int, data *MergePullRequest) error {
+	pr, err := s.getPullRequest(pid, prID)
+	if err != nil {
+		return err
+	}
+	// Bitbucket has no equivalent of `merge when pipeline succeeds`,
+	// the merge will be rejected by the merge checks if the required builds are not passed.
+	in := map[string]interface{}{}
+	if data.Squash && data.SquashCommitMessage != "" {
+		in["strategyId"] = "squash"
+		in["message"] = data.SquashCommitMessage
+	}
+	uri := fmt.Sprintf("%s/pull-requests/%d/merge?version=%d", bitbucketRepoPath(pid), prID, pr.Version)
+	if _, err := s.client.do(http.MethodPost, uri, in, nil); err != nil {
+		return err
+	}
+	if !data.ShouldRemoveSourceBranch {
+		return nil
+	}
+
+	// only remove the source branch in the same repository
+	if pr.FromRef.Repository.ID != pr.ToRef.Repository.ID {
+		return nil
+	}
+	uri = strings.Replace(bitbucketRepoPath(pid), "/rest/api/1.0/", "/rest/branch-utils/1.0/", 1) + "/branches"
+	branch := map[string]interface{}{"name": pr.FromRef.ID, "dryRun": false}
+	if _, err := s.client.do(http.MethodDelete, uri, branch, nil); err != nil {
+		logrus.Warningf("Remove source branch(%s) failed: %v", pr.FromRef.DisplayID, err)
+	}
+	return nil
+}
+
+func (s *bitbucketClient) GetReviewConfig(pid, ref string) (*ReviewConfig, error) {
+	uri := bitbucketRepoPath(pid) + "/raw/" + ReviewConfigPath(TypeBitbucket)
+	// the default branch is used when ref is empty
+	if ref != "" {
+		uri += "?at=" + url.QueryEscape(ref)
+	}
+	data, _, err := s.client.raw(http.MethodGet, uri, nil, nil)
+	if isNotFound(err) {
+		return nil, ErrReviewConfigNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config ReviewConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, err
+}
+
+// ListProjectMembers returns the users who have permissions on the repository or its project.
+func (s *bitbucketClient) ListProjectMembers(pid string) ([]ProjectMember, error) {
+	repoPath := bitbucketRepoPath(pid)
+	projectPath := bitbucketProjectPath(pid)
+
+	var result []ProjectMember
+	exists := make(map[int]struct{})
+	for _, base := range []string{repoPath, projectPath} {
+		start := 0
+		for {
+			var page struct {
+				bitbucketPage
+				Values []struct {
+					User bitbucketUser `json:"user"`
+				} `json:"values"`
+			}
+			uri := fmt.Sprintf("%s/permissions/users?limit=%d&start=%d", base, bitbucketPageSize, start)
+			if _, err := s.client.do(http.MethodGet, uri, nil, &page); err != nil {
+				return nil, err
+			}
+			for _, v := range page.Values {
+				if _, ok := exists[v.User.ID]; ok {
+					continue
+				}
+				exists[v.User.ID] = struct{}{}
+				result = append(result, ProjectMember{
+					ID:       v.User.ID,
+					Username: v.User.Name,
+					Email:    v.User.EmailAddress,
+					Name:     v.User.DisplayName,
+				})
+			}
+			if page.IsLastPage {
+				break
+			}
+			start = page.NextPageStart
+		}
+		if repoPath == projectPath {
+			break
+		}
+	}
+	return result, nil
+}
+
+// usernames converts the user ids to the usernames of the project members,
+// the ids which are not project members are rejected, otherwise they would be dropped silently.
+func (s *bitbucketClient) usernames(pid string, ids []int) ([]string, error) {
+	members, err := s.ListProjectMembers(pid)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		var name string
+		for _, member := range members {
+			if member.ID == id {
+				name = member.Username
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("user(%d) is not a member of repo(%s)", id, pid)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *bitbucketClient) UpdateBuildStatus(pid, sha string, state BuildState) error {
+	var bbState string
+	switch state {
+	case BuildStateSuccess:
+		bbState = "SUCCESSFUL"
+	case BuildStateFailed, BuildStateCanceled:
+		bbState = "FAILED"
+	default:
+		bbState = "INPROGRESS"
+	}
+	commitURL := strings.TrimSuffix(s.config.Host, "/") +
+		strings.TrimPrefix(bitbucketRepoPath(pid), "/rest/api/1.0") + "/commits/" + sha
+	in := map[string]string{
+		"state":       bbState,
+		"key":         "review-check",
+		"name":        "Review Check",
+		"url":         commitURL,
+		"description": "desc",
+	}
+	_, err := s.client.do(http.MethodPost, "/rest/build-status/1.0/commits/"+sha, in, nil)
+	return err
+}
+
+func (s *bitbucketClient) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	method := http.MethodPost
+	if !approved {
+		method = http.MethodDelete
+	}
+	_, err := s.client.do(method, fmt.Sprintf("%s/pull-requests/%d/approve", bitbucketRepoPath(pid), prID), nil, nil)
+	return err
+}
+
+// RebasePullRequest is not supported, the rebase api of Bitbucket Server is provided by the optional git plugin.
+func (s *bitbucketClient) RebasePullRequest(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+// Bitbucket Server has no issue tracker, the issue apis return ErrNotSupported.
+
+func (s *bitbucketClient) GetIssue(_ string, _ int) (*Issue, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *bitbucketClient) UpdateIssue(_ string, _ int, _ *UpdateIssue) error {
+	return ErrNotSupported
+}
+
+func (s *bitbucketClient) CreateIssueComment(_ string, _ int, _ string) error {
+	return ErrNotSupported
+}
+
+// The builds of Bitbucket Server are reported by the external CI, the pipeline apis return ErrNotSupported.
+
+func (s *bitbucketClient) ListPullRequestPipelines(_ string, _ int) ([]Pipeline, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *bitbucketClient) ListPipelineJobs(_ string, _ int) ([]Job, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *bitbucketClient) RetryPipeline(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *bitbucketClient) RetryJob(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *bitbucketClient) PlayJob(_ string, _ int) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,301 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+const bitbucketRepoPath = "/rest/api/1.0/projects/PROJ/repos/repo"
+
+func newBitbucketClient(t *testing.T, responses map[string]interface{}) (*apiServer, scm.Interface) {
+	server := newAPIServer(t, responses)
+	client, err := scm.NewBitbucketClient(&scm.Config{
+		Type:  scm.TypeBitbucket,
+		Host:  server.URL,
+		Token: "token",
+	})
+	if err != nil {
+		t.Fatalf("NewBitbucketClient() error = %v", err)
+	}
+	return server, client
+}
+
+func bitbucketPullRequest(title string, reviewers ...map[string]interface{}) map[string]interface{} {
+	ref := func(branch string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":         "refs/heads/" + branch,
+			"displayId":  branch,
+			"repository": map[string]interface{}{"id": 10, "slug": "repo", "project": map[string]interface{}{"key": "PROJ"}},
+		}
+	}
+	return map[string]interface{}{
+		"id":          1,
+		"version":     3,
+		"title":       title,
+		"description": "desc",
+		"state":       "OPEN",
+		"author":      map[string]interface{}{"user": map[string]interface{}{"id": 1, "name": "author"}},
+		"fromRef":     ref("feature"),
+		"toRef":       ref("main"),
+		"reviewers":   reviewers,
+	}
+}
+
+func bitbucketReviewer(id int, name string, approved bool) map[string]interface{} {
+	return map[string]interface{}{
+		"user":     map[string]interface{}{"id": id, "name": name},
+		"approved": approved,
+	}
+}
+
+func TestTitleLabels(t *testing.T) {
+	tests := []struct {
+		title      string
+		wantLabels []string
+		wantTitle  string
+		// wantJoined is the title joined again
+		wantJoined string
+	}{
+		{title: "title", wantTitle: "title", wantJoined: "title"},
+		{
+			title:      "[lgtm] [kind/feature] title",
+			wantLabels: []string{"lgtm", "kind/feature"},
+			wantTitle:  "title",
+			wantJoined: "[lgtm] [kind/feature] title",
+		},
+		{
+			title:      "  [lgtm][ kind/feature ]  title [not a label]",
+			wantLabels: []string{"lgtm", "kind/feature"},
+			wantTitle:  "title [not a label]",
+			wantJoined: "[lgtm] [kind/feature] title [not a label]",
+		},
+		{title: "[] title", wantTitle: "title", wantJoined: "title"},
+		{title: "[unclosed title", wantTitle: "[unclosed title", wantJoined: "[unclosed title"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			labels, title := scm.SplitTitleLabels(tt.title)
+			if !reflect.DeepEqual(labels, tt.wantLabels) || title != tt.wantTitle {
+				t.Errorf("SplitTitleLabels() = %v %q, want %v %q", labels, title, tt.wantLabels, tt.wantTitle)
+			}
+			joined := scm.JoinTitleLabels(labels, title)
+			if joined != tt.wantJoined {
+				t.Errorf("JoinTitleLabels() = %q, want %q", joined, tt.wantJoined)
+			}
+			// the joined title is stable
+			labels, title = scm.SplitTitleLabels(joined)
+			if got := scm.JoinTitleLabels(labels, title); got != joined {
+				t.Errorf("JoinTitleLabels() round trip = %q, want %q", got, joined)
+			}
+		})
+	}
+}
+
+func TestBitbucketClient_GetPullRequest(t *testing.T) {
+	_, client := newBitbucketClient(t, map[string]interface{}{
+		"GET " + bitbucketRepoPath + "/pull-requests/1": bitbucketPullRequest(
+			"[lgtm] [approved] [kind/feature] title",
+			bitbucketReviewer(2, "reviewer1", false),
+			bitbucketReviewer(3, "approver1", true),
+		),
+	})
+
+	pr, err := client.GetPullRequest("PROJ/repo", 1)
+	if err != nil {
+		t.Fatalf("GetPullRequest() error = %v", err)
+	}
+	// the admin labels in the title are never trusted
+	if !reflect.DeepEqual(pr.Labels, []string{"kind/feature"}) || pr.Title != "title" || !pr.TitleLabels {
+		t.Errorf("GetPullRequest() labels = %v, title = %q, title labels = %v", pr.Labels, pr.Title, pr.TitleLabels)
+	}
+	if !reflect.DeepEqual(pr.ApprovedBy, []string{"approver1"}) {
+		t.Errorf("GetPullRequest() approved by = %v, want [approver1]", pr.ApprovedBy)
+	}
+	if !reflect.DeepEqual(pr.ReviewerIDs, []int{2, 3}) {
+		t.Errorf("GetPullRequest() reviewers = %v, want [2 3]", pr.ReviewerIDs)
+	}
+}
+
+func TestBitbucketClient_UpdatePullRequest_Labels(t *testing.T) {
+	key := "PUT " + bitbucketRepoPath + "/pull-requests/1"
+	server, client := newBitbucketClient(t, map[string]interface{}{
+		"GET " + bitbucketRepoPath + "/pull-requests/1": bitbucketPullRequest(
+			"[kind/feature] [lgtm] title", bitbucketReviewer(2, "reviewer1", false),
+		),
+		key: map[string]interface{}{},
+	})
+	reviewers := []interface{}{map[string]interface{}{"user": map[string]interface{}{"name": "reviewer1"}}}
+
+	// the labels not carried are kept in the title
+	err := client.UpdatePullRequest("PROJ/repo", 1, &scm.UpdatePullRequest{
+		AddLabels:    []string{"approved"},
+		RemoveLabels: []string{"lgtm"},
+	})
+	if err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	// the labels carried replace all and the title is kept
+	if err := client.UpdatePullRequest("PROJ/repo", 1, &scm.UpdatePullRequest{Labels: []string{}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	// the title is updated with the labels kept
+	if err := client.UpdatePullRequest("PROJ/repo", 1, &scm.UpdatePullRequest{Title: "new title"}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+
+	var titles []interface{}
+	for _, v := range server.Requests(key) {
+		body := v.Body.(map[string]interface{})
+		titles = append(titles, body["title"])
+		if body["version"] != float64(3) || body["description"] != "desc" || !reflect.DeepEqual(body["reviewers"], reviewers) {
+			t.Errorf("UpdatePullRequest() body = %v, want version, description and reviewers kept", body)
+		}
+	}
+	want := []interface{}{"[kind/feature] [approved] title", "title", "[kind/feature] [lgtm] new title"}
+	if !reflect.DeepEqual(titles, want) {
+		t.Errorf("UpdatePullRequest() titles = %v, want %v", titles, want)
+	}
+}
+
+func TestBitbucketClient_UpdatePullRequest_Reviewers(t *testing.T) {
+	key := "PUT " + bitbucketRepoPath + "/pull-requests/1"
+	permissions := func(id int, name string) map[string]interface{} {
+		return map[string]interface{}{
+			"isLastPage": true,
+			"values":     []interface{}{map[string]interface{}{"user": map[string]interface{}{"id": id, "name": name}}},
+		}
+	}
+	server, client := newBitbucketClient(t, map[string]interface{}{
+		"GET " + bitbucketRepoPath + "/pull-requests/1": bitbucketPullRequest(
+			"title", bitbucketReviewer(2, "reviewer1", false),
+		),
+		"GET " + bitbucketRepoPath + "/permissions/users":   permissions(2, "reviewer1"),
+		"GET /rest/api/1.0/projects/PROJ/permissions/users": permissions(3, "approver1"),
+		key: map[string]interface{}{},
+	})
+
+	if err := client.UpdatePullRequest("PROJ/repo", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{3, 4}}); err == nil {
+		t.Errorf("UpdatePullRequest() with unknown reviewer should fail")
+	}
+	if got := server.Requests(key); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() with unknown reviewer updated the pull request: %v", got)
+	}
+
+	if err := client.UpdatePullRequest("PROJ/repo", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{3}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	updates := server.Requests(key)
+	want := []interface{}{map[string]interface{}{"user": map[string]interface{}{"name": "approver1"}}}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].Body.(map[string]interface{})["reviewers"], want) {
+		t.Errorf("UpdatePullRequest() updates = %v, want reviewers %v", updates, want)
+	}
+}
+
+func TestBitbucketClient_MergePullRequest(t *testing.T) {
+	mergeKey := "POST " + bitbucketRepoPath + "/pull-requests/1/merge"
+	branchKey := "DELETE /rest/branch-utils/1.0/projects/PROJ/repos/repo/branches"
+	server, client := newBitbucketClient(t, map[string]interface{}{
+		"GET " + bitbucketRepoPath + "/pull-requests/1": bitbucketPullRequest("title"),
+		mergeKey:  map[string]interface{}{},
+		branchKey: 204,
+	})
+
+	err := client.MergePullRequest("PROJ/repo", 1, &scm.MergePullRequest{
+		Squash:                   true,
+		SquashCommitMessage:      "feat:title",
+		ShouldRemoveSourceBranch: true,
+	})
+	if err != nil {
+		t.Fatalf("MergePullRequest() error = %v", err)
+	}
+	merges := server.Requests(mergeKey)
+	want := map[string]interface{}{"strategyId": "squash", "message": "feat:title"}
+	if len(merges) != 1 || !reflect.DeepEqual(merges[0].Body, want) || merges[0].Query.Get("version") != "3" {
+		t.Errorf("MergePullRequest() requests = %v, want body %v with version 3", merges, want)
+	}
+	branches := server.Requests(branchKey)
+	wantBranch := map[string]interface{}{"name": "refs/heads/feature", "dryRun": false}
+	if len(branches) != 1 || !reflect.DeepEqual(branches[0].Body, wantBranch) {
+		t.Errorf("MergePullRequest() remove branch = %v, want %v", branches, wantBranch)
+	}
+}
+
+func TestBitbucketClient_RebasePullRequest(t *testing.T) {
+	_, client := newBitbucketClient(t, nil)
+	if err := client.RebasePullRequest("PROJ/repo", 1); err != scm.ErrNotSupported {
+		t.Errorf("RebasePullRequest() error = %v, want %v", err, scm.ErrNotSupported)
+	}
+}
+
+func TestParseWebhook_Bitbucket(t *testing.T) {
+	repo := scm.Repository{ID: 10, FullName: "PROJ/repo", Name: "repo"}
+	modified := &scm.PullRequestEvent{
+		Action:        scm.EventActionUpdate,
+		Actor:         scm.User{ID: 1, Username: "author", Name: "Author"},
+		Repository:    repo,
+		Number:        1,
+		Title:         "Add the feature",
+		Description:   "/kind feature",
+		SourceBranch:  "feature",
+		TargetBranch:  "main",
+		AuthorID:      1,
+		Labels:        []string{"kind/feature"},
+		LastCommitSHA: "0123456789abcdef",
+	}
+	pushed := *modified
+	pushed.NewCommits = true
+
+	tests := []struct {
+		name  string
+		event string
+		file  string
+		want  interface{}
+	}{
+		{name: "modified", event: "pr:modified", file: "bitbucket_pr_modified.json", want: modified},
+		{name: "source branch updated", event: "pr:from_ref_updated", file: "bitbucket_pr_modified.json", want: &pushed},
+		{
+			name:  "comment",
+			event: "pr:comment:added",
+			file:  "bitbucket_comment_added.json",
+			want: &scm.CommentEvent{
+				Actor:         scm.User{ID: 2, Username: "reviewer1", Name: "Reviewer"},
+				Repository:    repo,
+				Number:        1,
+				Note:          "/lgtm",
+				LastCommitSHA: "0123456789abcdef",
+			},
+		},
+		{name: "not concerned", event: "repo:refs_changed", file: "bitbucket_pr_modified.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, payload := webhookRequest(t, tt.file, map[string]string{"X-Event-Key": tt.event})
+			got, err := scm.ParseWebhook(scm.TypeBitbucket, r, payload)
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			if tt.want == nil && got != nil {
+				t.Errorf("ParseWebhook() = %+v, want nil", got)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWebhook() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type bitbucketEvent struct {
+	EventKey    string               `json:"eventKey"`
+	Actor       bitbucketUser        `json:"actor"`
+	PullRequest bitbucketPullRequest `json:"pullRequest"`
+	Comment     *struct {
+		ID     int           `json:"id"`
+		Text   string        `json:"text"`
+		Author bitbucketUser `json:"author"`
+	} `json:"comment"`
+}
+
+func (e *bitbucketEvent) repository() Repository {
+	repo := &e.PullRequest.ToRef.Repository
+	return Repository{
+		ID:       repo.ID,
+		FullName: repo.Project.Key + "/" + repo.Slug,
+		Name:     repo.Slug,
+	}
+}
+
+// parseBitbucketWebhook parses the webhook of Bitbucket Server / Data Center.
+// The default branch is not carried by the payload, so Repository.DefaultBranch is always empty.
+func parseBitbucketWebhook(r *http.Request, payload []byte) (interface{}, error) {
+	eventKey := r.Header.Get("X-Event-Key")
+	switch eventKey {
+	case "pr:opened", "pr:modified", "pr:from_ref_updated", "pr:merged", "pr:declined",
+		"pr:reviewer:approved", "pr:reviewer:unapproved", "pr:comment:added":
+	default:
+		return nil, nil
+	}
+
+	var e bitbucketEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, err
+	}
+	if eventKey == "pr:comment:added" {
+		if e.Comment == nil {
+			return nil, nil
+		}
+		return &CommentEvent{
+			Actor:         convertBitbucketUser(&e.Comment.Author),
+			Repository:    e.repository(),
+			Number:        e.PullRequest.ID,
+			Note:          e.Comment.Text,
+			LastCommitSHA: e.PullRequest.FromRef.LatestCommit,
+		}, nil
+	}
+
+	pr := &e.PullRequest
+	labels, title := titleLabels(pr.Title)
+	result := &PullRequestEvent{
+		Actor:         convertBitbucketUser(&e.Actor),
+		Repository:    e.repository(),
+		Number:        pr.ID,
+		Title:         title,
+		Description:   pr.Description,
+		SourceBranch:  pr.FromRef.DisplayID,
+		TargetBranch:  pr.ToRef.DisplayID,
+		AuthorID:      pr.Author.User.ID,
+		Labels:        labels,
+		LastCommitSHA: pr.FromRef.LatestCommit,
+	}
+	switch eventKey {
+	case "pr:opened":
+		result.Action = EventActionOpen
+	case "pr:modified", "pr:from_ref_updated":
+		result.Action = EventActionUpdate
+		result.NewCommits = eventKey == "pr:from_ref_updated"
+	case "pr:merged":
+		result.Action = EventActionMerge
+	case "pr:declined":
+		result.Action = EventActionClose
+	case "pr:reviewer:approved":
+		result.Action = EventActionApproved
+	case "pr:reviewer:unapproved":
+		result.Action = EventActionUnapproved
+	}
+	return result, nil
+}
+
+func convertBitbucketUser(user *bitbucketUser) User {
+	return User{
+		ID:       user.ID,
+		Username: user.Name,
+		Name:     user.DisplayName,
+		Email:    user.EmailAddress,
+	}
+}
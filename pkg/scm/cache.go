@@ -14,6 +14,44 @@
 
 package scm
 
+import (
+	"sync"
+	"time"
+)
+
+// Named wraps the client with the name of the scm instance,
+// the caches of the named client are isolated from the other instances.
+func Named(name string, si Interface) Interface {
+	if name == "" {
+		return si
+	}
+	return &namedClient{Interface: si, name: name}
+}
+
+type namedClient struct {
+	Interface
+	name string
+}
+
+// NameOf returns the instance name of the client, it is empty for the default instance.
+func NameOf(si Interface) string {
+	if c, ok := si.(*namedClient); ok {
+		return c.name
+	}
+	return ""
+}
+
+// CacheKey returns the key in the global caches of the client.
+func CacheKey(si Interface, key string) string {
+	if name := NameOf(si); name != "" {
+		return name + ":" + key
+	}
+	return key
+}
+
+// cacheLock guards the map caches below, the events are processed concurrently.
+var cacheLock sync.RWMutex
+
 var cache = Cache{}
 
 func Cached() Cache {
@@ -23,14 +61,20 @@ func Cached() Cache {
 type Cache map[string]struct{}
 
 func (c Cache) Add(key string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	c[key] = struct{}{}
 }
 
 func (c Cache) Remove(key string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	delete(c, key)
 }
 
 func (c Cache) IsExist(key string) bool {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 	_, ok := c[key]
 	return ok
 }
@@ -44,6 +88,8 @@ func RepoCached() RepoCache {
 type RepoCache map[string]Cache
 
 func (c RepoCache) List(key string) []string {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 	cache, ok := c[key]
 	if !ok {
 		return nil
@@ -57,18 +103,20 @@ func (c RepoCache) List(key string) []string {
 }
 
 func (c RepoCache) IsExist(key, value string) bool {
-	if cache, ok := c[key]; ok {
-		return cache.IsExist(value)
-	}
-	return false
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	_, ok := c[key][value]
+	return ok
 }
 
 func (c RepoCache) Add(key string, values ...string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	if _, ok := c[key]; !ok {
 		c[key] = make(Cache)
 	}
 	for _, v := range values {
-		c[key].Add(v)
+		c[key][v] = struct{}{}
 	}
 }
 
@@ -81,14 +129,116 @@ func UserCached() UserCache {
 type UserCache map[string]ProjectMember
 
 func (c UserCache) Add(name string, member ProjectMember) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	c[name] = member
 }
 
 func (c UserCache) Remove(name string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	delete(c, name)
 }
 
 func (c UserCache) Get(name string) (ProjectMember, bool) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 	member, ok := c[name]
 	return member, ok
 }
+
+// DefaultReviewConfigTTL is the default duration of caching the review config.
+const DefaultReviewConfigTTL = 10 * time.Minute
+
+var reviewConfigCache = NewReviewConfigCache(DefaultReviewConfigTTL)
+
+// ReviewConfigCached returns the cache of the review config of projects.
+func ReviewConfigCached() *ReviewConfigCache {
+	return reviewConfigCache
+}
+
+type reviewConfigItem struct {
+	// config is nil when the project has no review config
+	config   *ReviewConfig
+	expireAt time.Time
+}
+
+// ReviewConfigCache caches the review config keyed by project and ref, it is safe for concurrent use.
+// The project without review config is cached as nil, so it can be skipped cheaply.
+type ReviewConfigCache struct {
+	mux   sync.Mutex
+	ttl   time.Duration
+	items map[string]map[string]reviewConfigItem
+}
+
+func NewReviewConfigCache(ttl time.Duration) *ReviewConfigCache {
+	return &ReviewConfigCache{
+		ttl:   ttl,
+		items: make(map[string]map[string]reviewConfigItem),
+	}
+}
+
+// SetTTL sets the expiration of the items added later, zero or negative ttl disables the cache.
+func (c *ReviewConfigCache) SetTTL(ttl time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.ttl = ttl
+	if ttl <= 0 {
+		c.items = make(map[string]map[string]reviewConfigItem)
+	}
+}
+
+// Get returns the cached review config, nil config with true means the project has no review config.
+func (c *ReviewConfigCache) Get(key, ref string) (*ReviewConfig, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	item, ok := c.items[key][ref]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(item.expireAt) {
+		delete(c.items[key], ref)
+		return nil, false
+	}
+	if item.config == nil {
+		return nil, true
+	}
+	config := *item.config
+	return &config, true
+}
+
+// Add caches the review config, nil config means the project has no review config.
+func (c *ReviewConfigCache) Add(key, ref string, config *ReviewConfig) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	// 清理过期的缓存，避免无限增长
+	for k, refs := range c.items {
+		for ref, item := range refs {
+			if now.After(item.expireAt) {
+				delete(refs, ref)
+			}
+		}
+		if len(refs) == 0 {
+			delete(c.items, k)
+		}
+	}
+	if _, ok := c.items[key]; !ok {
+		c.items[key] = make(map[string]reviewConfigItem)
+	}
+	if config != nil {
+		copied := *config
+		config = &copied
+	}
+	c.items[key][ref] = reviewConfigItem{config: config, expireAt: now.Add(c.ttl)}
+}
+
+// Remove removes the cached review config of all refs of the project.
+func (c *ReviewConfigCache) Remove(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.items, key)
+}
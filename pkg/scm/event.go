@@ -0,0 +1,207 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type EventAction = string
+
+const (
+	EventActionOpen       EventAction = "open"
+	EventActionUpdate     EventAction = "update"
+	EventActionMerge      EventAction = "merge"
+	EventActionClose      EventAction = "close"
+	EventActionReopen     EventAction = "reopen"
+	EventActionApproved   EventAction = "approved"
+	EventActionUnapproved EventAction = "unapproved"
+)
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+}
+
+type Repository struct {
+	ID int `json:"id"`
+	// FullName is the pid of the provider, e.g. namespace/name
+	FullName      string `json:"full_name"`
+	Name          string `json:"name"`
+	DefaultBranch string `json:"default_branch"`
+	WebURL        string `json:"web_url"`
+}
+
+// PullRequestEvent is the provider neutral event of the pull request.
+type PullRequestEvent struct {
+	Action        EventAction `json:"action"`
+	Actor         User        `json:"actor"`
+	Repository    Repository  `json:"repository"`
+	Number        int         `json:"number"`
+	Title         string      `json:"title"`
+	Description   string      `json:"description"`
+	SourceBranch  string      `json:"source_branch"`
+	TargetBranch  string      `json:"target_branch"`
+	AuthorID      int         `json:"author_id"`
+	Labels        []string    `json:"labels"`
+	AssigneeIDs   []int       `json:"assignee_ids"`
+	LastCommitSHA string      `json:"last_commit_sha"`
+	// NewCommits means the update event is triggered by pushing commits to the source branch
+	NewCommits bool `json:"new_commits,omitempty"`
+}
+
+// CommentEvent is the provider neutral event of the comment on the pull request.
+type CommentEvent struct {
+	Actor       User       `json:"actor"`
+	Repository  Repository `json:"repository"`
+	Number      int        `json:"number"`
+	Note        string     `json:"note"`
+	AssigneeIDs []int      `json:"assignee_ids"`
+	// LastCommitSHA may be empty if the provider does not carry it in the comment event
+	LastCommitSHA string `json:"last_commit_sha"`
+}
+
+const (
+	PipelineStatusSuccess = "success"
+	PipelineStatusFailed  = "failed"
+)
+
+// PipelineEvent is the provider neutral event of the finished pipeline of the pull request.
+type PipelineEvent struct {
+	Actor      User       `json:"actor"`
+	Repository Repository `json:"repository"`
+	Number     int        `json:"number"`
+	SHA        string     `json:"sha"`
+	// Status is PipelineStatusSuccess or PipelineStatusFailed
+	Status string `json:"status"`
+	WebURL string `json:"web_url"`
+	// FailedJobs is the names of the failed jobs which are not allowed to fail
+	FailedJobs []string `json:"failed_jobs,omitempty"`
+}
+
+// IssueCommentEvent is the provider neutral event of the comment on the issue.
+type IssueCommentEvent struct {
+	Actor      User       `json:"actor"`
+	Repository Repository `json:"repository"`
+	Number     int        `json:"number"`
+	Note       string     `json:"note"`
+}
+
+// PushEvent is the provider neutral event of pushing commits to a branch.
+type PushEvent struct {
+	Actor      User       `json:"actor"`
+	Repository Repository `json:"repository"`
+	Branch     string     `json:"branch"`
+	Before     string     `json:"before"`
+	After      string     `json:"after"`
+	// Files is the files changed by the pushed commits
+	Files []string `json:"files"`
+	// Truncated means the provider does not carry all the commits, Files is incomplete
+	Truncated bool `json:"truncated"`
+}
+
+// Touches reports whether the file may be changed by the push.
+func (e *PushEvent) Touches(file string) bool {
+	if e.Truncated {
+		return true
+	}
+	for _, v := range e.Files {
+		if v == file {
+			return true
+		}
+	}
+	return false
+}
+
+// appendFiles appends the files not exists.
+func (e *PushEvent) appendFiles(files ...[]string) {
+	for _, list := range files {
+		for _, file := range list {
+			exists := false
+			for _, v := range e.Files {
+				if v == file {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				e.Files = append(e.Files, file)
+			}
+		}
+	}
+}
+
+// ParseWebhook parses the webhook payload of the provider into *PullRequestEvent, *CommentEvent,
+// *IssueCommentEvent, *PushEvent or *PipelineEvent,
+// it returns nil when the event is not concerned.
+func ParseWebhook(typ string, r *http.Request, payload []byte) (interface{}, error) {
+	switch typ {
+	case TypeGitlab, "":
+		return parseGitlabWebhook(r, payload)
+	case TypeGithub:
+		return parseGithubWebhook(r, payload)
+	case TypeGitea, TypeForgejo:
+		return parseGiteaWebhook(r, payload)
+	case TypeBitbucket:
+		return parseBitbucketWebhook(r, payload)
+	}
+	return nil, fmt.Errorf("unsupported scm type: %s", typ)
+}
+
+// DeliveryID returns the unique id of the webhook delivery, the redelivery of the same event has the same id.
+func DeliveryID(typ string, r *http.Request) string {
+	switch typ {
+	case TypeGithub:
+		return r.Header.Get("X-GitHub-Delivery")
+	case TypeGitea, TypeForgejo:
+		return r.Header.Get("X-Gitea-Delivery")
+	case TypeBitbucket:
+		return r.Header.Get("X-Request-Id")
+	}
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+func appendAssigneeID(ids []int, id int) []int {
+	if id <= 0 {
+		return ids
+	}
+	for _, v := range ids {
+		if v == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,606 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides a stateful in-memory implementation of scm.Interface for testing.
+package fake
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/99nil/go/sets"
+	"gopkg.in/yaml.v3"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/util"
+)
+
+// Call records a method call of the client.
+type Call struct {
+	Method string
+	Pid    string
+	Args   []interface{}
+}
+
+// Project is the in-memory state of a project.
+type Project struct {
+	// ReviewConfig is the raw content of review.yml, keyed by ref.
+	// The content of key "" is used when the ref is not found.
+	ReviewConfig map[string]string
+	Labels       []scm.Label
+	Members      []scm.ProjectMember
+	PullRequests map[int]*scm.PullRequest
+	// Assignees is the assignee ids of the pull requests.
+	Assignees map[int][]int
+	// Reviewers is the reviewer ids of the pull requests.
+	Reviewers map[int][]int
+	// Comments is the comments created on the pull requests.
+	Comments map[int][]string
+	// Notes is the comments of the pull requests returned by ListPullRequestComments,
+	// the comments created by the bot are not included.
+	Notes map[int][]scm.Comment
+	// Statuses is the build status of the commits.
+	Statuses map[string]scm.BuildState
+	// Approvals is the approval state of the pull requests set by the bot.
+	Approvals map[int]bool
+	// Merges is the merge options of the merged pull requests.
+	Merges map[int]*scm.MergePullRequest
+	Issues map[int]*scm.Issue
+	// IssueComments is the comments created on the issues.
+	IssueComments map[int][]string
+	// Pipelines is the pipelines of the pull requests, the latest first.
+	Pipelines map[int][]scm.Pipeline
+	// Jobs is the jobs of the pipelines.
+	Jobs map[int][]scm.Job
+	// RebaseErrors is the merge error of the pull requests set when the rebase finishes,
+	// the rebase succeeds if not set.
+	RebaseErrors map[int]string
+	// RebasePending is the pull requests whose rebase never finishes.
+	RebasePending map[int]bool
+}
+
+func (p *Project) init() {
+	if p.ReviewConfig == nil {
+		p.ReviewConfig = make(map[string]string)
+	}
+	if p.PullRequests == nil {
+		p.PullRequests = make(map[int]*scm.PullRequest)
+	}
+	if p.Assignees == nil {
+		p.Assignees = make(map[int][]int)
+	}
+	if p.Reviewers == nil {
+		p.Reviewers = make(map[int][]int)
+	}
+	if p.Comments == nil {
+		p.Comments = make(map[int][]string)
+	}
+	if p.Notes == nil {
+		p.Notes = make(map[int][]scm.Comment)
+	}
+	if p.Statuses == nil {
+		p.Statuses = make(map[string]scm.BuildState)
+	}
+	if p.Approvals == nil {
+		p.Approvals = make(map[int]bool)
+	}
+	if p.Merges == nil {
+		p.Merges = make(map[int]*scm.MergePullRequest)
+	}
+	if p.Issues == nil {
+		p.Issues = make(map[int]*scm.Issue)
+	}
+	if p.IssueComments == nil {
+		p.IssueComments = make(map[int][]string)
+	}
+	if p.Pipelines == nil {
+		p.Pipelines = make(map[int][]scm.Pipeline)
+	}
+	if p.Jobs == nil {
+		p.Jobs = make(map[int][]scm.Job)
+	}
+	if p.RebaseErrors == nil {
+		p.RebaseErrors = make(map[int]string)
+	}
+	if p.RebasePending == nil {
+		p.RebasePending = make(map[int]bool)
+	}
+}
+
+// Client is the in-memory implementation of scm.Interface, it is safe for concurrent use.
+type Client struct {
+	mux      sync.Mutex
+	projects map[string]*Project
+	errs     map[string]error
+	calls    []Call
+}
+
+var _ scm.Interface = (*Client)(nil)
+
+func New() *Client {
+	return &Client{
+		projects: make(map[string]*Project),
+		errs:     make(map[string]error),
+	}
+}
+
+// AddProject adds or replaces the project with pid.
+func (c *Client) AddProject(pid string, project *Project) *Project {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if project == nil {
+		project = &Project{}
+	}
+	project.init()
+	c.projects[pid] = project
+	return project
+}
+
+// Project returns the state of the project, the returned value should not be modified concurrently.
+func (c *Client) Project(pid string) *Project {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.projects[pid]
+}
+
+// SetError makes the method return err, passing nil err to clear it.
+func (c *Client) SetError(method string, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err == nil {
+		delete(c.errs, method)
+		return
+	}
+	c.errs[method] = err
+}
+
+// Calls returns the call history, filtered by the methods if provided.
+func (c *Client) Calls(methods ...string) []Call {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	result := make([]Call, 0, len(c.calls))
+	for _, v := range c.calls {
+		if _, ok := util.InStringSlice(methods, v.Method); len(methods) == 0 || ok {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ResetCalls clears the call history.
+func (c *Client) ResetCalls() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.calls = nil
+}
+
+// call records the call and returns the project and the injected error, the caller must hold the lock.
+func (c *Client) call(method, pid string, args ...interface{}) (*Project, error) {
+	c.calls = append(c.calls, Call{Method: method, Pid: pid, Args: args})
+	if err, ok := c.errs[method]; ok {
+		return nil, err
+	}
+	project, ok := c.projects[pid]
+	if !ok {
+		return nil, fmt.Errorf("project(%s) not found", pid)
+	}
+	return project, nil
+}
+
+func (p *Project) pullRequest(pid string, prID int) (*scm.PullRequest, error) {
+	pr, ok := p.PullRequests[prID]
+	if !ok {
+		return nil, fmt.Errorf("pull request(%d) not found in project(%s)", prID, pid)
+	}
+	return pr, nil
+}
+
+// rebase starts the rebase of the pull request, it finishes after being got once.
+// The merge error before the rebase is kept like GitLab does.
+func (p *Project) rebase(pr *scm.PullRequest) {
+	pr.RebaseInProgress = true
+}
+
+// progress advances the rebase in progress of the pull request,
+// the head sha is changed if the rebase succeeds.
+func (p *Project) progress(pr *scm.PullRequest) {
+	if !pr.RebaseInProgress || p.RebasePending[pr.IID] {
+		return
+	}
+	pr.RebaseInProgress = false
+	if reason, ok := p.RebaseErrors[pr.IID]; ok {
+		pr.MergeError = reason
+		return
+	}
+	pr.SHA = fmt.Sprintf("%x", sha1.Sum([]byte(pr.SHA+"/rebase")))
+}
+
+func (p *Project) job(pid string, jobID int) (*scm.Job, error) {
+	for _, jobs := range p.Jobs {
+		for i := range jobs {
+			if jobs[i].ID == jobID {
+				return &jobs[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("job(%d) not found in project(%s)", jobID, pid)
+}
+
+// retryPipeline sets the failed and canceled jobs of the pipeline to pending.
+func (p *Project) retryPipeline(pid string, pipelineID int) error {
+	jobs, ok := p.Jobs[pipelineID]
+	if !ok {
+		return fmt.Errorf("pipeline(%d) not found in project(%s)", pipelineID, pid)
+	}
+	for i, job := range jobs {
+		if job.Status == scm.BuildStateFailed || job.Status == scm.BuildStateCanceled {
+			jobs[i].Status = scm.BuildStatePending
+		}
+	}
+	return nil
+}
+
+func (p *Project) issue(pid string, issueID int) (*scm.Issue, error) {
+	issue, ok := p.Issues[issueID]
+	if !ok {
+		return nil, fmt.Errorf("issue(%d) not found in project(%s)", issueID, pid)
+	}
+	return issue, nil
+}
+
+// updateIssue applies the update to the issue with the semantic of GitLab.
+func (p *Project) updateIssue(issue *scm.Issue, data *scm.UpdateIssue) {
+	labels := sets.NewString(issue.Labels...)
+	if data.Labels != nil {
+		labels = sets.NewString(data.Labels...)
+	}
+	labels.Add(data.AddLabels...)
+	labels.Remove(data.RemoveLabels...)
+	issue.Labels = labels.List()
+	sort.Strings(issue.Labels)
+
+	if data.UnassignAll {
+		issue.AssigneeIDs = nil
+	} else if len(data.AssigneeIDs) > 0 {
+		issue.AssigneeIDs = append([]int(nil), data.AssigneeIDs...)
+	}
+	switch data.StateEvent {
+	case scm.IssueStateEventClose:
+		issue.State = "closed"
+	case scm.IssueStateEventReopen:
+		issue.State = "opened"
+	}
+}
+
+func (c *Client) GetReviewConfig(pid, ref string) (*scm.ReviewConfig, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("GetReviewConfig", pid, ref)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := project.ReviewConfig[ref]
+	if !ok {
+		content, ok = project.ReviewConfig[""]
+	}
+	if !ok {
+		return nil, scm.ErrReviewConfigNotFound
+	}
+	var config scm.ReviewConfig
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Client) ListProjectMembers(pid string) ([]scm.ProjectMember, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("ListProjectMembers", pid)
+	if err != nil {
+		return nil, err
+	}
+	return append([]scm.ProjectMember(nil), project.Members...), nil
+}
+
+func (c *Client) ListLabels(pid string) ([]scm.Label, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("ListLabels", pid)
+	if err != nil {
+		return nil, err
+	}
+	return append([]scm.Label(nil), project.Labels...), nil
+}
+
+func (c *Client) CreateLabel(pid string, label *scm.Label) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("CreateLabel", pid, *label)
+	if err != nil {
+		return err
+	}
+	for _, v := range project.Labels {
+		if v.Name == label.Name {
+			return fmt.Errorf("label(%s) already exists in project(%s)", label.Name, pid)
+		}
+	}
+	project.Labels = append(project.Labels, *label)
+	return nil
+}
+
+func (c *Client) CreatePullRequestComment(pid string, prID int, comment string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("CreatePullRequestComment", pid, prID, comment)
+	if err != nil {
+		return err
+	}
+	if _, err := project.pullRequest(pid, prID); err != nil {
+		return err
+	}
+	project.Comments[prID] = append(project.Comments[prID], comment)
+	return nil
+}
+
+func (c *Client) ListPullRequestComments(pid string, prID int) ([]scm.Comment, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("ListPullRequestComments", pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := project.pullRequest(pid, prID); err != nil {
+		return nil, err
+	}
+	return append([]scm.Comment(nil), project.Notes[prID]...), nil
+}
+
+func (c *Client) GetPullRequest(pid string, prID int) (*scm.PullRequest, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("GetPullRequest", pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := project.pullRequest(pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	result := *pr
+	result.Labels = append([]string(nil), pr.Labels...)
+	result.AssigneeIDs = append([]int(nil), project.Assignees[prID]...)
+	result.ReviewerIDs = append([]int(nil), project.Reviewers[prID]...)
+	project.progress(pr)
+	return &result, nil
+}
+
+// UpdatePullRequest follows the semantic of GitLab,
+// Labels replaces all the labels, then AddLabels and RemoveLabels are applied.
+func (c *Client) UpdatePullRequest(pid string, prID int, data *scm.UpdatePullRequest) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("UpdatePullRequest", pid, prID, *data)
+	if err != nil {
+		return err
+	}
+	pr, err := project.pullRequest(pid, prID)
+	if err != nil {
+		return err
+	}
+	if data.Title != "" {
+		pr.Title = data.Title
+	}
+	if data.Description != "" {
+		pr.Description = data.Description
+	}
+	if data.TargetBranch != "" {
+		pr.TargetBranch = data.TargetBranch
+	}
+	labels := sets.NewString(pr.Labels...)
+	if data.Labels != nil {
+		labels = sets.NewString(data.Labels...)
+	}
+	labels.Add(data.AddLabels...)
+	labels.Remove(data.RemoveLabels...)
+	pr.Labels = labels.List()
+	sort.Strings(pr.Labels)
+
+	switch {
+	case data.UnassignAll:
+		project.Assignees[prID] = nil
+	case len(data.AssigneeIDs) > 0:
+		project.Assignees[prID] = append([]int(nil), data.AssigneeIDs...)
+	case data.AssigneeID > 0:
+		project.Assignees[prID] = []int{data.AssigneeID}
+	}
+	if data.ReviewerIDs != nil {
+		project.Reviewers[prID] = append([]int(nil), data.ReviewerIDs...)
+	}
+	return nil
+}
+
+func (c *Client) UpdateBuildStatus(pid, sha string, state scm.BuildState) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("UpdateBuildStatus", pid, sha, state)
+	if err != nil {
+		return err
+	}
+	project.Statuses[sha] = state
+	return nil
+}
+
+func (c *Client) MergePullRequest(pid string, prID int, data *scm.MergePullRequest) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("MergePullRequest", pid, prID, *data)
+	if err != nil {
+		return err
+	}
+	pr, err := project.pullRequest(pid, prID)
+	if err != nil {
+		return err
+	}
+	if pr.State == "merged" {
+		return fmt.Errorf("pull request(%d) has been merged in project(%s)", prID, pid)
+	}
+	opt := *data
+	project.Merges[prID] = &opt
+	pr.State = "merged"
+	return nil
+}
+
+func (c *Client) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("MergePullRequestApprove", pid, prID, approved)
+	if err != nil {
+		return err
+	}
+	if _, err := project.pullRequest(pid, prID); err != nil {
+		return err
+	}
+	project.Approvals[prID] = approved
+	return nil
+}
+
+func (c *Client) RebasePullRequest(pid string, prID int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("RebasePullRequest", pid, prID)
+	if err != nil {
+		return err
+	}
+	pr, err := project.pullRequest(pid, prID)
+	if err != nil {
+		return err
+	}
+	project.rebase(pr)
+	return nil
+}
+
+func (c *Client) GetIssue(pid string, issueID int) (*scm.Issue, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("GetIssue", pid, issueID)
+	if err != nil {
+		return nil, err
+	}
+	issue, err := project.issue(pid, issueID)
+	if err != nil {
+		return nil, err
+	}
+	result := *issue
+	result.Labels = append([]string(nil), issue.Labels...)
+	result.AssigneeIDs = append([]int(nil), issue.AssigneeIDs...)
+	return &result, nil
+}
+
+func (c *Client) UpdateIssue(pid string, issueID int, data *scm.UpdateIssue) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("UpdateIssue", pid, issueID, *data)
+	if err != nil {
+		return err
+	}
+	issue, err := project.issue(pid, issueID)
+	if err != nil {
+		return err
+	}
+	project.updateIssue(issue, data)
+	return nil
+}
+
+func (c *Client) CreateIssueComment(pid string, issueID int, comment string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("CreateIssueComment", pid, issueID, comment)
+	if err != nil {
+		return err
+	}
+	if _, err := project.issue(pid, issueID); err != nil {
+		return err
+	}
+	project.IssueComments[issueID] = append(project.IssueComments[issueID], comment)
+	return nil
+}
+
+func (c *Client) ListPullRequestPipelines(pid string, prID int) ([]scm.Pipeline, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("ListPullRequestPipelines", pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := project.pullRequest(pid, prID); err != nil {
+		return nil, err
+	}
+	return append([]scm.Pipeline(nil), project.Pipelines[prID]...), nil
+}
+
+func (c *Client) ListPipelineJobs(pid string, pipelineID int) ([]scm.Job, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("ListPipelineJobs", pid, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]scm.Job(nil), project.Jobs[pipelineID]...), nil
+}
+
+func (c *Client) RetryPipeline(pid string, pipelineID int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("RetryPipeline", pid, pipelineID)
+	if err != nil {
+		return err
+	}
+	return project.retryPipeline(pid, pipelineID)
+}
+
+func (c *Client) RetryJob(pid string, jobID int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("RetryJob", pid, jobID)
+	if err != nil {
+		return err
+	}
+	job, err := project.job(pid, jobID)
+	if err != nil {
+		return err
+	}
+	job.Status = scm.BuildStatePending
+	return nil
+}
+
+func (c *Client) PlayJob(pid string, jobID int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	project, err := c.call("PlayJob", pid, jobID)
+	if err != nil {
+		return err
+	}
+	job, err := project.job(pid, jobID)
+	if err != nil {
+		return err
+	}
+	if job.Status != scm.BuildStateManual {
+		return fmt.Errorf("job(%d) is not a manual job", jobID)
+	}
+	job.Status = scm.BuildStatePending
+	return nil
+}
@@ -0,0 +1,685 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/99nil/go/sets"
+	"github.com/go-chi/chi"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/util"
+)
+
+// Request records a request received by the fake server.
+type Request struct {
+	Method string
+	// Pid is the unescaped project id of the request
+	Pid string
+	// Route is the matched route pattern, e.g. /api/v4/projects/{pid}/labels
+	Route string
+	Query url.Values
+	Body  map[string]interface{}
+}
+
+// GitlabServer is a fake GitLab api server covering the endpoints used by the bot,
+// its state is stored in the same Project as the in-memory Client.
+type GitlabServer struct {
+	*httptest.Server
+
+	mux      sync.Mutex
+	projects map[string]*Project
+	requests []Request
+}
+
+// NewGitlabServer starts a fake GitLab api server, the caller should call Close when finished.
+func NewGitlabServer() *GitlabServer {
+	s := &GitlabServer{
+		projects: make(map[string]*Project),
+	}
+	r := chi.NewRouter()
+	r.Route("/api/v4/projects/{pid}", func(r chi.Router) {
+		r.Get("/labels", s.listLabels)
+		r.Post("/labels", s.createLabel)
+		r.Get("/members/all", s.listMembers)
+		r.Get("/repository/files/{file}/raw", s.getRawFile)
+		r.Post("/statuses/{sha}", s.setCommitStatus)
+		r.Get("/merge_requests/{iid}", s.getMergeRequest)
+		r.Put("/merge_requests/{iid}", s.updateMergeRequest)
+		r.Get("/merge_requests/{iid}/notes", s.listNotes)
+		r.Post("/merge_requests/{iid}/notes", s.createNote)
+		r.Put("/merge_requests/{iid}/merge", s.acceptMergeRequest)
+		r.Post("/merge_requests/{iid}/approve", s.approve(true))
+		r.Post("/merge_requests/{iid}/unapprove", s.approve(false))
+		r.Put("/merge_requests/{iid}/rebase", s.rebase)
+		r.Get("/merge_requests/{iid}/pipelines", s.listPipelines)
+		r.Get("/pipelines/{id}/jobs", s.listJobs)
+		r.Post("/pipelines/{id}/retry", s.retryPipeline)
+		r.Post("/jobs/{id}/retry", s.retryJob)
+		r.Post("/jobs/{id}/play", s.playJob)
+		r.Get("/issues/{iid}", s.getIssue)
+		r.Put("/issues/{iid}", s.updateIssue)
+		r.Post("/issues/{iid}/notes", s.createIssueNote)
+	})
+	s.Server = httptest.NewServer(r)
+	return s
+}
+
+// AddProject adds or replaces the project with pid.
+func (s *GitlabServer) AddProject(pid string, project *Project) *Project {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if project == nil {
+		project = &Project{}
+	}
+	project.init()
+	s.projects[pid] = project
+	return project
+}
+
+// Project returns the state of the project, the returned value should not be modified concurrently.
+func (s *GitlabServer) Project(pid string) *Project {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.projects[pid]
+}
+
+// Requests returns the received requests, filtered by `METHOD route` (e.g. `PUT /merge_requests/{iid}`)
+// relative to the project if provided.
+func (s *GitlabServer) Requests(routes ...string) []Request {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	result := make([]Request, 0, len(s.requests))
+	for _, v := range s.requests {
+		key := v.Method + " " + strings.TrimPrefix(v.Route, "/api/v4/projects/{pid}")
+		if _, ok := util.InStringSlice(routes, key); len(routes) == 0 || ok {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ResetRequests clears the received requests.
+func (s *GitlabServer) ResetRequests() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests = nil
+}
+
+// begin records the request and returns the project, the caller must call s.mux.Unlock.
+func (s *GitlabServer) begin(w http.ResponseWriter, r *http.Request) (*Project, bool) {
+	pid, _ := url.PathUnescape(chi.URLParam(r, "pid"))
+	req := Request{
+		Method: r.Method,
+		Pid:    pid,
+		Route:  chi.RouteContext(r.Context()).RoutePattern(),
+		Query:  r.URL.Query(),
+	}
+	if data, err := ioutil.ReadAll(r.Body); err == nil && len(data) > 0 {
+		_ = json.Unmarshal(data, &req.Body)
+	}
+
+	s.mux.Lock()
+	s.requests = append(s.requests, req)
+	project, ok := s.projects[pid]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Project Not Found"})
+	}
+	return project, ok
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func iid(r *http.Request) int {
+	id, _ := strconv.Atoi(chi.URLParam(r, "iid"))
+	return id
+}
+
+func pathID(r *http.Request) int {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	return id
+}
+
+// paginate returns the range of the page, following the pagination parameters of GitLab.
+func paginate(r *http.Request, total int) (int, int) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 20
+	}
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func (s *GitlabServer) listLabels(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	start, end := paginate(r, len(project.Labels))
+	result := make([]map[string]interface{}, 0, end-start)
+	for k, v := range project.Labels[start:end] {
+		result = append(result, map[string]interface{}{
+			"id":          start + k + 1,
+			"name":        v.Name,
+			"color":       v.Color,
+			"text_color":  v.TextColor,
+			"description": v.Description,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *GitlabServer) createLabel(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	body := s.requests[len(s.requests)-1].Body
+	label := scm.Label{}
+	label.Name, _ = body["name"].(string)
+	label.Color, _ = body["color"].(string)
+	label.Description, _ = body["description"].(string)
+	for _, v := range project.Labels {
+		if v.Name == label.Name {
+			writeJSON(w, http.StatusConflict, map[string]string{"message": "Label already exists"})
+			return
+		}
+	}
+	project.Labels = append(project.Labels, label)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":          len(project.Labels),
+		"name":        label.Name,
+		"color":       label.Color,
+		"description": label.Description,
+	})
+}
+
+func (s *GitlabServer) listMembers(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	start, end := paginate(r, len(project.Members))
+	writeJSON(w, http.StatusOK, project.Members[start:end])
+}
+
+func (s *GitlabServer) getRawFile(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	file, _ := url.PathUnescape(chi.URLParam(r, "file"))
+	if file != ".gitlab/"+scm.ReviewConfigFileName {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 File Not Found"})
+		return
+	}
+	content, ok := project.ReviewConfig[r.URL.Query().Get("ref")]
+	if !ok {
+		content, ok = project.ReviewConfig[""]
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 File Not Found"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(content))
+}
+
+func (s *GitlabServer) setCommitStatus(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	sha := chi.URLParam(r, "sha")
+	state, _ := s.requests[len(s.requests)-1].Body["state"].(string)
+	project.Statuses[sha] = state
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"sha": sha, "status": state})
+}
+
+func (s *GitlabServer) mergeRequest(w http.ResponseWriter, r *http.Request, project *Project) (*scm.PullRequest, bool) {
+	pr, ok := project.PullRequests[iid(r)]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+	}
+	return pr, ok
+}
+
+func (s *GitlabServer) writeMergeRequest(w http.ResponseWriter, pr *scm.PullRequest, project *Project) {
+	labels := pr.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+	assignees := make([]map[string]interface{}, 0)
+	for _, id := range project.Assignees[pr.IID] {
+		assignees = append(assignees, map[string]interface{}{"id": id})
+	}
+	reviewers := make([]map[string]interface{}, 0)
+	for _, id := range project.Reviewers[pr.IID] {
+		reviewers = append(reviewers, map[string]interface{}{"id": id})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":                 pr.ID,
+		"iid":                pr.IID,
+		"project_id":         pr.ProjectID,
+		"title":              pr.Title,
+		"description":        pr.Description,
+		"state":              pr.State,
+		"labels":             labels,
+		"assignees":          assignees,
+		"reviewers":          reviewers,
+		"author":             map[string]interface{}{"id": pr.AuthorID},
+		"rebase_in_progress": pr.RebaseInProgress,
+		"merge_error":        pr.MergeError,
+		"source_branch":      pr.SourceBranch,
+		"target_branch":      pr.TargetBranch,
+		"sha":                pr.SHA,
+		"squash":             pr.Squash,
+		"merge_commit_sha":   pr.MergeCommitSHA,
+	})
+}
+
+func (s *GitlabServer) getMergeRequest(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	if pr, ok := s.mergeRequest(w, r, project); ok {
+		s.writeMergeRequest(w, pr, project)
+		project.progress(pr)
+	}
+}
+
+func (s *GitlabServer) rebase(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	if pr, ok := s.mergeRequest(w, r, project); ok {
+		project.rebase(pr)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"rebase_in_progress": true})
+	}
+}
+
+func splitLabels(v interface{}) ([]string, bool) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	var labels []string
+	for _, label := range strings.Split(str, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels, true
+}
+
+// updateMergeRequest follows the semantic of GitLab,
+// labels replaces all the labels, then add_labels and remove_labels are applied.
+func (s *GitlabServer) updateMergeRequest(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	pr, ok := s.mergeRequest(w, r, project)
+	if !ok {
+		return
+	}
+	body := s.requests[len(s.requests)-1].Body
+	if v, ok := body["title"].(string); ok {
+		pr.Title = v
+	}
+	if v, ok := body["description"].(string); ok {
+		pr.Description = v
+	}
+	if v, ok := body["target_branch"].(string); ok {
+		pr.TargetBranch = v
+	}
+
+	labels := sets.NewString(pr.Labels...)
+	if v, ok := splitLabels(body["labels"]); ok {
+		labels = sets.NewString(v...)
+	}
+	if v, ok := splitLabels(body["add_labels"]); ok {
+		labels.Add(v...)
+	}
+	if v, ok := splitLabels(body["remove_labels"]); ok {
+		labels.Remove(v...)
+	}
+	pr.Labels = labels.List()
+	sort.Strings(pr.Labels)
+
+	if ids, ok := body["assignee_ids"].([]interface{}); ok {
+		project.Assignees[pr.IID] = nil
+		for _, v := range ids {
+			if id, ok := v.(float64); ok {
+				project.Assignees[pr.IID] = append(project.Assignees[pr.IID], int(id))
+			}
+		}
+	} else if id, ok := body["assignee_id"].(float64); ok {
+		project.Assignees[pr.IID] = []int{int(id)}
+	}
+	if ids, ok := body["reviewer_ids"].([]interface{}); ok {
+		project.Reviewers[pr.IID] = nil
+		for _, v := range ids {
+			if id, ok := v.(float64); ok {
+				project.Reviewers[pr.IID] = append(project.Reviewers[pr.IID], int(id))
+			}
+		}
+	}
+	s.writeMergeRequest(w, pr, project)
+}
+
+func (s *GitlabServer) listNotes(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	pr, ok := s.mergeRequest(w, r, project)
+	if !ok {
+		return
+	}
+	notes := project.Notes[pr.IID]
+	start, end := paginate(r, len(notes))
+	result := make([]map[string]interface{}, 0, end-start)
+	for _, v := range notes[start:end] {
+		result = append(result, map[string]interface{}{
+			"id":   v.ID,
+			"body": v.Body,
+			"author": map[string]interface{}{
+				"id":       v.Author.ID,
+				"username": v.Author.Username,
+				"name":     v.Author.Name,
+			},
+			"created_at": v.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *GitlabServer) createNote(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	pr, ok := s.mergeRequest(w, r, project)
+	if !ok {
+		return
+	}
+	body, _ := s.requests[len(s.requests)-1].Body["body"].(string)
+	project.Comments[pr.IID] = append(project.Comments[pr.IID], body)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":   len(project.Comments[pr.IID]),
+		"body": body,
+	})
+}
+
+func (s *GitlabServer) acceptMergeRequest(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	pr, ok := s.mergeRequest(w, r, project)
+	if !ok {
+		return
+	}
+	if pr.State != "opened" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "405 Method Not Allowed"})
+		return
+	}
+	body := s.requests[len(s.requests)-1].Body
+	opt := &scm.MergePullRequest{}
+	opt.Squash, _ = body["squash"].(bool)
+	opt.SquashCommitMessage, _ = body["squash_commit_message"].(string)
+	opt.ShouldRemoveSourceBranch, _ = body["should_remove_source_branch"].(bool)
+	opt.MergeWhenPipelineSucceeds, _ = body["merge_when_pipeline_succeeds"].(bool)
+	project.Merges[pr.IID] = opt
+	pr.State = "merged"
+	s.writeMergeRequest(w, pr, project)
+}
+
+func (s *GitlabServer) approve(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		project, ok := s.begin(w, r)
+		defer s.mux.Unlock()
+		if !ok {
+			return
+		}
+		pr, ok := s.mergeRequest(w, r, project)
+		if !ok {
+			return
+		}
+		project.Approvals[pr.IID] = approved
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"iid": pr.IID})
+	}
+}
+
+func (s *GitlabServer) issue(w http.ResponseWriter, r *http.Request, project *Project) (*scm.Issue, bool) {
+	issue, ok := project.Issues[iid(r)]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+	}
+	return issue, ok
+}
+
+func writeIssue(w http.ResponseWriter, issue *scm.Issue) {
+	labels := issue.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+	assignees := make([]map[string]interface{}, 0, len(issue.AssigneeIDs))
+	for _, id := range issue.AssigneeIDs {
+		assignees = append(assignees, map[string]interface{}{"id": id})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":          issue.ID,
+		"iid":         issue.IID,
+		"title":       issue.Title,
+		"description": issue.Description,
+		"state":       issue.State,
+		"author":      map[string]interface{}{"id": issue.AuthorID},
+		"labels":      labels,
+		"assignees":   assignees,
+	})
+}
+
+func (s *GitlabServer) getIssue(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	if issue, ok := s.issue(w, r, project); ok {
+		writeIssue(w, issue)
+	}
+}
+
+func (s *GitlabServer) updateIssue(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	issue, ok := s.issue(w, r, project)
+	if !ok {
+		return
+	}
+	body := s.requests[len(s.requests)-1].Body
+	data := &scm.UpdateIssue{}
+	if v, ok := splitLabels(body["labels"]); ok {
+		data.Labels = append([]string{}, v...)
+	}
+	data.AddLabels, _ = splitLabels(body["add_labels"])
+	data.RemoveLabels, _ = splitLabels(body["remove_labels"])
+	data.StateEvent, _ = body["state_event"].(string)
+	if ids, ok := body["assignee_ids"].([]interface{}); ok {
+		for _, v := range ids {
+			if id, ok := v.(float64); ok {
+				data.AssigneeIDs = append(data.AssigneeIDs, int(id))
+			}
+		}
+		data.UnassignAll = len(data.AssigneeIDs) == 0
+	}
+	project.updateIssue(issue, data)
+	writeIssue(w, issue)
+}
+
+func (s *GitlabServer) createIssueNote(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	issue, ok := s.issue(w, r, project)
+	if !ok {
+		return
+	}
+	body, _ := s.requests[len(s.requests)-1].Body["body"].(string)
+	project.IssueComments[issue.IID] = append(project.IssueComments[issue.IID], body)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":   len(project.IssueComments[issue.IID]),
+		"body": body,
+	})
+}
+
+func (s *GitlabServer) listPipelines(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	pr, ok := s.mergeRequest(w, r, project)
+	if !ok {
+		return
+	}
+	result := make([]map[string]interface{}, 0)
+	for _, v := range project.Pipelines[pr.IID] {
+		result = append(result, map[string]interface{}{
+			"id":      v.ID,
+			"sha":     v.SHA,
+			"ref":     v.Ref,
+			"status":  v.Status,
+			"web_url": v.WebURL,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *GitlabServer) listJobs(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	jobs, ok := project.Jobs[pathID(r)]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+		return
+	}
+	start, end := paginate(r, len(jobs))
+	result := make([]map[string]interface{}, 0, end-start)
+	for _, v := range jobs[start:end] {
+		result = append(result, map[string]interface{}{
+			"id":            v.ID,
+			"name":          v.Name,
+			"stage":         v.Stage,
+			"status":        v.Status,
+			"allow_failure": v.AllowFailure,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *GitlabServer) retryPipeline(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	if err := project.retryPipeline(chi.URLParam(r, "pid"), pathID(r)); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": pathID(r), "status": scm.BuildStatePending})
+}
+
+func (s *GitlabServer) retryJob(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	job, err := project.job(chi.URLParam(r, "pid"), pathID(r))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+		return
+	}
+	job.Status = scm.BuildStatePending
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": job.ID, "name": job.Name, "status": job.Status})
+}
+
+func (s *GitlabServer) playJob(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.begin(w, r)
+	defer s.mux.Unlock()
+	if !ok {
+		return
+	}
+	job, err := project.job(chi.URLParam(r, "pid"), pathID(r))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "404 Not found"})
+		return
+	}
+	if job.Status != scm.BuildStateManual {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "400 Unplayable Job"})
+		return
+	}
+	job.Status = scm.BuildStatePending
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": job.ID, "name": job.Name, "status": job.Status})
+}
@@ -0,0 +1,615 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// giteaPageSize is the max page size of the Gitea api by default.
+const giteaPageSize = 50
+
+type giteaClient struct {
+	config *Config
+	client *restClient
+
+	mux   sync.Mutex
+	login string
+}
+
+// NewGiteaClient returns the client of Gitea, it also works for Forgejo.
+func NewGiteaClient(cfg *Config) (Interface, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", "token "+cfg.Token)
+	return &giteaClient{
+		config: cfg,
+		client: newRestClient(strings.TrimSuffix(cfg.Host, "/")+"/api/v1", header),
+	}, nil
+}
+
+type giteaUser struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	FullName  string `json:"full_name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type giteaLabel struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	Description string `json:"description"`
+}
+
+type giteaPullRequest struct {
+	ID        int          `json:"id"`
+	Number    int          `json:"number"`
+	Title     string       `json:"title"`
+	Body      string       `json:"body"`
+	State     string       `json:"state"`
+	Merged    bool         `json:"merged"`
+	User      giteaUser    `json:"user"`
+	Labels    []giteaLabel `json:"labels"`
+	Assignees []giteaUser  `json:"assignees"`
+	CreatedAt *time.Time   `json:"created_at"`
+	UpdatedAt *time.Time   `json:"updated_at"`
+	Head      giteaRef     `json:"head"`
+	Base      giteaRef     `json:"base"`
+
+	MergeCommitSHA     string      `json:"merge_commit_sha"`
+	RequestedReviewers []giteaUser `json:"requested_reviewers"`
+}
+
+type giteaRef struct {
+	Ref    string `json:"ref"`
+	SHA    string `json:"sha"`
+	RepoID int    `json:"repo_id"`
+}
+
+type giteaIssue struct {
+	ID        int          `json:"id"`
+	Number    int          `json:"number"`
+	Title     string       `json:"title"`
+	Body      string       `json:"body"`
+	State     string       `json:"state"`
+	User      giteaUser    `json:"user"`
+	Labels    []giteaLabel `json:"labels"`
+	Assignees []giteaUser  `json:"assignees"`
+}
+
+type giteaComment struct {
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	User      giteaUser  `json:"user"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+type giteaReview struct {
+	ID        int       `json:"id"`
+	State     string    `json:"state"`
+	Dismissed bool      `json:"dismissed"`
+	User      giteaUser `json:"user"`
+}
+
+func (s *giteaClient) listLabels(pid string) ([]giteaLabel, error) {
+	var result []giteaLabel
+	var page int
+	for {
+		page++
+		var labels []giteaLabel
+		uri := fmt.Sprintf("/repos/%s/labels?limit=%d&page=%d", pid, giteaPageSize, page)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &labels); err != nil {
+			return nil, err
+		}
+		result = append(result, labels...)
+		if len(labels) < giteaPageSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *giteaClient) ListLabels(pid string) ([]Label, error) {
+	labels, err := s.listLabels(pid)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Label, 0, len(labels))
+	for _, v := range labels {
+		result = append(result, Label{
+			Name:        v.Name,
+			Color:       "#" + strings.TrimPrefix(v.Color, "#"),
+			Description: v.Description,
+		})
+	}
+	return result, nil
+}
+
+func (s *giteaClient) CreateLabel(pid string, label *Label) error {
+	in := &giteaLabel{
+		Name:        label.Name,
+		Color:       "#" + strings.TrimPrefix(label.Color, "#"),
+		Description: label.Description,
+	}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/labels", pid), in, nil)
+	return err
+}
+
+func (s *giteaClient) GetPullRequest(pid string, prID int) (*PullRequest, error) {
+	var pr giteaPullRequest
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d", pid, prID), nil, &pr); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(pr.Labels))
+	for _, v := range pr.Labels {
+		labels = append(labels, v.Name)
+	}
+	var assigneeIDs []int
+	for _, v := range pr.Assignees {
+		assigneeIDs = append(assigneeIDs, v.ID)
+	}
+	var reviewerIDs []int
+	for _, v := range pr.RequestedReviewers {
+		reviewerIDs = append(reviewerIDs, v.ID)
+	}
+	state := pr.State
+	if pr.Merged {
+		state = "merged"
+	}
+	return &PullRequest{
+		ID:              pr.ID,
+		IID:             pr.Number,
+		TargetBranch:    pr.Base.Ref,
+		SourceBranch:    pr.Head.Ref,
+		ProjectID:       pr.Base.RepoID,
+		Title:           pr.Title,
+		State:           state,
+		CreatedAt:       pr.CreatedAt,
+		UpdatedAt:       pr.UpdatedAt,
+		SourceProjectID: pr.Head.RepoID,
+		TargetProjectID: pr.Base.RepoID,
+		Labels:          labels,
+		Description:     pr.Body,
+		WorkInProgress:  strings.HasPrefix(pr.Title, "WIP:") || strings.HasPrefix(pr.Title, "[WIP]"),
+		SHA:             pr.Head.SHA,
+		MergeCommitSHA:  pr.MergeCommitSHA,
+		AssigneeIDs:     assigneeIDs,
+		ReviewerIDs:     reviewerIDs,
+		AuthorID:        pr.User.ID,
+	}, nil
+}
+
+// labelIDs converts the label names to ids, the labels are referenced by id in the Gitea api.
+func (s *giteaClient) labelIDs(pid string, names []string) ([]int, error) {
+	labels, err := s.listLabels(pid)
+	if err != nil {
+		return nil, err
+	}
+	labelIDs := make([]int, 0, len(names))
+	for _, name := range names {
+		for _, v := range labels {
+			if v.Name == name {
+				labelIDs = append(labelIDs, v.ID)
+				break
+			}
+		}
+	}
+	return labelIDs, nil
+}
+
+func (s *giteaClient) UpdatePullRequest(pid string, prID int, data *UpdatePullRequest) error {
+	in := map[string]interface{}{}
+	if data.Labels != nil {
+		labelIDs, err := s.labelIDs(pid, data.Labels)
+		if err != nil {
+			return err
+		}
+		in["labels"] = labelIDs
+	}
+	if data.Title != "" {
+		in["title"] = data.Title
+	}
+	if data.Description != "" {
+		in["body"] = data.Description
+	}
+	if data.TargetBranch != "" {
+		in["base"] = data.TargetBranch
+	}
+
+	assigneeIDs := data.AssigneeIDs
+	if len(assigneeIDs) == 0 && data.AssigneeID > 0 {
+		assigneeIDs = []int{data.AssigneeID}
+	}
+	if len(assigneeIDs) > 0 {
+		assignees, err := s.usernames(pid, assigneeIDs)
+		if err != nil {
+			return err
+		}
+		in["assignees"] = assignees
+	}
+	if data.UnassignAll {
+		in["assignees"] = []string{}
+	}
+	logrus.Debugf("UpdatePullRequest options: %+v", in)
+	if len(in) > 0 {
+		if _, err := s.client.do(http.MethodPatch, fmt.Sprintf("/repos/%s/pulls/%d", pid, prID), in, nil); err != nil {
+			return err
+		}
+	}
+	if data.Labels == nil {
+		if err := s.patchLabels(pid, prID, data.AddLabels, data.RemoveLabels); err != nil {
+			return err
+		}
+	}
+	if data.ReviewerIDs != nil {
+		return s.updateReviewers(pid, prID, data.ReviewerIDs)
+	}
+	return nil
+}
+
+// patchLabels adds and removes the labels of the issue or pull request without replacing the others.
+func (s *giteaClient) patchLabels(pid string, number int, adds, removes []string) error {
+	if len(adds) == 0 && len(removes) == 0 {
+		return nil
+	}
+	uri := fmt.Sprintf("/repos/%s/issues/%d/labels", pid, number)
+	if len(adds) > 0 {
+		labelIDs, err := s.labelIDs(pid, adds)
+		if err != nil {
+			return err
+		}
+		if _, err := s.client.do(http.MethodPost, uri, map[string]interface{}{"labels": labelIDs}, nil); err != nil {
+			return err
+		}
+	}
+	if len(removes) == 0 {
+		return nil
+	}
+	labelIDs, err := s.labelIDs(pid, removes)
+	if err != nil {
+		return err
+	}
+	for _, id := range labelIDs {
+		if _, err := s.client.do(http.MethodDelete, fmt.Sprintf("%s/%d", uri, id), nil, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateReviewers requests the reviews of the users and removes the other requested reviewers.
+func (s *giteaClient) updateReviewers(pid string, prID int, ids []int) error {
+	var pr giteaPullRequest
+	uri := fmt.Sprintf("/repos/%s/pulls/%d", pid, prID)
+	if _, err := s.client.do(http.MethodGet, uri, nil, &pr); err != nil {
+		return err
+	}
+	var removes []string
+	current := make(map[int]struct{})
+	for _, v := range pr.RequestedReviewers {
+		current[v.ID] = struct{}{}
+		if !containsInt(ids, v.ID) {
+			removes = append(removes, v.Login)
+		}
+	}
+	var addIDs []int
+	for _, id := range ids {
+		if _, ok := current[id]; !ok {
+			addIDs = append(addIDs, id)
+		}
+	}
+
+	if len(removes) > 0 {
+		in := map[string][]string{"reviewers": removes}
+		if _, err := s.client.do(http.MethodDelete, uri+"/requested_reviewers", in, nil); err != nil {
+			return err
+		}
+	}
+	if len(addIDs) == 0 {
+		return nil
+	}
+	adds, err := s.usernames(pid, addIDs)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.do(http.MethodPost, uri+"/requested_reviewers", map[string][]string{"reviewers": adds}, nil)
+	return err
+}
+
+func (s *giteaClient) CreatePullRequestComment(pid string, prID int, comment string) error {
+	if comment == "" {
+		return nil
+	}
+	in := map[string]string{"body": comment}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", pid, prID), in, nil)
+	return err
+}
+
+func (s *giteaClient) ListPullRequestComments(pid string, prID int) ([]Comment, error) {
+	// the comments api of Gitea is not paginated, all the comments are returned
+	var comments []giteaComment
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/issues/%d/comments", pid, prID), nil, &comments); err != nil {
+		return nil, err
+	}
+	result := make([]Comment, 0, len(comments))
+	for _, v := range comments {
+		result = append(result, Comment{
+			ID:   v.ID,
+			Body: v.Body,
+			Author: User{
+				ID:       v.User.ID,
+				Username: v.User.Login,
+				Name:     v.User.FullName,
+				Email:    v.User.Email,
+			},
+			CreatedAt: v.CreatedAt,
+		})
+	}
+	return result, nil
+}
+
+func (s *giteaClient) MergePullRequest(pid string, prID int, data *MergePullRequest) error {
+	in := map[string]interface{}{
+		"Do":                        "merge",
+		"delete_branch_after_merge": data.ShouldRemoveSourceBranch,
+		"merge_when_checks_succeed": data.MergeWhenPipelineSucceeds,
+	}
+	if data.Squash && data.SquashCommitMessage != "" {
+		in["Do"] = "squash"
+		in["MergeTitleField"] = data.SquashCommitMessage
+	}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls/%d/merge", pid, prID), in, nil)
+	return err
+}
+
+func (s *giteaClient) RebasePullRequest(pid string, prID int) error {
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls/%d/update?style=rebase", pid, prID), nil, nil)
+	if e, ok := err.(*StatusError); ok && e.Response.StatusCode == http.StatusConflict {
+		return ErrRebaseConflict
+	}
+	return err
+}
+
+func (s *giteaClient) GetReviewConfig(pid, ref string) (*ReviewConfig, error) {
+	uri := fmt.Sprintf("/repos/%s/raw/%s?ref=%s", pid, ReviewConfigPath(TypeGitea), url.QueryEscape(ref))
+	data, _, err := s.client.raw(http.MethodGet, uri, nil, nil)
+	if isNotFound(err) {
+		return nil, ErrReviewConfigNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config ReviewConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, err
+}
+
+func (s *giteaClient) ListProjectMembers(pid string) ([]ProjectMember, error) {
+	var result []ProjectMember
+	var page int
+	for {
+		page++
+		var members []giteaUser
+		uri := fmt.Sprintf("/repos/%s/collaborators?limit=%d&page=%d", pid, giteaPageSize, page)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &members); err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			result = append(result, ProjectMember{
+				ID:        member.ID,
+				Username:  member.Login,
+				Email:     member.Email,
+				Name:      member.FullName,
+				AvatarURL: member.AvatarURL,
+			})
+		}
+		if len(members) < giteaPageSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *giteaClient) UpdateBuildStatus(pid, sha string, state BuildState) error {
+	var giteaState string
+	switch state {
+	case BuildStateSuccess:
+		giteaState = "success"
+	case BuildStateFailed:
+		giteaState = "failure"
+	case BuildStateCanceled:
+		giteaState = "error"
+	case BuildStateSkipped:
+		giteaState = "warning"
+	default:
+		giteaState = "pending"
+	}
+	in := map[string]string{
+		"state":       giteaState,
+		"context":     "Review Check",
+		"description": "desc",
+	}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", pid, sha), in, nil)
+	return err
+}
+
+func (s *giteaClient) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	if approved {
+		in := map[string]string{"event": "APPROVED"}
+		_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls/%d/reviews", pid, prID), in, nil)
+		return err
+	}
+
+	// dismiss all approved reviews submitted by the bot
+	login, err := s.currentLogin()
+	if err != nil {
+		return err
+	}
+	var reviews []giteaReview
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d/reviews", pid, prID), nil, &reviews); err != nil {
+		return err
+	}
+	for _, v := range reviews {
+		if v.State != "APPROVED" || v.Dismissed || v.User.Login != login {
+			continue
+		}
+		in := map[string]string{"message": "approval removed by review bot"}
+		uri := fmt.Sprintf("/repos/%s/pulls/%d/reviews/%d/dismissals", pid, prID, v.ID)
+		if _, err := s.client.do(http.MethodPost, uri, in, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *giteaClient) currentLogin() (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.login != "" {
+		return s.login, nil
+	}
+	var user giteaUser
+	if _, err := s.client.do(http.MethodGet, "/user", nil, &user); err != nil {
+		return "", err
+	}
+	s.login = user.Login
+	return s.login, nil
+}
+
+// usernames converts the user ids to login names, Gitea only accepts login names as assignees.
+// The ids which are not collaborators of the repository are rejected, otherwise they would be dropped silently.
+func (s *giteaClient) usernames(pid string, ids []int) ([]string, error) {
+	members, err := s.ListProjectMembers(pid)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		var name string
+		for _, member := range members {
+			if member.ID == id {
+				name = member.Username
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("user(%d) is not a collaborator of repo(%s)", id, pid)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *giteaClient) GetIssue(pid string, issueID int) (*Issue, error) {
+	var issue giteaIssue
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/issues/%d", pid, issueID), nil, &issue); err != nil {
+		return nil, err
+	}
+	result := &Issue{
+		ID:          issue.ID,
+		IID:         issue.Number,
+		Title:       issue.Title,
+		Description: issue.Body,
+		State:       issue.State,
+		AuthorID:    issue.User.ID,
+		Labels:      make([]string, 0, len(issue.Labels)),
+	}
+	for _, v := range issue.Labels {
+		result.Labels = append(result.Labels, v.Name)
+	}
+	for _, v := range issue.Assignees {
+		result.AssigneeIDs = append(result.AssigneeIDs, v.ID)
+	}
+	return result, nil
+}
+
+func (s *giteaClient) UpdateIssue(pid string, issueID int, data *UpdateIssue) error {
+	// labels of the issue are replaced by the separate api
+	uri := fmt.Sprintf("/repos/%s/issues/%d", pid, issueID)
+	if data.Labels != nil {
+		labelIDs, err := s.labelIDs(pid, data.Labels)
+		if err != nil {
+			return err
+		}
+		if _, err := s.client.do(http.MethodPut, uri+"/labels", map[string]interface{}{"labels": labelIDs}, nil); err != nil {
+			return err
+		}
+	} else if err := s.patchLabels(pid, issueID, data.AddLabels, data.RemoveLabels); err != nil {
+		return err
+	}
+
+	in := map[string]interface{}{}
+	if len(data.AssigneeIDs) > 0 {
+		assignees, err := s.usernames(pid, data.AssigneeIDs)
+		if err != nil {
+			return err
+		}
+		in["assignees"] = assignees
+	}
+	if data.UnassignAll {
+		in["assignees"] = []string{}
+	}
+	switch data.StateEvent {
+	case IssueStateEventClose:
+		in["state"] = "closed"
+	case IssueStateEventReopen:
+		in["state"] = "open"
+	}
+	if len(in) == 0 {
+		return nil
+	}
+	logrus.Debugf("UpdateIssue options: %+v", in)
+	_, err := s.client.do(http.MethodPatch, uri, in, nil)
+	return err
+}
+
+// CreateIssueComment shares the api with the pull request comment.
+func (s *giteaClient) CreateIssueComment(pid string, issueID int, comment string) error {
+	return s.CreatePullRequestComment(pid, issueID, comment)
+}
+
+// The pipelines of Gitea Actions are not supported yet, the pipeline apis return ErrNotSupported.
+
+func (s *giteaClient) ListPullRequestPipelines(_ string, _ int) ([]Pipeline, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *giteaClient) ListPipelineJobs(_ string, _ int) ([]Job, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *giteaClient) RetryPipeline(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *giteaClient) RetryJob(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *giteaClient) PlayJob(_ string, _ int) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,285 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+func newGiteaClient(t *testing.T, responses map[string]interface{}) (*apiServer, scm.Interface) {
+	server := newAPIServer(t, responses)
+	client, err := scm.NewGiteaClient(&scm.Config{
+		Type:  scm.TypeGitea,
+		Host:  server.URL,
+		Token: "token",
+	})
+	if err != nil {
+		t.Fatalf("NewGiteaClient() error = %v", err)
+	}
+	return server, client
+}
+
+var giteaCollaborators = []map[string]interface{}{
+	{"id": 1, "login": "author"},
+	{"id": 2, "login": "reviewer1"},
+	{"id": 3, "login": "approver1"},
+}
+
+func TestGiteaClient_UpdatePullRequest_Labels(t *testing.T) {
+	server, client := newGiteaClient(t, map[string]interface{}{
+		"GET /api/v1/repos/owner/repo/labels": []map[string]interface{}{
+			{"id": 1, "name": "lgtm"},
+			{"id": 2, "name": "approved"},
+			{"id": 3, "name": "kind/bugfix"},
+		},
+		"POST /api/v1/repos/owner/repo/issues/1/labels":     []interface{}{},
+		"DELETE /api/v1/repos/owner/repo/issues/1/labels/2": 204,
+		"PATCH /api/v1/repos/owner/repo/pulls/1":            map[string]interface{}{},
+	})
+
+	// the labels not carried are kept, the label not on the pull request is ignored
+	err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{
+		AddLabels:    []string{"lgtm"},
+		RemoveLabels: []string{"approved", "kind/bugfix"},
+	})
+	if err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	if got := server.Requests("PATCH /api/v1/repos/owner/repo/pulls/1"); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() patched the pull request without fields: %v", got)
+	}
+	adds := server.Requests("POST /api/v1/repos/owner/repo/issues/1/labels")
+	if want := map[string]interface{}{"labels": []interface{}{float64(1)}}; len(adds) != 1 || !reflect.DeepEqual(adds[0].Body, want) {
+		t.Errorf("UpdatePullRequest() add labels = %v, want %v", adds, want)
+	}
+	for _, key := range []string{
+		"DELETE /api/v1/repos/owner/repo/issues/1/labels/2",
+		"DELETE /api/v1/repos/owner/repo/issues/1/labels/3",
+	} {
+		if got := server.Requests(key); len(got) != 1 {
+			t.Errorf("UpdatePullRequest() requested %s %d times, want 1", key, len(got))
+		}
+	}
+
+	// the labels carried replace all
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{Labels: []string{"lgtm"}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	patches := server.Requests("PATCH /api/v1/repos/owner/repo/pulls/1")
+	if want := map[string]interface{}{"labels": []interface{}{float64(1)}}; len(patches) != 1 || !reflect.DeepEqual(patches[0].Body, want) {
+		t.Errorf("UpdatePullRequest() patch = %v, want %v", patches, want)
+	}
+}
+
+func TestGiteaClient_UpdatePullRequest_Assignees(t *testing.T) {
+	server, client := newGiteaClient(t, map[string]interface{}{
+		"GET /api/v1/repos/owner/repo/collaborators": giteaCollaborators,
+		"PATCH /api/v1/repos/owner/repo/pulls/1":     map[string]interface{}{},
+	})
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{AssigneeIDs: []int{2, 4}}); err == nil {
+		t.Errorf("UpdatePullRequest() with unknown assignee should fail")
+	}
+	if got := server.Requests("PATCH /api/v1/repos/owner/repo/pulls/1"); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() with unknown assignee patched the pull request: %v", got)
+	}
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{UnassignAll: true}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	patches := server.Requests("PATCH /api/v1/repos/owner/repo/pulls/1")
+	if want := map[string]interface{}{"assignees": []interface{}{}}; len(patches) != 1 || !reflect.DeepEqual(patches[0].Body, want) {
+		t.Errorf("UpdatePullRequest() patch = %v, want %v", patches, want)
+	}
+}
+
+func TestGiteaClient_UpdatePullRequest_Reviewers(t *testing.T) {
+	server, client := newGiteaClient(t, map[string]interface{}{
+		"GET /api/v1/repos/owner/repo/collaborators": giteaCollaborators,
+		"GET /api/v1/repos/owner/repo/pulls/1": map[string]interface{}{
+			"number":              1,
+			"requested_reviewers": []map[string]interface{}{{"id": 2, "login": "reviewer1"}},
+		},
+		"POST /api/v1/repos/owner/repo/pulls/1/requested_reviewers":   []interface{}{},
+		"DELETE /api/v1/repos/owner/repo/pulls/1/requested_reviewers": 204,
+	})
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{2, 3}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	if got := server.Requests("DELETE /api/v1/repos/owner/repo/pulls/1/requested_reviewers"); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() removed the kept reviewers: %v", got)
+	}
+	adds := server.Requests("POST /api/v1/repos/owner/repo/pulls/1/requested_reviewers")
+	if want := map[string]interface{}{"reviewers": []interface{}{"approver1"}}; len(adds) != 1 || !reflect.DeepEqual(adds[0].Body, want) {
+		t.Errorf("UpdatePullRequest() add reviewers = %v, want %v", adds, want)
+	}
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	removes := server.Requests("DELETE /api/v1/repos/owner/repo/pulls/1/requested_reviewers")
+	if want := map[string]interface{}{"reviewers": []interface{}{"reviewer1"}}; len(removes) != 1 || !reflect.DeepEqual(removes[0].Body, want) {
+		t.Errorf("UpdatePullRequest() remove reviewers = %v, want %v", removes, want)
+	}
+}
+
+func TestGiteaClient_MergePullRequest(t *testing.T) {
+	server, client := newGiteaClient(t, map[string]interface{}{
+		"POST /api/v1/repos/owner/repo/pulls/1/merge": 200,
+	})
+
+	err := client.MergePullRequest("owner/repo", 1, &scm.MergePullRequest{
+		Squash:                    true,
+		SquashCommitMessage:       "feat:title",
+		ShouldRemoveSourceBranch:  true,
+		MergeWhenPipelineSucceeds: true,
+	})
+	if err != nil {
+		t.Fatalf("MergePullRequest() error = %v", err)
+	}
+	merges := server.Requests("POST /api/v1/repos/owner/repo/pulls/1/merge")
+	want := map[string]interface{}{
+		"Do":                        "squash",
+		"MergeTitleField":           "feat:title",
+		"delete_branch_after_merge": true,
+		"merge_when_checks_succeed": true,
+	}
+	if len(merges) != 1 || !reflect.DeepEqual(merges[0].Body, want) {
+		t.Errorf("MergePullRequest() body = %v, want %v", merges, want)
+	}
+}
+
+func TestGiteaClient_RebasePullRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr error
+	}{
+		{name: "rebase", status: 200},
+		{name: "conflict", status: 409, wantErr: scm.ErrRebaseConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newGiteaClient(t, map[string]interface{}{
+				"POST /api/v1/repos/owner/repo/pulls/1/update": tt.status,
+			})
+			if err := client.RebasePullRequest("owner/repo", 1); err != tt.wantErr {
+				t.Errorf("RebasePullRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			requests := server.Requests("POST /api/v1/repos/owner/repo/pulls/1/update")
+			if len(requests) != 1 || requests[0].Query.Get("style") != "rebase" {
+				t.Errorf("RebasePullRequest() requests = %v, want style rebase", requests)
+			}
+		})
+	}
+}
+
+func TestParseWebhook_Gitea(t *testing.T) {
+	repo := scm.Repository{ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main"}
+	tests := []struct {
+		name  string
+		event string
+		file  string
+		want  interface{}
+	}{
+		{
+			name:  "pull request",
+			event: "pull_request",
+			file:  "gitea_pull_request.json",
+			want: &scm.PullRequestEvent{
+				Action:        scm.EventActionUpdate,
+				Actor:         scm.User{ID: 2, Username: "reviewer1"},
+				Repository:    scm.Repository{ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main", WebURL: "https://gitea.example.com/owner/repo"},
+				Number:        1,
+				Title:         "Add the feature",
+				Description:   "/kind feature",
+				SourceBranch:  "feature",
+				TargetBranch:  "main",
+				AuthorID:      1,
+				Labels:        []string{"lgtm"},
+				AssigneeIDs:   []int{2},
+				LastCommitSHA: "0123456789abcdef",
+			},
+		},
+		{
+			name:  "approved",
+			event: "pull_request_approved",
+			file:  "gitea_pull_request_approved.json",
+			want: &scm.PullRequestEvent{
+				Action:        scm.EventActionApproved,
+				Actor:         scm.User{ID: 3, Username: "approver1"},
+				Repository:    repo,
+				Number:        1,
+				Title:         "Add the feature",
+				SourceBranch:  "feature",
+				TargetBranch:  "main",
+				AuthorID:      1,
+				LastCommitSHA: "0123456789abcdef",
+			},
+		},
+		{
+			name:  "pull request comment",
+			event: "issue_comment",
+			file:  "gitea_issue_comment.json",
+			want: &scm.CommentEvent{
+				Actor:       scm.User{ID: 3, Username: "approver1"},
+				Repository:  repo,
+				Number:      1,
+				Note:        "/approve",
+				AssigneeIDs: []int{2},
+			},
+		},
+		{
+			name:  "issue comment",
+			event: "issue_comment",
+			file:  "gitea_issue_comment_issue.json",
+			want: &scm.IssueCommentEvent{
+				Actor:      scm.User{ID: 1, Username: "author"},
+				Repository: repo,
+				Number:     2,
+				Note:       "/kind bug",
+			},
+		},
+		{
+			name:  "push",
+			event: "push",
+			file:  "gitea_push.json",
+			want: &scm.PushEvent{
+				Actor:      scm.User{ID: 1, Username: "author"},
+				Repository: repo,
+				Branch:     "main",
+				Before:     "fedcba9876543210",
+				After:      "0123456789abcdef",
+				Files:      []string{".gitea/review.yml"},
+				Truncated:  true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, payload := webhookRequest(t, tt.file, map[string]string{"X-Gitea-Event": tt.event})
+			got, err := scm.ParseWebhook(scm.TypeGitea, r, payload)
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWebhook() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
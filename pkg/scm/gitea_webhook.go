@@ -0,0 +1,177 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type giteaPullRequestEvent struct {
+	Action      string           `json:"action"`
+	PullRequest giteaPullRequest `json:"pull_request"`
+	Repository  githubRepository `json:"repository"`
+	Sender      giteaUser        `json:"sender"`
+}
+
+type giteaIssueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number    int         `json:"number"`
+		Assignees []giteaUser `json:"assignees"`
+	} `json:"issue"`
+	Comment struct {
+		ID   int       `json:"id"`
+		Body string    `json:"body"`
+		User giteaUser `json:"user"`
+	} `json:"comment"`
+	IsPull     bool             `json:"is_pull"`
+	Repository githubRepository `json:"repository"`
+	Sender     giteaUser        `json:"sender"`
+}
+
+type giteaPushEvent struct {
+	Ref          string           `json:"ref"`
+	Before       string           `json:"before"`
+	After        string           `json:"after"`
+	TotalCommits int              `json:"total_commits"`
+	Commits      []githubCommit   `json:"commits"`
+	Repository   githubRepository `json:"repository"`
+	Sender       giteaUser        `json:"sender"`
+}
+
+// parseGiteaWebhook parses the webhook of Gitea and Forgejo.
+func parseGiteaWebhook(r *http.Request, payload []byte) (interface{}, error) {
+	eventType := r.Header.Get("X-Gitea-Event")
+	switch eventType {
+	case "pull_request", "pull_request_approved", "pull_request_rejected":
+		var e giteaPullRequestEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		return convertGiteaPullRequestEvent(eventType, &e), nil
+	case "issue_comment":
+		var e giteaIssueCommentEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		if e.Action != "created" {
+			return nil, nil
+		}
+		if !e.IsPull {
+			return &IssueCommentEvent{
+				Actor:      convertGiteaUser(&e.Comment.User),
+				Repository: e.Repository.convert(),
+				Number:     e.Issue.Number,
+				Note:       e.Comment.Body,
+			}, nil
+		}
+		return convertGiteaCommentEvent(&e), nil
+	case "push":
+		var e giteaPushEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		// tags are not concerned
+		if !strings.HasPrefix(e.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		return convertGiteaPushEvent(&e), nil
+	}
+	return nil, nil
+}
+
+func convertGiteaPushEvent(e *giteaPushEvent) *PushEvent {
+	result := &PushEvent{
+		Actor:      convertGiteaUser(&e.Sender),
+		Repository: e.Repository.convert(),
+		Branch:     strings.TrimPrefix(e.Ref, "refs/heads/"),
+		Before:     e.Before,
+		After:      e.After,
+		Truncated:  e.TotalCommits > len(e.Commits),
+	}
+	for _, v := range e.Commits {
+		result.appendFiles(v.Added, v.Modified, v.Removed)
+	}
+	return result
+}
+
+func convertGiteaUser(user *giteaUser) User {
+	return User{
+		ID:       user.ID,
+		Username: user.Login,
+		Name:     user.FullName,
+		Email:    user.Email,
+	}
+}
+
+func convertGiteaPullRequestEvent(eventType string, e *giteaPullRequestEvent) *PullRequestEvent {
+	pr := &e.PullRequest
+	result := &PullRequestEvent{
+		Actor:         convertGiteaUser(&e.Sender),
+		Repository:    e.Repository.convert(),
+		Number:        pr.Number,
+		Title:         pr.Title,
+		Description:   pr.Body,
+		SourceBranch:  pr.Head.Ref,
+		TargetBranch:  pr.Base.Ref,
+		AuthorID:      pr.User.ID,
+		LastCommitSHA: pr.Head.SHA,
+	}
+
+	switch eventType {
+	case "pull_request_approved":
+		result.Action = EventActionApproved
+	case "pull_request_rejected":
+		// requesting changes is not concerned
+	default:
+		switch e.Action {
+		case "opened":
+			result.Action = EventActionOpen
+		case "reopened":
+			result.Action = EventActionReopen
+		case "closed":
+			result.Action = EventActionClose
+			if pr.Merged {
+				result.Action = EventActionMerge
+			}
+		case "synchronized", "edited", "label_updated", "label_cleared", "assigned", "unassigned":
+			result.Action = EventActionUpdate
+			result.NewCommits = e.Action == "synchronized"
+		}
+	}
+
+	for _, v := range pr.Labels {
+		result.Labels = append(result.Labels, v.Name)
+	}
+	for _, v := range pr.Assignees {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v.ID)
+	}
+	return result
+}
+
+func convertGiteaCommentEvent(e *giteaIssueCommentEvent) *CommentEvent {
+	result := &CommentEvent{
+		Actor:      convertGiteaUser(&e.Comment.User),
+		Repository: e.Repository.convert(),
+		Number:     e.Issue.Number,
+		Note:       e.Comment.Body,
+	}
+	for _, v := range e.Issue.Assignees {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v.ID)
+	}
+	return result
+}
@@ -0,0 +1,594 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const githubAPI = "https://api.github.com"
+
+type githubClient struct {
+	config *Config
+	client *restClient
+
+	mux   sync.Mutex
+	login string
+}
+
+func NewGithubClient(cfg *Config) (Interface, error) {
+	host := strings.TrimSuffix(cfg.Host, "/")
+	if host == "" || host == "https://github.com" {
+		host = githubAPI
+	}
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github.v3+json")
+	header.Set("Authorization", "token "+cfg.Token)
+	return &githubClient{
+		config: cfg,
+		client: newRestClient(host, header),
+	}, nil
+}
+
+type githubUser struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type githubLabel struct {
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	Description string `json:"description"`
+}
+
+type githubPullRequest struct {
+	ID        int           `json:"id"`
+	Number    int           `json:"number"`
+	Title     string        `json:"title"`
+	Body      string        `json:"body"`
+	State     string        `json:"state"`
+	Draft     bool          `json:"draft"`
+	Merged    bool          `json:"merged"`
+	User      githubUser    `json:"user"`
+	Labels    []githubLabel `json:"labels"`
+	Assignees []githubUser  `json:"assignees"`
+	CreatedAt *time.Time    `json:"created_at"`
+	UpdatedAt *time.Time    `json:"updated_at"`
+	Head      githubRef     `json:"head"`
+	Base      githubRef     `json:"base"`
+
+	MergeCommitSHA     string       `json:"merge_commit_sha"`
+	RequestedReviewers []githubUser `json:"requested_reviewers"`
+}
+
+type githubRef struct {
+	Ref  string `json:"ref"`
+	SHA  string `json:"sha"`
+	Repo struct {
+		ID            int    `json:"id"`
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repo"`
+}
+
+type githubIssue struct {
+	ID        int           `json:"id"`
+	Number    int           `json:"number"`
+	Title     string        `json:"title"`
+	Body      string        `json:"body"`
+	State     string        `json:"state"`
+	User      githubUser    `json:"user"`
+	Labels    []githubLabel `json:"labels"`
+	Assignees []githubUser  `json:"assignees"`
+}
+
+type githubComment struct {
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	User      githubUser `json:"user"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+type githubReview struct {
+	ID    int        `json:"id"`
+	State string     `json:"state"`
+	User  githubUser `json:"user"`
+}
+
+func (s *githubClient) ListLabels(pid string) ([]Label, error) {
+	var result []Label
+	var page int
+	for {
+		page++
+		var labels []githubLabel
+		uri := fmt.Sprintf("/repos/%s/labels?per_page=100&page=%d", pid, page)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &labels); err != nil {
+			return nil, err
+		}
+		for _, v := range labels {
+			result = append(result, Label{
+				Name:        v.Name,
+				Color:       "#" + v.Color,
+				Description: v.Description,
+			})
+		}
+		if len(labels) < 100 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *githubClient) CreateLabel(pid string, label *Label) error {
+	in := &githubLabel{
+		Name:        label.Name,
+		Color:       strings.TrimPrefix(label.Color, "#"),
+		Description: label.Description,
+	}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/labels", pid), in, nil)
+	return err
+}
+
+func (s *githubClient) GetPullRequest(pid string, prID int) (*PullRequest, error) {
+	var pr githubPullRequest
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d", pid, prID), nil, &pr); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(pr.Labels))
+	for _, v := range pr.Labels {
+		labels = append(labels, v.Name)
+	}
+	var assigneeIDs []int
+	for _, v := range pr.Assignees {
+		assigneeIDs = append(assigneeIDs, v.ID)
+	}
+	var reviewerIDs []int
+	for _, v := range pr.RequestedReviewers {
+		reviewerIDs = append(reviewerIDs, v.ID)
+	}
+	state := pr.State
+	if pr.Merged {
+		state = "merged"
+	}
+	return &PullRequest{
+		ID:              pr.ID,
+		IID:             pr.Number,
+		TargetBranch:    pr.Base.Ref,
+		SourceBranch:    pr.Head.Ref,
+		ProjectID:       pr.Base.Repo.ID,
+		Title:           pr.Title,
+		State:           state,
+		CreatedAt:       pr.CreatedAt,
+		UpdatedAt:       pr.UpdatedAt,
+		SourceProjectID: pr.Head.Repo.ID,
+		TargetProjectID: pr.Base.Repo.ID,
+		Labels:          labels,
+		Description:     pr.Body,
+		WorkInProgress:  pr.Draft,
+		SHA:             pr.Head.SHA,
+		MergeCommitSHA:  pr.MergeCommitSHA,
+		AssigneeIDs:     assigneeIDs,
+		ReviewerIDs:     reviewerIDs,
+		AuthorID:        pr.User.ID,
+	}, nil
+}
+
+func (s *githubClient) UpdatePullRequest(pid string, prID int, data *UpdatePullRequest) error {
+	// labels and assignees of the pull request are managed by the issues api
+	in := map[string]interface{}{}
+	if data.Labels != nil {
+		in["labels"] = data.Labels
+	}
+	if data.Title != "" {
+		in["title"] = data.Title
+	}
+	if data.Description != "" {
+		in["body"] = data.Description
+	}
+
+	assigneeIDs := data.AssigneeIDs
+	if len(assigneeIDs) == 0 && data.AssigneeID > 0 {
+		assigneeIDs = []int{data.AssigneeID}
+	}
+	if len(assigneeIDs) > 0 {
+		assignees, err := s.usernames(pid, assigneeIDs)
+		if err != nil {
+			return err
+		}
+		in["assignees"] = assignees
+	}
+	if data.UnassignAll {
+		in["assignees"] = []string{}
+	}
+	logrus.Debugf("UpdatePullRequest options: %+v", in)
+	if len(in) > 0 {
+		if _, err := s.client.do(http.MethodPatch, fmt.Sprintf("/repos/%s/issues/%d", pid, prID), in, nil); err != nil {
+			return err
+		}
+	}
+	if data.Labels == nil {
+		if err := s.patchLabels(pid, prID, data.AddLabels, data.RemoveLabels); err != nil {
+			return err
+		}
+	}
+	if data.ReviewerIDs != nil {
+		if err := s.updateReviewers(pid, prID, data.ReviewerIDs); err != nil {
+			return err
+		}
+	}
+
+	if data.TargetBranch != "" {
+		in := map[string]string{"base": data.TargetBranch}
+		_, err := s.client.do(http.MethodPatch, fmt.Sprintf("/repos/%s/pulls/%d", pid, prID), in, nil)
+		return err
+	}
+	return nil
+}
+
+// updateReviewers requests the reviews of the users and removes the other requested reviewers.
+func (s *githubClient) updateReviewers(pid string, prID int, ids []int) error {
+	var pr githubPullRequest
+	uri := fmt.Sprintf("/repos/%s/pulls/%d", pid, prID)
+	if _, err := s.client.do(http.MethodGet, uri, nil, &pr); err != nil {
+		return err
+	}
+	var removes []string
+	current := make(map[int]struct{})
+	for _, v := range pr.RequestedReviewers {
+		current[v.ID] = struct{}{}
+		if !containsInt(ids, v.ID) {
+			removes = append(removes, v.Login)
+		}
+	}
+	var addIDs []int
+	for _, id := range ids {
+		if _, ok := current[id]; !ok {
+			addIDs = append(addIDs, id)
+		}
+	}
+
+	if len(removes) > 0 {
+		in := map[string][]string{"reviewers": removes}
+		if _, err := s.client.do(http.MethodDelete, uri+"/requested_reviewers", in, nil); err != nil {
+			return err
+		}
+	}
+	if len(addIDs) == 0 {
+		return nil
+	}
+	adds, err := s.usernames(pid, addIDs)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.do(http.MethodPost, uri+"/requested_reviewers", map[string][]string{"reviewers": adds}, nil)
+	return err
+}
+
+func (s *githubClient) CreatePullRequestComment(pid string, prID int, comment string) error {
+	if comment == "" {
+		return nil
+	}
+	in := map[string]string{"body": comment}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", pid, prID), in, nil)
+	return err
+}
+
+func (s *githubClient) ListPullRequestComments(pid string, prID int) ([]Comment, error) {
+	var result []Comment
+	var page int
+	for {
+		page++
+		var comments []githubComment
+		uri := fmt.Sprintf("/repos/%s/issues/%d/comments?per_page=100&page=%d", pid, prID, page)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &comments); err != nil {
+			return nil, err
+		}
+		for _, v := range comments {
+			result = append(result, Comment{
+				ID:   v.ID,
+				Body: v.Body,
+				Author: User{
+					ID:       v.User.ID,
+					Username: v.User.Login,
+					Name:     v.User.Name,
+					Email:    v.User.Email,
+				},
+				CreatedAt: v.CreatedAt,
+			})
+		}
+		if len(comments) < 100 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *githubClient) MergePullRequest(pid string, prID int, data *MergePullRequest) error {
+	// GitHub has no equivalent of `merge when pipeline succeeds` in the rest api,
+	// the merge will be rejected by the branch protection if the required checks are not passed.
+	in := map[string]string{"merge_method": "merge"}
+	if data.Squash && data.SquashCommitMessage != "" {
+		in["merge_method"] = "squash"
+		in["commit_title"] = data.SquashCommitMessage
+	}
+	if _, err := s.client.do(http.MethodPut, fmt.Sprintf("/repos/%s/pulls/%d/merge", pid, prID), in, nil); err != nil {
+		return err
+	}
+	if !data.ShouldRemoveSourceBranch {
+		return nil
+	}
+
+	var pr githubPullRequest
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d", pid, prID), nil, &pr); err != nil {
+		return err
+	}
+	// only remove the source branch in the same repository
+	if pr.Head.Repo.FullName != pid || pr.Head.Ref == pr.Head.Repo.DefaultBranch {
+		return nil
+	}
+	uri := fmt.Sprintf("/repos/%s/git/refs/heads/%s", pid, url.PathEscape(pr.Head.Ref))
+	if _, err := s.client.do(http.MethodDelete, uri, nil, nil); err != nil {
+		logrus.Warningf("Remove source branch(%s) failed: %v", pr.Head.Ref, err)
+	}
+	return nil
+}
+
+// RebasePullRequest is not supported, GitHub only updates the branch by merging the base branch.
+func (s *githubClient) RebasePullRequest(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *githubClient) GetReviewConfig(pid, ref string) (*ReviewConfig, error) {
+	uri := fmt.Sprintf("/repos/%s/contents/%s?ref=%s", pid, ReviewConfigPath(TypeGithub), url.QueryEscape(ref))
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github.v3.raw")
+	data, _, err := s.client.raw(http.MethodGet, uri, nil, header)
+	if isNotFound(err) {
+		return nil, ErrReviewConfigNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config ReviewConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, err
+}
+
+func (s *githubClient) ListProjectMembers(pid string) ([]ProjectMember, error) {
+	var result []ProjectMember
+	var page int
+	for {
+		page++
+		var members []githubUser
+		uri := fmt.Sprintf("/repos/%s/collaborators?per_page=100&page=%d", pid, page)
+		if _, err := s.client.do(http.MethodGet, uri, nil, &members); err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			result = append(result, ProjectMember{
+				ID:        member.ID,
+				Username:  member.Login,
+				Email:     member.Email,
+				Name:      member.Name,
+				AvatarURL: member.AvatarURL,
+			})
+		}
+		if len(members) < 100 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *githubClient) UpdateBuildStatus(pid, sha string, state BuildState) error {
+	var ghState string
+	switch state {
+	case BuildStateSuccess:
+		ghState = "success"
+	case BuildStateFailed:
+		ghState = "failure"
+	case BuildStateCanceled, BuildStateSkipped:
+		ghState = "error"
+	default:
+		ghState = "pending"
+	}
+	in := map[string]string{
+		"state":       ghState,
+		"context":     "Review Check",
+		"description": "desc",
+	}
+	_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", pid, sha), in, nil)
+	return err
+}
+
+func (s *githubClient) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	if approved {
+		in := map[string]string{"event": "APPROVE"}
+		_, err := s.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls/%d/reviews", pid, prID), in, nil)
+		return err
+	}
+
+	// dismiss all approved reviews submitted by the bot
+	login, err := s.currentLogin()
+	if err != nil {
+		return err
+	}
+	var reviews []githubReview
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d/reviews?per_page=100", pid, prID), nil, &reviews); err != nil {
+		return err
+	}
+	for _, v := range reviews {
+		if v.State != "APPROVED" || v.User.Login != login {
+			continue
+		}
+		in := map[string]string{"message": "approval removed by review bot"}
+		uri := fmt.Sprintf("/repos/%s/pulls/%d/reviews/%d/dismissals", pid, prID, v.ID)
+		if _, err := s.client.do(http.MethodPut, uri, in, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *githubClient) currentLogin() (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.login != "" {
+		return s.login, nil
+	}
+	var user githubUser
+	if _, err := s.client.do(http.MethodGet, "/user", nil, &user); err != nil {
+		return "", err
+	}
+	s.login = user.Login
+	return s.login, nil
+}
+
+// usernames converts the user ids to login names, GitHub only accepts login names as assignees.
+// The ids which are not collaborators of the repository are rejected, otherwise they would be dropped silently.
+func (s *githubClient) usernames(pid string, ids []int) ([]string, error) {
+	members, err := s.ListProjectMembers(pid)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		var name string
+		for _, member := range members {
+			if member.ID == id {
+				name = member.Username
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("user(%d) is not a collaborator of repo(%s)", id, pid)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *githubClient) GetIssue(pid string, issueID int) (*Issue, error) {
+	var issue githubIssue
+	if _, err := s.client.do(http.MethodGet, fmt.Sprintf("/repos/%s/issues/%d", pid, issueID), nil, &issue); err != nil {
+		return nil, err
+	}
+	result := &Issue{
+		ID:          issue.ID,
+		IID:         issue.Number,
+		Title:       issue.Title,
+		Description: issue.Body,
+		State:       issue.State,
+		AuthorID:    issue.User.ID,
+		Labels:      make([]string, 0, len(issue.Labels)),
+	}
+	for _, v := range issue.Labels {
+		result.Labels = append(result.Labels, v.Name)
+	}
+	for _, v := range issue.Assignees {
+		result.AssigneeIDs = append(result.AssigneeIDs, v.ID)
+	}
+	return result, nil
+}
+
+func (s *githubClient) UpdateIssue(pid string, issueID int, data *UpdateIssue) error {
+	in := map[string]interface{}{}
+	if data.Labels != nil {
+		in["labels"] = data.Labels
+	}
+	if len(data.AssigneeIDs) > 0 {
+		assignees, err := s.usernames(pid, data.AssigneeIDs)
+		if err != nil {
+			return err
+		}
+		in["assignees"] = assignees
+	}
+	if data.UnassignAll {
+		in["assignees"] = []string{}
+	}
+	switch data.StateEvent {
+	case IssueStateEventClose:
+		in["state"] = "closed"
+	case IssueStateEventReopen:
+		in["state"] = "open"
+	}
+	logrus.Debugf("UpdateIssue options: %+v", in)
+	if len(in) > 0 {
+		if _, err := s.client.do(http.MethodPatch, fmt.Sprintf("/repos/%s/issues/%d", pid, issueID), in, nil); err != nil {
+			return err
+		}
+	}
+	if data.Labels == nil {
+		return s.patchLabels(pid, issueID, data.AddLabels, data.RemoveLabels)
+	}
+	return nil
+}
+
+// patchLabels adds and removes the labels of the issue or pull request without replacing the others.
+func (s *githubClient) patchLabels(pid string, number int, adds, removes []string) error {
+	uri := fmt.Sprintf("/repos/%s/issues/%d/labels", pid, number)
+	if len(adds) > 0 {
+		if _, err := s.client.do(http.MethodPost, uri, map[string][]string{"labels": adds}, nil); err != nil {
+			return err
+		}
+	}
+	for _, name := range removes {
+		// the label not on the issue responds 404
+		if _, err := s.client.do(http.MethodDelete, uri+"/"+url.PathEscape(name), nil, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateIssueComment shares the api with the pull request comment.
+func (s *githubClient) CreateIssueComment(pid string, issueID int, comment string) error {
+	return s.CreatePullRequestComment(pid, issueID, comment)
+}
+
+// The pipelines of GitHub Actions are not supported yet, the pipeline apis return ErrNotSupported.
+
+func (s *githubClient) ListPullRequestPipelines(_ string, _ int) ([]Pipeline, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *githubClient) ListPipelineJobs(_ string, _ int) ([]Job, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *githubClient) RetryPipeline(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *githubClient) RetryJob(_ string, _ int) error {
+	return ErrNotSupported
+}
+
+func (s *githubClient) PlayJob(_ string, _ int) error {
+	return ErrNotSupported
+}
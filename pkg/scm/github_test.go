@@ -0,0 +1,262 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+)
+
+func newGithubClient(t *testing.T, responses map[string]interface{}) (*apiServer, scm.Interface) {
+	server := newAPIServer(t, responses)
+	client, err := scm.NewGithubClient(&scm.Config{
+		Type:  scm.TypeGithub,
+		Host:  server.URL,
+		Token: "token",
+	})
+	if err != nil {
+		t.Fatalf("NewGithubClient() error = %v", err)
+	}
+	return server, client
+}
+
+var githubCollaborators = []map[string]interface{}{
+	{"id": 1, "login": "author"},
+	{"id": 2, "login": "reviewer1"},
+	{"id": 3, "login": "approver1"},
+}
+
+func TestGithubClient_UpdatePullRequest_Labels(t *testing.T) {
+	server, client := newGithubClient(t, map[string]interface{}{
+		"POST /repos/owner/repo/issues/1/labels":            []interface{}{},
+		"DELETE /repos/owner/repo/issues/1/labels/approved": []interface{}{},
+		"PATCH /repos/owner/repo/issues/1":                  map[string]interface{}{},
+	})
+
+	// the labels not carried are kept, the label not on the pull request is ignored
+	err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{
+		AddLabels:    []string{"lgtm"},
+		RemoveLabels: []string{"approved", "kind/bugfix"},
+	})
+	if err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	if got := server.Requests("PATCH /repos/owner/repo/issues/1"); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() patched the issue without fields: %v", got)
+	}
+	adds := server.Requests("POST /repos/owner/repo/issues/1/labels")
+	if want := map[string]interface{}{"labels": []interface{}{"lgtm"}}; len(adds) != 1 || !reflect.DeepEqual(adds[0].Body, want) {
+		t.Errorf("UpdatePullRequest() add labels = %v, want %v", adds, want)
+	}
+	if got := server.Requests("DELETE /repos/owner/repo/issues/1/labels/approved"); len(got) != 1 {
+		t.Errorf("UpdatePullRequest() removed approved %d times, want 1", len(got))
+	}
+	if got := server.Requests("DELETE /repos/owner/repo/issues/1/labels/kind%2Fbugfix"); len(got) != 1 {
+		t.Errorf("UpdatePullRequest() removed kind/bugfix %d times, want 1", len(got))
+	}
+
+	// the labels carried replace all
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{Labels: []string{"lgtm"}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	patches := server.Requests("PATCH /repos/owner/repo/issues/1")
+	if want := map[string]interface{}{"labels": []interface{}{"lgtm"}}; len(patches) != 1 || !reflect.DeepEqual(patches[0].Body, want) {
+		t.Errorf("UpdatePullRequest() patch = %v, want %v", patches, want)
+	}
+	if got := server.Requests("POST /repos/owner/repo/issues/1/labels"); len(got) != 1 {
+		t.Errorf("UpdatePullRequest() with labels should not add labels one by one")
+	}
+}
+
+func TestGithubClient_UpdatePullRequest_Assignees(t *testing.T) {
+	server, client := newGithubClient(t, map[string]interface{}{
+		"GET /repos/owner/repo/collaborators": githubCollaborators,
+		"PATCH /repos/owner/repo/issues/1":    map[string]interface{}{},
+	})
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{AssigneeIDs: []int{2, 4}}); err == nil {
+		t.Errorf("UpdatePullRequest() with unknown assignee should fail")
+	}
+	if got := server.Requests("PATCH /repos/owner/repo/issues/1"); len(got) != 0 {
+		t.Errorf("UpdatePullRequest() with unknown assignee patched the issue: %v", got)
+	}
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{AssigneeIDs: []int{2, 3}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	patches := server.Requests("PATCH /repos/owner/repo/issues/1")
+	want := map[string]interface{}{"assignees": []interface{}{"reviewer1", "approver1"}}
+	if len(patches) != 1 || !reflect.DeepEqual(patches[0].Body, want) {
+		t.Errorf("UpdatePullRequest() patch = %v, want %v", patches, want)
+	}
+}
+
+func TestGithubClient_UpdatePullRequest_Reviewers(t *testing.T) {
+	server, client := newGithubClient(t, map[string]interface{}{
+		"GET /repos/owner/repo/collaborators": githubCollaborators,
+		"GET /repos/owner/repo/pulls/1": map[string]interface{}{
+			"number":              1,
+			"requested_reviewers": []map[string]interface{}{{"id": 2, "login": "reviewer1"}},
+		},
+		"POST /repos/owner/repo/pulls/1/requested_reviewers":   map[string]interface{}{},
+		"DELETE /repos/owner/repo/pulls/1/requested_reviewers": map[string]interface{}{},
+	})
+
+	if err := client.UpdatePullRequest("owner/repo", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{3}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	removes := server.Requests("DELETE /repos/owner/repo/pulls/1/requested_reviewers")
+	if want := map[string]interface{}{"reviewers": []interface{}{"reviewer1"}}; len(removes) != 1 || !reflect.DeepEqual(removes[0].Body, want) {
+		t.Errorf("UpdatePullRequest() remove reviewers = %v, want %v", removes, want)
+	}
+	adds := server.Requests("POST /repos/owner/repo/pulls/1/requested_reviewers")
+	if want := map[string]interface{}{"reviewers": []interface{}{"approver1"}}; len(adds) != 1 || !reflect.DeepEqual(adds[0].Body, want) {
+		t.Errorf("UpdatePullRequest() add reviewers = %v, want %v", adds, want)
+	}
+}
+
+func TestGithubClient_MergePullRequest(t *testing.T) {
+	server, client := newGithubClient(t, map[string]interface{}{
+		"PUT /repos/owner/repo/pulls/1/merge": map[string]interface{}{"merged": true},
+		"GET /repos/owner/repo/pulls/1": map[string]interface{}{
+			"number": 1,
+			"head": map[string]interface{}{
+				"ref":  "feature",
+				"repo": map[string]interface{}{"full_name": "owner/repo", "default_branch": "main"},
+			},
+		},
+		"DELETE /repos/owner/repo/git/refs/heads/feature": 204,
+	})
+
+	err := client.MergePullRequest("owner/repo", 1, &scm.MergePullRequest{
+		Squash:                   true,
+		SquashCommitMessage:      "feat:title",
+		ShouldRemoveSourceBranch: true,
+	})
+	if err != nil {
+		t.Fatalf("MergePullRequest() error = %v", err)
+	}
+	merges := server.Requests("PUT /repos/owner/repo/pulls/1/merge")
+	want := map[string]interface{}{"merge_method": "squash", "commit_title": "feat:title"}
+	if len(merges) != 1 || !reflect.DeepEqual(merges[0].Body, want) {
+		t.Errorf("MergePullRequest() body = %v, want %v", merges, want)
+	}
+	if got := server.Requests("DELETE /repos/owner/repo/git/refs/heads/feature"); len(got) != 1 {
+		t.Errorf("MergePullRequest() removed the source branch %d times, want 1", len(got))
+	}
+}
+
+func TestGithubClient_RebasePullRequest(t *testing.T) {
+	_, client := newGithubClient(t, nil)
+	if err := client.RebasePullRequest("owner/repo", 1); err != scm.ErrNotSupported {
+		t.Errorf("RebasePullRequest() error = %v, want %v", err, scm.ErrNotSupported)
+	}
+}
+
+func TestParseWebhook_Github(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		file  string
+		want  interface{}
+	}{
+		{
+			name:  "pull request",
+			event: "pull_request",
+			file:  "github_pull_request.json",
+			want: &scm.PullRequestEvent{
+				Action: scm.EventActionUpdate,
+				Actor:  scm.User{ID: 1, Username: "author"},
+				Repository: scm.Repository{
+					ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main",
+					WebURL: "https://github.com/owner/repo",
+				},
+				Number:        1,
+				Title:         "Add the feature",
+				Description:   "/kind feature",
+				SourceBranch:  "feature",
+				TargetBranch:  "main",
+				AuthorID:      1,
+				Labels:        []string{"lgtm", "kind/feature"},
+				AssigneeIDs:   []int{2},
+				LastCommitSHA: "0123456789abcdef",
+				NewCommits:    true,
+			},
+		},
+		{
+			name:  "review approved",
+			event: "pull_request_review",
+			file:  "github_pull_request_review.json",
+			want: &scm.PullRequestEvent{
+				Action:        scm.EventActionApproved,
+				Actor:         scm.User{ID: 3, Username: "approver1"},
+				Repository:    scm.Repository{ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main"},
+				Number:        1,
+				Title:         "Add the feature",
+				SourceBranch:  "feature",
+				TargetBranch:  "main",
+				AuthorID:      1,
+				LastCommitSHA: "0123456789abcdef",
+			},
+		},
+		{
+			name:  "comment",
+			event: "issue_comment",
+			file:  "github_issue_comment.json",
+			want: &scm.CommentEvent{
+				Actor:       scm.User{ID: 2, Username: "reviewer1"},
+				Repository:  scm.Repository{ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main"},
+				Number:      1,
+				Note:        "/lgtm",
+				AssigneeIDs: []int{2},
+			},
+		},
+		{
+			name:  "push",
+			event: "push",
+			file:  "github_push.json",
+			want: &scm.PushEvent{
+				Actor:      scm.User{ID: 1, Username: "author"},
+				Repository: scm.Repository{ID: 10, FullName: "owner/repo", Name: "repo", DefaultBranch: "main"},
+				Branch:     "main",
+				Before:     "fedcba9876543210",
+				After:      "0123456789abcdef",
+				Files:      []string{".github/review.yml", "README.md"},
+			},
+		},
+		{
+			name:  "not concerned",
+			event: "star",
+			file:  "github_push.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, payload := webhookRequest(t, tt.file, map[string]string{"X-GitHub-Event": tt.event})
+			got, err := scm.ParseWebhook(scm.TypeGithub, r, payload)
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			if tt.want == nil && got != nil {
+				t.Errorf("ParseWebhook() = %+v, want nil", got)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWebhook() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type githubRepository struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+	HTMLURL       string `json:"html_url"`
+}
+
+func (r *githubRepository) convert() Repository {
+	return Repository{
+		ID:            r.ID,
+		FullName:      r.FullName,
+		Name:          r.Name,
+		DefaultBranch: r.DefaultBranch,
+		WebURL:        r.HTMLURL,
+	}
+}
+
+type githubPullRequestEvent struct {
+	Action      string            `json:"action"`
+	PullRequest githubPullRequest `json:"pull_request"`
+	Repository  githubRepository  `json:"repository"`
+	Sender      githubUser        `json:"sender"`
+	Review      struct {
+		State string `json:"state"`
+	} `json:"review"`
+}
+
+type githubIssueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int          `json:"number"`
+		Assignees   []githubUser `json:"assignees"`
+		PullRequest *struct {
+			URL string `json:"url"`
+		} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		ID   int        `json:"id"`
+		Body string     `json:"body"`
+		User githubUser `json:"user"`
+	} `json:"comment"`
+	Repository githubRepository `json:"repository"`
+	Sender     githubUser       `json:"sender"`
+}
+
+type githubPushEvent struct {
+	Ref        string           `json:"ref"`
+	Before     string           `json:"before"`
+	After      string           `json:"after"`
+	Repository githubRepository `json:"repository"`
+	Sender     githubUser       `json:"sender"`
+	Commits    []githubCommit   `json:"commits"`
+}
+
+type githubCommit struct {
+	ID       string   `json:"id"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+func parseGithubWebhook(r *http.Request, payload []byte) (interface{}, error) {
+	switch r.Header.Get("X-GitHub-Event") {
+	case "pull_request", "pull_request_review":
+		var e githubPullRequestEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		return convertGithubPullRequestEvent(&e), nil
+	case "issue_comment":
+		var e githubIssueCommentEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		if e.Action != "created" {
+			return nil, nil
+		}
+		if e.Issue.PullRequest == nil {
+			return &IssueCommentEvent{
+				Actor:      convertGithubUser(&e.Comment.User),
+				Repository: e.Repository.convert(),
+				Number:     e.Issue.Number,
+				Note:       e.Comment.Body,
+			}, nil
+		}
+		return convertGithubCommentEvent(&e), nil
+	case "push":
+		var e githubPushEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		// tags are not concerned
+		if !strings.HasPrefix(e.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		return convertGithubPushEvent(&e), nil
+	}
+	return nil, nil
+}
+
+func convertGithubPushEvent(e *githubPushEvent) *PushEvent {
+	result := &PushEvent{
+		Actor:      convertGithubUser(&e.Sender),
+		Repository: e.Repository.convert(),
+		Branch:     strings.TrimPrefix(e.Ref, "refs/heads/"),
+		Before:     e.Before,
+		After:      e.After,
+		// github carries 2048 commits at most
+		Truncated: len(e.Commits) >= 2048,
+	}
+	for _, v := range e.Commits {
+		result.appendFiles(v.Added, v.Modified, v.Removed)
+	}
+	return result
+}
+
+func convertGithubUser(user *githubUser) User {
+	return User{
+		ID:       user.ID,
+		Username: user.Login,
+		Name:     user.Name,
+		Email:    user.Email,
+	}
+}
+
+func convertGithubPullRequestEvent(e *githubPullRequestEvent) *PullRequestEvent {
+	pr := &e.PullRequest
+	result := &PullRequestEvent{
+		Actor:         convertGithubUser(&e.Sender),
+		Repository:    e.Repository.convert(),
+		Number:        pr.Number,
+		Title:         pr.Title,
+		Description:   pr.Body,
+		SourceBranch:  pr.Head.Ref,
+		TargetBranch:  pr.Base.Ref,
+		AuthorID:      pr.User.ID,
+		LastCommitSHA: pr.Head.SHA,
+	}
+
+	switch e.Action {
+	case "opened":
+		result.Action = EventActionOpen
+	case "reopened":
+		result.Action = EventActionReopen
+	case "closed":
+		result.Action = EventActionClose
+		if pr.Merged {
+			result.Action = EventActionMerge
+		}
+	case "synchronize", "edited", "labeled", "unlabeled",
+		"assigned", "unassigned", "ready_for_review", "converted_to_draft":
+		result.Action = EventActionUpdate
+		result.NewCommits = e.Action == "synchronize"
+	case "submitted":
+		if strings.EqualFold(e.Review.State, "approved") {
+			result.Action = EventActionApproved
+		}
+	case "dismissed":
+		result.Action = EventActionUnapproved
+	}
+
+	for _, v := range pr.Labels {
+		result.Labels = append(result.Labels, v.Name)
+	}
+	for _, v := range pr.Assignees {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v.ID)
+	}
+	return result
+}
+
+func convertGithubCommentEvent(e *githubIssueCommentEvent) *CommentEvent {
+	result := &CommentEvent{
+		Actor:      convertGithubUser(&e.Comment.User),
+		Repository: e.Repository.convert(),
+		Number:     e.Issue.Number,
+		Note:       e.Comment.Body,
+	}
+	for _, v := range e.Issue.Assignees {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v.ID)
+	}
+	return result
+}
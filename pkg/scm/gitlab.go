@@ -15,7 +15,7 @@
 package scm
 
 import (
-	"path"
+	"net/http"
 
 	"github.com/sirupsen/logrus"
 
@@ -32,6 +32,8 @@ func NewGitlabClient(cfg *Config) (Interface, error) {
 	client, err := gitlab.NewClient(
 		cfg.Token,
 		gitlab.WithBaseURL(cfg.Host),
+		// 重试由RetryClient处理
+		gitlab.WithoutRetries(),
 	)
 	if err != nil {
 		return nil, err
@@ -83,11 +85,32 @@ func (s *gitlabClient) CreateLabel(pid string, label *Label) error {
 }
 
 func (s *gitlabClient) GetPullRequest(pid string, prID int) (*PullRequest, error) {
-	opt := &gitlab.GetMergeRequestsOptions{}
+	opt := &gitlab.GetMergeRequestsOptions{
+		IncludeRebaseInProgress: gitlab.Bool(true),
+	}
 	mr, _, err := s.client.MergeRequests.GetMergeRequest(pid, prID, opt)
 	if err != nil {
 		return nil, err
 	}
+	mergeCommitSHA := mr.MergeCommitSHA
+	if mr.SquashCommitSHA != "" {
+		mergeCommitSHA = mr.SquashCommitSHA
+	}
+	var assigneeIDs []int
+	for _, v := range mr.Assignees {
+		assigneeIDs = appendAssigneeID(assigneeIDs, v.ID)
+	}
+	if mr.Assignee != nil {
+		assigneeIDs = appendAssigneeID(assigneeIDs, mr.Assignee.ID)
+	}
+	var reviewerIDs []int
+	for _, v := range mr.Reviewers {
+		reviewerIDs = append(reviewerIDs, v.ID)
+	}
+	var authorID int
+	if mr.Author != nil {
+		authorID = mr.Author.ID
+	}
 	return &PullRequest{
 		ID:                        mr.ID,
 		IID:                       mr.IID,
@@ -107,6 +130,13 @@ func (s *gitlabClient) GetPullRequest(pid string, prID int) (*PullRequest, error
 		ShouldRemoveSourceBranch:  mr.ShouldRemoveSourceBranch,
 		ForceRemoveSourceBranch:   mr.ForceRemoveSourceBranch,
 		Squash:                    mr.Squash,
+		SHA:                       mr.SHA,
+		MergeCommitSHA:            mergeCommitSHA,
+		AssigneeIDs:               assigneeIDs,
+		ReviewerIDs:               reviewerIDs,
+		AuthorID:                  authorID,
+		RebaseInProgress:          mr.RebaseInProgress,
+		MergeError:                mr.MergeError,
 	}, nil
 }
 
@@ -131,6 +161,13 @@ func (s *gitlabClient) UpdatePullRequest(pid string, prID int, data *UpdatePullR
 	if len(data.AssigneeIDs) > 0 {
 		opt.AssigneeIDs = &data.AssigneeIDs
 	}
+	if data.UnassignAll {
+		opt.AssigneeID = nil
+		opt.AssigneeIDs = &[]int{}
+	}
+	if data.ReviewerIDs != nil {
+		opt.ReviewerIDs = &data.ReviewerIDs
+	}
 	logrus.Debugf("UpdateMergeRequest options: %+v", opt)
 	_, _, err := s.client.MergeRequests.UpdateMergeRequest(pid, prID, opt)
 	return err
@@ -145,6 +182,47 @@ func (s *gitlabClient) CreatePullRequestComment(pid string, prID int, comment st
 	return err
 }
 
+func (s *gitlabClient) ListPullRequestComments(pid string, prID int) ([]Comment, error) {
+	var result []Comment
+	var page int
+	for {
+		page++
+		opt := &gitlab.ListMergeRequestNotesOptions{
+			ListOptions: gitlab.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			},
+			OrderBy: gitlab.String("created_at"),
+			Sort:    gitlab.String("asc"),
+		}
+		notes, _, err := s.client.Notes.ListMergeRequestNotes(pid, prID, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range notes {
+			// 跳过系统生成的评论
+			if v.System {
+				continue
+			}
+			result = append(result, Comment{
+				ID:   v.ID,
+				Body: v.Body,
+				Author: User{
+					ID:       v.Author.ID,
+					Username: v.Author.Username,
+					Name:     v.Author.Name,
+					Email:    v.Author.Email,
+				},
+				CreatedAt: v.CreatedAt,
+			})
+		}
+		if len(notes) < 100 {
+			break
+		}
+	}
+	return result, nil
+}
+
 func (s *gitlabClient) MergePullRequest(pid string, prID int, data *MergePullRequest) error {
 	opt := &gitlab.AcceptMergeRequestOptions{}
 	if data.Squash && data.SquashCommitMessage != "" {
@@ -161,11 +239,20 @@ func (s *gitlabClient) MergePullRequest(pid string, prID int, data *MergePullReq
 	return err
 }
 
+// RebasePullRequest starts the rebase in background, the progress is reported by GetPullRequest.
+func (s *gitlabClient) RebasePullRequest(pid string, prID int) error {
+	_, err := s.client.MergeRequests.RebaseMergeRequest(pid, prID)
+	return err
+}
+
 func (s *gitlabClient) GetReviewConfig(pid, ref string) (*ReviewConfig, error) {
 	opt := &gitlab.GetRawFileOptions{
 		Ref: &ref,
 	}
-	data, _, err := s.client.RepositoryFiles.GetRawFile(pid, path.Join(".gitlab", ReviewConfigFileName), opt)
+	data, resp, err := s.client.RepositoryFiles.GetRawFile(pid, ReviewConfigPath(TypeGitlab), opt)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, ErrReviewConfigNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -228,3 +315,118 @@ func (s *gitlabClient) MergePullRequestApprove(pid string, prID int, approved bo
 	}
 	return err
 }
+
+func (s *gitlabClient) GetIssue(pid string, issueID int) (*Issue, error) {
+	issue, _, err := s.client.Issues.GetIssue(pid, issueID)
+	if err != nil {
+		return nil, err
+	}
+	result := &Issue{
+		ID:          issue.ID,
+		IID:         issue.IID,
+		Title:       issue.Title,
+		Description: issue.Description,
+		State:       issue.State,
+		Labels:      issue.Labels,
+	}
+	if issue.Author != nil {
+		result.AuthorID = issue.Author.ID
+	}
+	for _, v := range issue.Assignees {
+		result.AssigneeIDs = append(result.AssigneeIDs, v.ID)
+	}
+	return result, nil
+}
+
+func (s *gitlabClient) UpdateIssue(pid string, issueID int, data *UpdateIssue) error {
+	opt := &gitlab.UpdateIssueOptions{
+		Labels:       (*gitlab.Labels)(&data.Labels),
+		AddLabels:    (*gitlab.Labels)(&data.AddLabels),
+		RemoveLabels: (*gitlab.Labels)(&data.RemoveLabels),
+	}
+	if len(data.AssigneeIDs) > 0 {
+		opt.AssigneeIDs = &data.AssigneeIDs
+	}
+	if data.UnassignAll {
+		opt.AssigneeIDs = &[]int{}
+	}
+	if data.StateEvent != "" {
+		opt.StateEvent = &data.StateEvent
+	}
+	logrus.Debugf("UpdateIssue options: %+v", opt)
+	_, _, err := s.client.Issues.UpdateIssue(pid, issueID, opt)
+	return err
+}
+
+func (s *gitlabClient) CreateIssueComment(pid string, issueID int, comment string) error {
+	if comment == "" {
+		return nil
+	}
+	opt := &gitlab.CreateIssueNoteOptions{Body: &comment}
+	_, _, err := s.client.Notes.CreateIssueNote(pid, issueID, opt)
+	return err
+}
+
+func (s *gitlabClient) ListPullRequestPipelines(pid string, prID int) ([]Pipeline, error) {
+	pipelines, _, err := s.client.MergeRequests.ListMergeRequestPipelines(pid, prID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Pipeline, 0, len(pipelines))
+	for _, v := range pipelines {
+		result = append(result, Pipeline{
+			ID:     v.ID,
+			SHA:    v.SHA,
+			Ref:    v.Ref,
+			Status: v.Status,
+			WebURL: v.WebURL,
+		})
+	}
+	return result, nil
+}
+
+func (s *gitlabClient) ListPipelineJobs(pid string, pipelineID int) ([]Job, error) {
+	var result []Job
+	var page int
+	for {
+		page++
+		opt := &gitlab.ListJobsOptions{
+			ListOptions: gitlab.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			},
+		}
+		jobs, _, err := s.client.Jobs.ListPipelineJobs(pid, pipelineID, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range jobs {
+			result = append(result, Job{
+				ID:           v.ID,
+				Name:         v.Name,
+				Stage:        v.Stage,
+				Status:       v.Status,
+				AllowFailure: v.AllowFailure,
+			})
+		}
+		if len(jobs) < 100 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *gitlabClient) RetryPipeline(pid string, pipelineID int) error {
+	_, _, err := s.client.Pipelines.RetryPipelineBuild(pid, pipelineID)
+	return err
+}
+
+func (s *gitlabClient) RetryJob(pid string, jobID int) error {
+	_, _, err := s.client.Jobs.RetryJob(pid, jobID)
+	return err
+}
+
+func (s *gitlabClient) PlayJob(pid string, jobID int) error {
+	_, _, err := s.client.Jobs.PlayJob(pid, jobID)
+	return err
+}
@@ -0,0 +1,306 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/zc2638/review-bot/pkg/scm"
+	"github.com/zc2638/review-bot/pkg/scm/fake"
+)
+
+func newGitlabClient(t *testing.T) (*fake.GitlabServer, scm.Interface) {
+	server := fake.NewGitlabServer()
+	t.Cleanup(server.Close)
+	client, err := scm.NewGitlabClient(&scm.Config{
+		Type:  scm.TypeGitlab,
+		Host:  server.URL,
+		Token: "token",
+	})
+	if err != nil {
+		t.Fatalf("NewGitlabClient() error = %v", err)
+	}
+	return server, client
+}
+
+func TestGitlabClient_ListLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     int
+		wantPages int
+	}{
+		{name: "empty", total: 0, wantPages: 1},
+		{name: "one page", total: 99, wantPages: 1},
+		{name: "full page", total: 100, wantPages: 2},
+		{name: "multiple pages", total: 250, wantPages: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newGitlabClient(t)
+			project := server.AddProject("group/labels", nil)
+			for i := 0; i < tt.total; i++ {
+				project.Labels = append(project.Labels, scm.Label{Name: fmt.Sprintf("label-%d", i), Color: "#FFFFFF"})
+			}
+
+			labels, err := client.ListLabels("group/labels")
+			if err != nil {
+				t.Fatalf("ListLabels() error = %v", err)
+			}
+			if len(labels) != tt.total {
+				t.Errorf("ListLabels() got %d labels, want %d", len(labels), tt.total)
+			}
+			if got := len(server.Requests("GET /labels")); got != tt.wantPages {
+				t.Errorf("ListLabels() requested %d pages, want %d", got, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestGitlabClient_ListProjectMembers(t *testing.T) {
+	server, client := newGitlabClient(t)
+	project := server.AddProject("group/members", nil)
+	for i := 1; i <= 150; i++ {
+		project.Members = append(project.Members, scm.ProjectMember{ID: i, Username: fmt.Sprintf("user%d", i)})
+	}
+
+	members, err := client.ListProjectMembers("group/members")
+	if err != nil {
+		t.Fatalf("ListProjectMembers() error = %v", err)
+	}
+	if !reflect.DeepEqual(members, project.Members) {
+		t.Errorf("ListProjectMembers() = %v, want %v", members, project.Members)
+	}
+	if got := len(server.Requests("GET /members/all")); got != 2 {
+		t.Errorf("ListProjectMembers() requested %d pages, want 2", got)
+	}
+}
+
+func TestGitlabClient_ListPullRequestComments(t *testing.T) {
+	server, client := newGitlabClient(t)
+	project := server.AddProject("group/notes", &fake.Project{
+		PullRequests: map[int]*scm.PullRequest{1: {IID: 1}},
+	})
+	for i := 1; i <= 150; i++ {
+		project.Notes[1] = append(project.Notes[1], scm.Comment{
+			ID:     i,
+			Body:   fmt.Sprintf("note %d", i),
+			Author: scm.User{ID: i, Username: fmt.Sprintf("user%d", i)},
+		})
+	}
+
+	comments, err := client.ListPullRequestComments("group/notes", 1)
+	if err != nil {
+		t.Fatalf("ListPullRequestComments() error = %v", err)
+	}
+	if !reflect.DeepEqual(comments, project.Notes[1]) {
+		t.Errorf("ListPullRequestComments() = %v, want %v", comments, project.Notes[1])
+	}
+	if got := len(server.Requests("GET /merge_requests/{iid}/notes")); got != 2 {
+		t.Errorf("ListPullRequestComments() requested %d pages, want 2", got)
+	}
+}
+
+func TestGitlabClient_GetReviewConfig(t *testing.T) {
+	server, client := newGitlabClient(t)
+	server.AddProject("group/config", &fake.Project{
+		ReviewConfig: map[string]string{
+			"main": "reviewers:\n  - reviewer1\napprovers:\n  - approver1\npullrequest:\n  squash_with_title: true\n",
+		},
+	})
+
+	cfg, err := client.GetReviewConfig("group/config", "main")
+	if err != nil {
+		t.Fatalf("GetReviewConfig() error = %v", err)
+	}
+	want := &scm.ReviewConfig{
+		Reviewers: []string{"reviewer1"},
+		Approvers: []string{"approver1"},
+		PRConfig:  scm.PullRequestConfig{SquashWithTitle: true},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("GetReviewConfig() = %+v, want %+v", cfg, want)
+	}
+
+	requests := server.Requests("GET /repository/files/{file}/raw")
+	if len(requests) != 1 || requests[0].Query.Get("ref") != "main" {
+		t.Errorf("GetReviewConfig() requests = %+v, want ref main", requests)
+	}
+	if _, err := client.GetReviewConfig("group/none", "main"); err == nil {
+		t.Errorf("GetReviewConfig() of unknown project should fail")
+	}
+}
+
+func TestGitlabClient_MergePullRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *scm.MergePullRequest
+		want *scm.MergePullRequest
+	}{
+		{
+			name: "squash",
+			opt: &scm.MergePullRequest{
+				Squash:                    true,
+				SquashCommitMessage:       "feat:title",
+				ShouldRemoveSourceBranch:  true,
+				MergeWhenPipelineSucceeds: true,
+			},
+			want: &scm.MergePullRequest{
+				Squash:                    true,
+				SquashCommitMessage:       "feat:title",
+				ShouldRemoveSourceBranch:  true,
+				MergeWhenPipelineSucceeds: true,
+			},
+		},
+		{
+			name: "squash without message",
+			opt: &scm.MergePullRequest{
+				Squash:                    true,
+				MergeWhenPipelineSucceeds: true,
+			},
+			want: &scm.MergePullRequest{
+				MergeWhenPipelineSucceeds: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newGitlabClient(t)
+			project := server.AddProject("group/merge", &fake.Project{
+				PullRequests: map[int]*scm.PullRequest{
+					1: {IID: 1, State: "opened"},
+				},
+			})
+			if err := client.MergePullRequest("group/merge", 1, tt.opt); err != nil {
+				t.Fatalf("MergePullRequest() error = %v", err)
+			}
+			if got := project.Merges[1]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MergePullRequest() options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitlabClient_UpdatePullRequest_Reviewers(t *testing.T) {
+	server, client := newGitlabClient(t)
+	project := server.AddProject("group/reviewers", &fake.Project{
+		PullRequests: map[int]*scm.PullRequest{1: {IID: 1, State: "opened"}},
+		Reviewers:    map[int][]int{1: {2}},
+	})
+
+	if err := client.UpdatePullRequest("group/reviewers", 1, &scm.UpdatePullRequest{Title: "title"}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	if got := project.Reviewers[1]; !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("UpdatePullRequest() without ReviewerIDs changed reviewers to %v", got)
+	}
+
+	if err := client.UpdatePullRequest("group/reviewers", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{2, 3}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	pr, err := client.GetPullRequest("group/reviewers", 1)
+	if err != nil {
+		t.Fatalf("GetPullRequest() error = %v", err)
+	}
+	if !reflect.DeepEqual(pr.ReviewerIDs, []int{2, 3}) {
+		t.Errorf("GetPullRequest() reviewers = %v, want [2 3]", pr.ReviewerIDs)
+	}
+
+	if err := client.UpdatePullRequest("group/reviewers", 1, &scm.UpdatePullRequest{ReviewerIDs: []int{}}); err != nil {
+		t.Fatalf("UpdatePullRequest() error = %v", err)
+	}
+	if got := project.Reviewers[1]; len(got) != 0 {
+		t.Errorf("UpdatePullRequest() reviewers = %v, want none", got)
+	}
+}
+
+func TestGitlabClient_RetryPipeline(t *testing.T) {
+	server, client := newGitlabClient(t)
+	project := server.AddProject("group/pipelines", &fake.Project{
+		PullRequests: map[int]*scm.PullRequest{1: {IID: 1, State: "opened"}},
+		Pipelines: map[int][]scm.Pipeline{
+			1: {{ID: 11, SHA: "sha", Status: scm.BuildStateFailed}},
+		},
+		Jobs: map[int][]scm.Job{
+			11: {
+				{ID: 1, Name: "build", Stage: "build", Status: scm.BuildStateSuccess},
+				{ID: 2, Name: "test", Stage: "test", Status: scm.BuildStateFailed},
+				{ID: 3, Name: "deploy", Stage: "deploy", Status: scm.BuildStateManual},
+			},
+		},
+	})
+
+	pipelines, err := client.ListPullRequestPipelines("group/pipelines", 1)
+	if err != nil {
+		t.Fatalf("ListPullRequestPipelines() error = %v", err)
+	}
+	if !reflect.DeepEqual(pipelines, project.Pipelines[1]) {
+		t.Errorf("ListPullRequestPipelines() = %v, want %v", pipelines, project.Pipelines[1])
+	}
+	jobs, err := client.ListPipelineJobs("group/pipelines", 11)
+	if err != nil {
+		t.Fatalf("ListPipelineJobs() error = %v", err)
+	}
+	if !reflect.DeepEqual(jobs, project.Jobs[11]) {
+		t.Errorf("ListPipelineJobs() = %v, want %v", jobs, project.Jobs[11])
+	}
+
+	if err := client.RetryPipeline("group/pipelines", 11); err != nil {
+		t.Fatalf("RetryPipeline() error = %v", err)
+	}
+	if err := client.PlayJob("group/pipelines", 3); err != nil {
+		t.Fatalf("PlayJob() error = %v", err)
+	}
+	if err := client.PlayJob("group/pipelines", 1); err == nil {
+		t.Errorf("PlayJob() of the finished job should fail")
+	}
+	if err := client.RetryJob("group/pipelines", 1); err != nil {
+		t.Fatalf("RetryJob() error = %v", err)
+	}
+	for _, job := range project.Jobs[11] {
+		if job.Status != scm.BuildStatePending {
+			t.Errorf("job(%s) status = %s, want pending", job.Name, job.Status)
+		}
+	}
+}
+
+func TestGitlabClient_RebasePullRequest(t *testing.T) {
+	server, client := newGitlabClient(t)
+	server.AddProject("group/rebase", &fake.Project{
+		PullRequests: map[int]*scm.PullRequest{1: {IID: 1, State: "opened"}},
+		RebaseErrors: map[int]string{1: "Rebase failed"},
+	})
+
+	if err := client.RebasePullRequest("group/rebase", 1); err != nil {
+		t.Fatalf("RebasePullRequest() error = %v", err)
+	}
+	pr, err := client.GetPullRequest("group/rebase", 1)
+	if err != nil {
+		t.Fatalf("GetPullRequest() error = %v", err)
+	}
+	if !pr.RebaseInProgress {
+		t.Errorf("GetPullRequest() rebase_in_progress = false, want true")
+	}
+	if requests := server.Requests("GET /merge_requests/{iid}"); requests[0].Query.Get("include_rebase_in_progress") != "true" {
+		t.Errorf("GetPullRequest() query = %v, want include_rebase_in_progress", requests[0].Query)
+	}
+	if pr, err = client.GetPullRequest("group/rebase", 1); err != nil {
+		t.Fatalf("GetPullRequest() error = %v", err)
+	}
+	if pr.RebaseInProgress || pr.MergeError != "Rebase failed" {
+		t.Errorf("GetPullRequest() = %v %q, want finished with merge error", pr.RebaseInProgress, pr.MergeError)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func parseGitlabWebhook(r *http.Request, payload []byte) (interface{}, error) {
+	eventType := gitlab.HookEventType(r)
+	if eventType == gitlab.EventTypeSystemHook {
+		// 系统webhook仅处理merge request、push及pipeline事件，其余事件忽略
+		var hook struct {
+			ObjectKind string `json:"object_kind"`
+		}
+		if err := json.Unmarshal(payload, &hook); err != nil {
+			return nil, err
+		}
+		switch hook.ObjectKind {
+		case string(gitlab.MergeRequestEventTargetType):
+		case "push":
+			// 系统webhook的push事件与项目webhook格式一致
+			eventType = gitlab.EventTypePush
+		case "pipeline":
+			eventType = gitlab.EventTypePipeline
+		default:
+			return nil, nil
+		}
+	}
+	webhook, err := gitlab.ParseHook(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch e := webhook.(type) {
+	case *gitlab.MergeEvent:
+		return convertGitlabMergeEvent(e), nil
+	case *gitlab.MergeCommentEvent:
+		return convertGitlabCommentEvent(e), nil
+	case *gitlab.IssueCommentEvent:
+		return convertGitlabIssueCommentEvent(e), nil
+	case *gitlab.PushEvent:
+		// tags are not concerned
+		if !strings.HasPrefix(e.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		return convertGitlabPushEvent(e), nil
+	case *gitlab.PipelineEvent:
+		// 仅处理merge request流水线的最终结果
+		status := e.ObjectAttributes.Status
+		if e.MergeRequest.IID == 0 || (status != PipelineStatusSuccess && status != PipelineStatusFailed) {
+			return nil, nil
+		}
+		return convertGitlabPipelineEvent(e), nil
+	}
+	return nil, nil
+}
+
+func convertGitlabUser(user *gitlab.EventUser) User {
+	if user == nil {
+		return User{}
+	}
+	return User{
+		ID:       user.ID,
+		Username: user.Username,
+		Name:     user.Name,
+		Email:    user.Email,
+	}
+}
+
+func convertGitlabMergeEvent(e *gitlab.MergeEvent) *PullRequestEvent {
+	attrs := &e.ObjectAttributes
+	result := &PullRequestEvent{
+		Action: attrs.Action,
+		Actor:  convertGitlabUser(e.User),
+		Repository: Repository{
+			ID:            e.Project.ID,
+			FullName:      e.Project.PathWithNamespace,
+			Name:          e.Project.Name,
+			DefaultBranch: e.Project.DefaultBranch,
+			WebURL:        e.Project.WebURL,
+		},
+		Number:        attrs.IID,
+		Title:         attrs.Title,
+		Description:   attrs.Description,
+		SourceBranch:  attrs.SourceBranch,
+		TargetBranch:  attrs.TargetBranch,
+		AuthorID:      attrs.AuthorID,
+		LastCommitSHA: attrs.LastCommit.ID,
+		// oldrev只在推送新的commit时存在
+		NewCommits: attrs.Action == EventActionUpdate && attrs.OldRev != "",
+	}
+	for _, v := range e.Labels {
+		result.Labels = append(result.Labels, v.Name)
+	}
+	for _, v := range e.Assignees {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v.ID)
+	}
+	if e.Assignee != nil {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, e.Assignee.ID)
+	}
+	return result
+}
+
+func convertGitlabCommentEvent(e *gitlab.MergeCommentEvent) *CommentEvent {
+	mr := &e.MergeRequest
+	result := &CommentEvent{
+		Actor: convertGitlabUser(e.User),
+		Repository: Repository{
+			ID:            e.ProjectID,
+			FullName:      e.Project.PathWithNamespace,
+			Name:          e.Project.Name,
+			DefaultBranch: e.Project.DefaultBranch,
+			WebURL:        e.Project.WebURL,
+		},
+		Number:        mr.IID,
+		Note:          e.ObjectAttributes.Note,
+		LastCommitSHA: mr.LastCommit.ID,
+	}
+	for _, v := range mr.AssigneeIDs {
+		result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, v)
+	}
+	result.AssigneeIDs = appendAssigneeID(result.AssigneeIDs, mr.AssigneeID)
+	return result
+}
+
+func convertGitlabIssueCommentEvent(e *gitlab.IssueCommentEvent) *IssueCommentEvent {
+	result := &IssueCommentEvent{
+		Repository: Repository{
+			ID:            e.ProjectID,
+			FullName:      e.Project.PathWithNamespace,
+			Name:          e.Project.Name,
+			DefaultBranch: e.Project.DefaultBranch,
+			WebURL:        e.Project.WebURL,
+		},
+		Number: e.Issue.IID,
+		Note:   e.ObjectAttributes.Note,
+	}
+	if e.User != nil {
+		result.Actor = User{
+			ID:       e.User.ID,
+			Username: e.User.Username,
+			Name:     e.User.Name,
+			Email:    e.User.Email,
+		}
+	}
+	return result
+}
+
+func convertGitlabPushEvent(e *gitlab.PushEvent) *PushEvent {
+	result := &PushEvent{
+		Actor: User{
+			ID:       e.UserID,
+			Username: e.UserUsername,
+			Name:     e.UserName,
+			Email:    e.UserEmail,
+		},
+		Repository: Repository{
+			ID:            e.ProjectID,
+			FullName:      e.Project.PathWithNamespace,
+			Name:          e.Project.Name,
+			DefaultBranch: e.Project.DefaultBranch,
+			WebURL:        e.Project.WebURL,
+		},
+		Branch: strings.TrimPrefix(e.Ref, "refs/heads/"),
+		Before: e.Before,
+		After:  e.After,
+		// gitlab carries 20 commits at most
+		Truncated: e.TotalCommitsCount > len(e.Commits),
+	}
+	for _, v := range e.Commits {
+		result.appendFiles(v.Added, v.Modified, v.Removed)
+	}
+	return result
+}
+
+func convertGitlabPipelineEvent(e *gitlab.PipelineEvent) *PipelineEvent {
+	result := &PipelineEvent{
+		Actor: convertGitlabUser(e.User),
+		Repository: Repository{
+			ID:            e.Project.ID,
+			FullName:      e.Project.PathWithNamespace,
+			Name:          e.Project.Name,
+			DefaultBranch: e.Project.DefaultBranch,
+			WebURL:        e.Project.WebURL,
+		},
+		Number: e.MergeRequest.IID,
+		SHA:    e.ObjectAttributes.SHA,
+		Status: e.ObjectAttributes.Status,
+	}
+	if e.Project.WebURL != "" {
+		result.WebURL = e.Project.WebURL + "/-/pipelines/" + strconv.Itoa(e.ObjectAttributes.ID)
+	}
+	for _, v := range e.Builds {
+		if v.Status == PipelineStatusFailed && !v.AllowFailure {
+			result.FailedJobs = append(result.FailedJobs, v.Name)
+		}
+	}
+	return result
+}
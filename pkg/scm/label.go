@@ -14,7 +14,7 @@
 
 package scm
 
-import "strings"
+import "github.com/zc2638/review-bot/pkg/command"
 
 const DoNotMerge = "do-not-merge"
 
@@ -26,6 +26,7 @@ const (
 	AddSet
 	RemoveSet
 	CustomSet
+	AutoSet
 )
 
 func getLabelSet(s Set) map[string]Label {
@@ -38,6 +39,8 @@ func getLabelSet(s Set) map[string]Label {
 		return removeSet
 	case CustomSet:
 		return customSet
+	case AutoSet:
+		return autoSet
 	default:
 		return customSet
 	}
@@ -72,34 +75,47 @@ func (s Set) LabelByKey(key string) *Label {
 	return nil
 }
 
-func (s Set) FuzzyLabels(content string) []Label {
+// MatchLabels returns the labels whose orders match the commands.
+func (s Set) MatchLabels(cmds command.Commands) []Label {
 	set := getLabelSet(s)
 	var labels []Label
 	for _, v := range set {
-		if strings.Contains(content, v.Order) {
+		if v.Match(cmds) {
 			labels = append(labels, v)
 		}
 	}
 	return labels
 }
 
-func (s Set) FuzzyLabelWithKey(key, content string) *Label {
+func (s Set) MatchLabelWithKey(key string, cmds command.Commands) *Label {
 	set := getLabelSet(s)
 	for k, v := range set {
-		if k == key && strings.Contains(content, v.Order) {
+		if k == key && v.Match(cmds) {
 			return &v
 		}
 	}
 	return nil
 }
 
-func (s Set) FuzzyLabelsWithPrefix(prefix, content string) []Label {
+// MatchLabelsWithPrefix returns the labels whose orders with the prefix match the commands,
+// e.g. `/remove-kind bug` with the prefix remove.
+func (s Set) MatchLabelsWithPrefix(prefix string, cmds command.Commands) []Label {
 	set := getLabelSet(s)
 	var labels []Label
 	for _, v := range set {
-		order := strings.TrimPrefix(v.Order, "/")
-		order = "/" + prefix + "-" + order
-		if strings.Contains(content, order) {
+		if v.MatchWithPrefix(prefix, cmds) {
+			labels = append(labels, v)
+		}
+	}
+	return labels
+}
+
+// CancelLabels returns the labels whose orders are canceled by the commands, e.g. `/hold cancel`.
+func (s Set) CancelLabels(cmds command.Commands) []Label {
+	set := getLabelSet(s)
+	var labels []Label
+	for _, v := range set {
+		if v.Order != "" && cmds.Cancel(v.Order) {
 			labels = append(labels, v)
 		}
 	}
@@ -113,6 +129,11 @@ var autoSet = map[string]Label{
 		Color:       "#FF0000",
 		Description: "标识缺少分类，不要合并",
 	},
+	"CI-FAILED": {
+		Name:        DoNotMerge + "/ci-failed",
+		Color:       "#FF0000",
+		Description: "标识流水线失败，不要合并",
+	},
 }
 
 var adminSet = map[string]Label{
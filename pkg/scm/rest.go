@@ -0,0 +1,118 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StatusError is returned by the rest client when the server responds with a non 2xx status code.
+type StatusError struct {
+	Method   string
+	URL      string
+	Response *http.Response
+	Body     []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.Response.StatusCode, strings.TrimSpace(string(e.Body)))
+}
+
+// isNotFound reports whether the err is a 404 response of the rest client.
+func isNotFound(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.Response.StatusCode == http.StatusNotFound
+}
+
+// restClient is a minimal json api client for the providers which have no sdk dependency.
+type restClient struct {
+	baseURL string
+	header  http.Header
+	client  *http.Client
+}
+
+func newRestClient(baseURL string, header http.Header) *restClient {
+	return &restClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		header:  header,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// raw sends the request and returns the response body without decoding.
+func (c *restClient) raw(method, path string, in interface{}, header http.Header) ([]byte, *http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := c.baseURL + path
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return data, resp, &StatusError{
+			Method:   method,
+			URL:      u,
+			Response: resp,
+			Body:     data,
+		}
+	}
+	return data, resp, nil
+}
+
+// do sends the request with json body `in` and decodes the json response into `out`.
+func (c *restClient) do(method, path string, in, out interface{}) (*http.Response, error) {
+	data, resp, err := c.raw(method, path, in, nil)
+	if err != nil {
+		return resp, err
+	}
+	if out == nil || len(data) == 0 {
+		return resp, nil
+	}
+	return resp, json.Unmarshal(data, out)
+}
@@ -0,0 +1,103 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// apiRequest records a request received by the apiServer.
+type apiRequest struct {
+	// Key is `METHOD escaped path`, e.g. `DELETE /repos/o/r/issues/1/labels/kind%2Fbugfix`
+	Key   string
+	Query url.Values
+	Body  interface{}
+}
+
+// apiServer is a fake rest api server which replies the fixed responses by `METHOD escaped path`,
+// the response is the status code if it is an int, otherwise it is encoded as json.
+// The unknown routes respond 404.
+type apiServer struct {
+	*httptest.Server
+
+	mux       sync.Mutex
+	responses map[string]interface{}
+	requests  []apiRequest
+}
+
+func newAPIServer(t *testing.T, responses map[string]interface{}) *apiServer {
+	s := &apiServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *apiServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	req := apiRequest{
+		Key:   r.Method + " " + r.URL.EscapedPath(),
+		Query: r.URL.Query(),
+	}
+	if data, err := ioutil.ReadAll(r.Body); err == nil && len(data) > 0 {
+		_ = json.Unmarshal(data, &req.Body)
+	}
+	s.requests = append(s.requests, req)
+
+	resp, ok := s.responses[req.Key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if code, ok := resp.(int); ok {
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Requests returns the received requests with the keys.
+func (s *apiServer) Requests(key string) []apiRequest {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var result []apiRequest
+	for _, v := range s.requests {
+		if v.Key == key {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// webhookRequest builds the webhook request with the headers and the payload in testdata.
+func webhookRequest(t *testing.T, file string, header map[string]string) (*http.Request, []byte) {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatalf("read testdata %s error = %v", file, err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	return r, payload
+}
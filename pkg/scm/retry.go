@@ -0,0 +1,350 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+type RetryConfig struct {
+	// MaxRetries is the max retry times of a call, negative value disables the retry
+	MaxRetries int `json:"max_retries"`
+	// MinBackoff is the wait time before the first retry, it doubles for each retry
+	MinBackoff time.Duration `json:"min_backoff"`
+	// MaxBackoff is the max wait time before a retry,
+	// the call fails directly if the server asks to wait longer than it
+	MaxBackoff time.Duration `json:"max_backoff"`
+}
+
+// RetryStats is the counters of a method.
+type RetryStats struct {
+	Calls    int64 `json:"calls"`
+	Retries  int64 `json:"retries"`
+	Failures int64 `json:"failures"`
+}
+
+// RetryClient is the decorator of Interface, it retries the failed calls with exponential backoff.
+// The idempotent calls are retried on 429, 5xx and network errors,
+// the others are only retried on 429 because the request is not processed by the server.
+type RetryClient struct {
+	si  Interface
+	cfg RetryConfig
+
+	sleep func(time.Duration)
+	mux   sync.Mutex
+	stats map[string]*RetryStats
+}
+
+var _ Interface = (*RetryClient)(nil)
+
+func NewRetryClient(si Interface, cfg RetryConfig) *RetryClient {
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+	return &RetryClient{
+		si:    si,
+		cfg:   cfg,
+		sleep: time.Sleep,
+		stats: make(map[string]*RetryStats),
+	}
+}
+
+// Stats returns the counters of the methods.
+func (c *RetryClient) Stats() map[string]RetryStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	result := make(map[string]RetryStats, len(c.stats))
+	for k, v := range c.stats {
+		result[k] = *v
+	}
+	return result
+}
+
+// RetryStatsOf returns the counters of the retry client wrapped by si, ok is false if si does not retry.
+func RetryStatsOf(si Interface) (stats map[string]RetryStats, ok bool) {
+	if c, named := si.(*namedClient); named {
+		si = c.Interface
+	}
+	c, ok := si.(*RetryClient)
+	if !ok {
+		return nil, false
+	}
+	return c.Stats(), true
+}
+
+func (c *RetryClient) count(method string, fn func(stats *RetryStats)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	stats, ok := c.stats[method]
+	if !ok {
+		stats = &RetryStats{}
+		c.stats[method] = stats
+	}
+	fn(stats)
+}
+
+func (c *RetryClient) do(method string, idempotent bool, fn func() error) error {
+	c.count(method, func(stats *RetryStats) { stats.Calls++ })
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= c.cfg.MaxRetries || !retryable(err, idempotent) {
+			break
+		}
+		wait, ok := c.backoff(attempt, errorResponse(err))
+		if !ok {
+			break
+		}
+		logrus.Debugf("Retry %s after %s, attempt %d: %v", method, wait, attempt+1, err)
+		c.count(method, func(stats *RetryStats) { stats.Retries++ })
+		c.sleep(wait)
+	}
+	c.count(method, func(stats *RetryStats) { stats.Failures++ })
+	return err
+}
+
+// backoff returns the wait time before the next retry,
+// it returns false if the server asks to wait longer than the max backoff.
+func (c *RetryClient) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if wait, ok := waitFromHeader(resp); ok {
+		if wait > c.cfg.MaxBackoff {
+			return 0, false
+		}
+		return wait, true
+	}
+
+	wait := c.cfg.MinBackoff << uint(attempt)
+	if wait > c.cfg.MaxBackoff || wait <= 0 {
+		wait = c.cfg.MaxBackoff
+	}
+	// 增加随机抖动，避免同时重试
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// waitFromHeader parses the wait time from the Retry-After or RateLimit-Reset header.
+func waitFromHeader(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return nonNegative(time.Until(t)), true
+		}
+	}
+	if v := resp.Header.Get("RateLimit-Reset"); v != "" {
+		if reset, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return nonNegative(time.Until(time.Unix(reset, 0))), true
+		}
+	}
+	return 0, false
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// errorResponse returns the http response carried by the error of the providers.
+func errorResponse(err error) *http.Response {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Response
+	}
+	var gitlabErr *gitlab.ErrorResponse
+	if errors.As(err, &gitlabErr) {
+		return gitlabErr.Response
+	}
+	return nil
+}
+
+func retryable(err error, idempotent bool) bool {
+	if resp := errorResponse(err); resp != nil {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		return idempotent && resp.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return idempotent && errors.As(err, &netErr)
+}
+
+func (c *RetryClient) GetReviewConfig(pid, ref string) (result *ReviewConfig, err error) {
+	err = c.do("GetReviewConfig", true, func() error {
+		result, err = c.si.GetReviewConfig(pid, ref)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) ListProjectMembers(pid string) (result []ProjectMember, err error) {
+	err = c.do("ListProjectMembers", true, func() error {
+		result, err = c.si.ListProjectMembers(pid)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) ListLabels(pid string) (result []Label, err error) {
+	err = c.do("ListLabels", true, func() error {
+		result, err = c.si.ListLabels(pid)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) CreateLabel(pid string, label *Label) error {
+	return c.do("CreateLabel", false, func() error {
+		return c.si.CreateLabel(pid, label)
+	})
+}
+
+func (c *RetryClient) CreatePullRequestComment(pid string, prID int, comment string) error {
+	return c.do("CreatePullRequestComment", false, func() error {
+		return c.si.CreatePullRequestComment(pid, prID, comment)
+	})
+}
+
+func (c *RetryClient) ListPullRequestComments(pid string, prID int) (result []Comment, err error) {
+	err = c.do("ListPullRequestComments", true, func() error {
+		result, err = c.si.ListPullRequestComments(pid, prID)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) GetPullRequest(pid string, prID int) (result *PullRequest, err error) {
+	err = c.do("GetPullRequest", true, func() error {
+		result, err = c.si.GetPullRequest(pid, prID)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) UpdatePullRequest(pid string, prID int, data *UpdatePullRequest) error {
+	return c.do("UpdatePullRequest", true, func() error {
+		return c.si.UpdatePullRequest(pid, prID, data)
+	})
+}
+
+func (c *RetryClient) UpdateBuildStatus(pid, sha string, state BuildState) error {
+	return c.do("UpdateBuildStatus", true, func() error {
+		return c.si.UpdateBuildStatus(pid, sha, state)
+	})
+}
+
+func (c *RetryClient) MergePullRequest(pid string, prID int, data *MergePullRequest) error {
+	return c.do("MergePullRequest", false, func() error {
+		return c.si.MergePullRequest(pid, prID, data)
+	})
+}
+
+func (c *RetryClient) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	// GitHub和Gitea每次都会创建新的review，不能重复提交
+	return c.do("MergePullRequestApprove", false, func() error {
+		return c.si.MergePullRequestApprove(pid, prID, approved)
+	})
+}
+
+func (c *RetryClient) RebasePullRequest(pid string, prID int) error {
+	return c.do("RebasePullRequest", false, func() error {
+		return c.si.RebasePullRequest(pid, prID)
+	})
+}
+
+func (c *RetryClient) GetIssue(pid string, issueID int) (result *Issue, err error) {
+	err = c.do("GetIssue", true, func() error {
+		result, err = c.si.GetIssue(pid, issueID)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) UpdateIssue(pid string, issueID int, data *UpdateIssue) error {
+	return c.do("UpdateIssue", true, func() error {
+		return c.si.UpdateIssue(pid, issueID, data)
+	})
+}
+
+func (c *RetryClient) CreateIssueComment(pid string, issueID int, comment string) error {
+	return c.do("CreateIssueComment", false, func() error {
+		return c.si.CreateIssueComment(pid, issueID, comment)
+	})
+}
+
+func (c *RetryClient) ListPullRequestPipelines(pid string, prID int) (result []Pipeline, err error) {
+	err = c.do("ListPullRequestPipelines", true, func() error {
+		result, err = c.si.ListPullRequestPipelines(pid, prID)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) ListPipelineJobs(pid string, pipelineID int) (result []Job, err error) {
+	err = c.do("ListPipelineJobs", true, func() error {
+		result, err = c.si.ListPipelineJobs(pid, pipelineID)
+		return err
+	})
+	return
+}
+
+func (c *RetryClient) RetryPipeline(pid string, pipelineID int) error {
+	return c.do("RetryPipeline", false, func() error {
+		return c.si.RetryPipeline(pid, pipelineID)
+	})
+}
+
+func (c *RetryClient) RetryJob(pid string, jobID int) error {
+	return c.do("RetryJob", false, func() error {
+		return c.si.RetryJob(pid, jobID)
+	})
+}
+
+func (c *RetryClient) PlayJob(pid string, jobID int) error {
+	return c.do("PlayJob", false, func() error {
+		return c.si.PlayJob(pid, jobID)
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scm
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// flakyClient returns the errors in order, then succeeds.
+type flakyClient struct {
+	Interface
+	errs  []error
+	calls int
+}
+
+func (c *flakyClient) next() error {
+	c.calls++
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func (c *flakyClient) GetPullRequest(pid string, prID int) (*PullRequest, error) {
+	if err := c.next(); err != nil {
+		return nil, err
+	}
+	return &PullRequest{IID: prID}, nil
+}
+
+func (c *flakyClient) CreatePullRequestComment(pid string, prID int, comment string) error {
+	return c.next()
+}
+
+func (c *flakyClient) MergePullRequestApprove(pid string, prID int, approved bool) error {
+	return c.next()
+}
+
+func statusErr(code int, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &StatusError{Response: &http.Response{StatusCode: code, Header: header}}
+}
+
+func TestRetryClient(t *testing.T) {
+	retryAfter := http.Header{}
+	retryAfter.Set("Retry-After", "2")
+	rateLimitReset := http.Header{}
+	rateLimitReset.Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+
+	tests := []struct {
+		name       string
+		method     string
+		errs       []error
+		wantErr    bool
+		wantCalls  int
+		wantWaits  []time.Duration
+		wantCounts RetryStats
+	}{
+		{
+			name:       "success",
+			method:     "GetPullRequest",
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1},
+		},
+		{
+			name:       "retry server error",
+			method:     "GetPullRequest",
+			errs:       []error{statusErr(502, nil), statusErr(503, nil)},
+			wantCalls:  3,
+			wantCounts: RetryStats{Calls: 1, Retries: 2},
+		},
+		{
+			name:       "exceed max retries",
+			method:     "GetPullRequest",
+			errs:       []error{statusErr(500, nil), statusErr(500, nil), statusErr(500, nil), statusErr(500, nil)},
+			wantErr:    true,
+			wantCalls:  4,
+			wantCounts: RetryStats{Calls: 1, Retries: 3, Failures: 1},
+		},
+		{
+			name:       "client error",
+			method:     "GetPullRequest",
+			errs:       []error{statusErr(404, nil)},
+			wantErr:    true,
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1, Failures: 1},
+		},
+		{
+			name:       "retry after",
+			method:     "GetPullRequest",
+			errs:       []error{statusErr(429, retryAfter)},
+			wantCalls:  2,
+			wantWaits:  []time.Duration{2 * time.Second},
+			wantCounts: RetryStats{Calls: 1, Retries: 1},
+		},
+		{
+			name:       "rate limit reset exceeds max backoff",
+			method:     "GetPullRequest",
+			errs:       []error{statusErr(429, rateLimitReset)},
+			wantErr:    true,
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1, Failures: 1},
+		},
+		{
+			name:       "non idempotent server error",
+			method:     "CreatePullRequestComment",
+			errs:       []error{statusErr(500, nil)},
+			wantErr:    true,
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1, Failures: 1},
+		},
+		{
+			name:       "approve server error",
+			method:     "MergePullRequestApprove",
+			errs:       []error{statusErr(502, nil)},
+			wantErr:    true,
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1, Failures: 1},
+		},
+		{
+			name:       "non idempotent rate limit",
+			method:     "CreatePullRequestComment",
+			errs:       []error{statusErr(429, retryAfter)},
+			wantCalls:  2,
+			wantWaits:  []time.Duration{2 * time.Second},
+			wantCounts: RetryStats{Calls: 1, Retries: 1},
+		},
+		{
+			name:       "unknown error",
+			method:     "GetPullRequest",
+			errs:       []error{errors.New("unknown")},
+			wantErr:    true,
+			wantCalls:  1,
+			wantCounts: RetryStats{Calls: 1, Failures: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			si := &flakyClient{errs: tt.errs}
+			c := NewRetryClient(si, RetryConfig{MinBackoff: time.Second, MaxBackoff: time.Minute})
+			var waits []time.Duration
+			c.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+			var err error
+			switch tt.method {
+			case "GetPullRequest":
+				_, err = c.GetPullRequest("group/project", 1)
+			case "CreatePullRequestComment":
+				err = c.CreatePullRequestComment("group/project", 1, "comment")
+			case "MergePullRequestApprove":
+				err = c.MergePullRequestApprove("group/project", 1, true)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s() error = %v, wantErr %v", tt.method, err, tt.wantErr)
+			}
+			if si.calls != tt.wantCalls {
+				t.Errorf("%s() calls = %d, want %d", tt.method, si.calls, tt.wantCalls)
+			}
+			if tt.wantWaits != nil && !reflect.DeepEqual(waits, tt.wantWaits) {
+				t.Errorf("%s() waits = %v, want %v", tt.method, waits, tt.wantWaits)
+			}
+			if got := c.Stats()[tt.method]; got != tt.wantCounts {
+				t.Errorf("%s() stats = %+v, want %+v", tt.method, got, tt.wantCounts)
+			}
+		})
+	}
+}
+
+func TestRetryClient_backoff(t *testing.T) {
+	c := NewRetryClient(nil, RetryConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		wait, ok := c.backoff(attempt, nil)
+		if !ok || wait < max/2 || wait > max {
+			t.Errorf("backoff(%d) = %v, want in [%v, %v]", attempt, wait, max/2, max)
+		}
+	}
+}
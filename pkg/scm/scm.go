@@ -14,11 +14,25 @@
 
 package scm
 
+const (
+	TypeGitlab = "gitlab"
+	TypeGithub = "github"
+	TypeGitea  = "gitea"
+	// TypeForgejo is the soft fork of Gitea, it shares the Gitea api.
+	TypeForgejo = "forgejo"
+	// TypeBitbucket is the Bitbucket Server / Data Center, Bitbucket Cloud is not supported.
+	TypeBitbucket = "bitbucket"
+)
+
 type Config struct {
+	// Name is the name of the instance, it is used to route the webhook when there are multiple instances.
+	Name   string `json:"name"`
 	Type   string `json:"type"`
 	Host   string `json:"host"`
 	Token  string `json:"token"`
 	Secret string `json:"secret"`
+	// Retry is the retry policy of the failed api calls
+	Retry RetryConfig `json:"retry"`
 }
 
 type Interface interface {
@@ -27,11 +41,27 @@ type Interface interface {
 	ListLabels(pid string) ([]Label, error)
 	CreateLabel(pid string, label *Label) error
 	CreatePullRequestComment(pid string, prID int, comment string) error
+	ListPullRequestComments(pid string, prID int) ([]Comment, error)
 	GetPullRequest(pid string, prID int) (*PullRequest, error)
 	UpdatePullRequest(pid string, prID int, data *UpdatePullRequest) error
 	UpdateBuildStatus(pid, sha string, state BuildState) error
 	MergePullRequest(pid string, prID int, data *MergePullRequest) error
 	MergePullRequestApprove(pid string, prID int, approved bool) error
+	// RebasePullRequest rebases the source branch onto the target branch,
+	// the provider may rebase asynchronously and report the progress by PullRequest.RebaseInProgress and MergeError.
+	RebasePullRequest(pid string, prID int) error
+	GetIssue(pid string, issueID int) (*Issue, error)
+	UpdateIssue(pid string, issueID int, data *UpdateIssue) error
+	CreateIssueComment(pid string, issueID int, comment string) error
+	// ListPullRequestPipelines returns the pipelines of the pull request, the latest first.
+	ListPullRequestPipelines(pid string, prID int) ([]Pipeline, error)
+	// ListPipelineJobs returns the latest attempts of the jobs in the pipeline.
+	ListPipelineJobs(pid string, pipelineID int) ([]Job, error)
+	// RetryPipeline retries the failed and canceled jobs of the pipeline.
+	RetryPipeline(pid string, pipelineID int) error
+	RetryJob(pid string, jobID int) error
+	// PlayJob triggers the manual job.
+	PlayJob(pid string, jobID int) error
 }
 
 type BuildState = string
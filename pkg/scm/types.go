@@ -14,10 +14,39 @@
 
 package scm
 
-import "time"
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zc2638/review-bot/pkg/command"
+)
 
 const ReviewConfigFileName = "review.yml"
 
+// ReviewConfigPath returns the path of the review config file in the repository of the provider.
+func ReviewConfigPath(typ string) string {
+	switch typ {
+	case TypeGithub:
+		return path.Join(".github", ReviewConfigFileName)
+	case TypeGitea, TypeForgejo:
+		return path.Join(".gitea", ReviewConfigFileName)
+	case TypeBitbucket:
+		return path.Join(".bitbucket", ReviewConfigFileName)
+	}
+	return path.Join(".gitlab", ReviewConfigFileName)
+}
+
+// ErrReviewConfigNotFound is returned when the project has no review config file.
+var ErrReviewConfigNotFound = errors.New("review config not found")
+
+// ErrNotSupported is returned when the operation is not supported by the provider.
+var ErrNotSupported = errors.New("operation is not supported by the provider")
+
+// ErrRebaseConflict is returned when the pull request can not be rebased because of the conflicts.
+var ErrRebaseConflict = errors.New("pull request can not be rebased because of the conflicts")
+
 type ReviewConfig struct {
 	Reviewers    []string          `json:"reviewers" yaml:"reviewers"`
 	Approvers    []string          `json:"approvers" yaml:"approvers"`
@@ -28,6 +57,10 @@ type ReviewConfig struct {
 type PullRequestConfig struct {
 	// 合并信息以PR的标题为主，否则以PR描述模板内的 <!-- title -->内容<!-- end title--> 内容为主
 	SquashWithTitle bool `json:"squash_with_title" yaml:"squash_with_title"`
+	// 推送新的commit时除lgtm外，同时移除approved
+	ResetApprovedOnPush bool `json:"reset_approved_on_push" yaml:"reset_approved_on_push"`
+	// 允许 /cc 项目的任意成员，否则只能 /cc reviewers 及 approvers
+	CCAnyMember bool `json:"cc_any_member" yaml:"cc_any_member"`
 }
 
 type Label struct {
@@ -39,6 +72,23 @@ type Label struct {
 	Description string `json:"description"`
 }
 
+// Match reports whether the order of the label matches the commands.
+func (l Label) Match(cmds command.Commands) bool {
+	return l.MatchWithPrefix("", cmds)
+}
+
+// MatchWithPrefix is like Match, but the orders are prefixed, e.g. `/remove-kind bug` with the prefix remove.
+func (l Label) MatchWithPrefix(prefix string, cmds command.Commands) bool {
+	order := l.Order
+	if order == "" {
+		return false
+	}
+	if prefix != "" {
+		order = "/" + prefix + "-" + strings.TrimPrefix(order, "/")
+	}
+	return cmds.Match(order)
+}
+
 type ProjectMember struct {
 	ID        int    `json:"id"`
 	Username  string `json:"username"`
@@ -61,11 +111,53 @@ type PullRequest struct {
 	TargetProjectID           int        `json:"target_project_id"`
 	Labels                    []string   `json:"labels"`
 	Description               string     `json:"description"`
+	AuthorID                  int        `json:"author_id"`
 	WorkInProgress            bool       `json:"work_in_progress"`
 	MergeWhenPipelineSucceeds bool       `json:"merge_when_pipeline_succeeds"`
 	ShouldRemoveSourceBranch  bool       `json:"should_remove_source_branch"`
 	ForceRemoveSourceBranch   bool       `json:"force_remove_source_branch"`
 	Squash                    bool       `json:"squash"`
+	SHA                       string     `json:"sha"`
+	// MergeCommitSHA is the commit created by merging, it is the squash commit if squashed
+	MergeCommitSHA string `json:"merge_commit_sha"`
+	AssigneeIDs    []int  `json:"assignee_ids"`
+	// ReviewerIDs is the users requested to review
+	ReviewerIDs []int `json:"reviewer_ids"`
+	// RebaseInProgress reports whether the rebase started by RebasePullRequest is not finished
+	RebaseInProgress bool `json:"rebase_in_progress"`
+	// MergeError is the error of the last merge or rebase
+	MergeError string `json:"merge_error"`
+	// TitleLabels means the labels are emulated by the title tags which can be edited by the author,
+	// the admin labels are not read from the title and should be rebuilt from the comments and ApprovedBy
+	TitleLabels bool `json:"title_labels,omitempty"`
+	// ApprovedBy is the usernames who approved the pull request, it is only set when TitleLabels is true
+	ApprovedBy []string `json:"approved_by,omitempty"`
+}
+
+// Pipeline is the pipeline of the pull request.
+type Pipeline struct {
+	ID     int    `json:"id"`
+	SHA    string `json:"sha"`
+	Ref    string `json:"ref"`
+	Status string `json:"status"`
+	WebURL string `json:"web_url"`
+}
+
+// Job is the job of the pipeline.
+type Job struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	Stage        string     `json:"stage"`
+	Status       BuildState `json:"status"`
+	AllowFailure bool       `json:"allow_failure"`
+}
+
+// Comment is the comment of the pull request.
+type Comment struct {
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	Author    User       `json:"author"`
+	CreatedAt *time.Time `json:"created_at"`
 }
 
 type UpdatePullRequest struct {
@@ -77,6 +169,10 @@ type UpdatePullRequest struct {
 	Labels       []string `json:"labels"`
 	AddLabels    []string `json:"add_labels"`
 	RemoveLabels []string `json:"remove_labels"`
+	// UnassignAll removes all the assignees, AssigneeID and AssigneeIDs are ignored
+	UnassignAll bool `json:"unassign_all"`
+	// ReviewerIDs replaces the users requested to review if not nil, the empty slice removes all
+	ReviewerIDs []int `json:"reviewer_ids"`
 }
 
 type MergePullRequest struct {
@@ -85,3 +181,31 @@ type MergePullRequest struct {
 	ShouldRemoveSourceBranch  bool   `json:"should_remove_source_branch"`
 	MergeWhenPipelineSucceeds bool   `json:"merge_when_pipeline_succeeds"`
 }
+
+type Issue struct {
+	ID          int      `json:"id"`
+	IID         int      `json:"iid"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	State       string   `json:"state"`
+	AuthorID    int      `json:"author_id"`
+	Labels      []string `json:"labels"`
+	AssigneeIDs []int    `json:"assignee_ids"`
+}
+
+const (
+	IssueStateEventClose  = "close"
+	IssueStateEventReopen = "reopen"
+)
+
+type UpdateIssue struct {
+	// AssigneeIDs replaces all the assignees if not empty
+	AssigneeIDs  []int    `json:"assignee_ids"`
+	Labels       []string `json:"labels"`
+	AddLabels    []string `json:"add_labels"`
+	RemoveLabels []string `json:"remove_labels"`
+	// StateEvent is IssueStateEventClose or IssueStateEventReopen
+	StateEvent string `json:"state_event"`
+	// UnassignAll removes all the assignees, AssigneeIDs is ignored
+	UnassignAll bool `json:"unassign_all"`
+}
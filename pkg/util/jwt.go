@@ -15,9 +15,12 @@
 package util
 
 import (
-	"crypto/md5"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -28,23 +31,59 @@ type JwtClaims struct {
 	jwt.RegisteredClaims
 }
 
+const (
+	// JwtScopeProject is the scope of the project webhook, the slug is namespace/name
+	JwtScopeProject = ""
+	// JwtScopeNamespace is the scope of the group webhook, the slug is namespace
+	JwtScopeNamespace = "namespace"
+	// JwtScopeSystem is the scope of the system hook, the slug is empty
+	JwtScopeSystem = "system"
+)
+
 type JwtAuthInfo struct {
-	Slug      string    `json:"slug"` // namespace/name
+	Slug      string    `json:"slug"`               // namespace/name
+	Scope     string    `json:"scope,omitempty"`    // project、namespace、system
+	Instance  string    `json:"instance,omitempty"` // name of the scm instance
 	CreatedAt time.Time `json:"created_at"`
 	Signature string    `json:"signature"`
 }
 
+// Match reports whether the project path is allowed by the scope of the token.
+func (j *JwtAuthInfo) Match(path string) bool {
+	switch j.Scope {
+	case JwtScopeSystem:
+		return true
+	case JwtScopeNamespace:
+		return strings.HasPrefix(path, strings.TrimSuffix(j.Slug, "/")+"/")
+	}
+	return j.Slug == path
+}
+
+// BuildSign returns the hex encoded hmac-sha256 signature of the auth info with the secret of the scm instance.
 func (j *JwtAuthInfo) BuildSign(secret string) string {
-	data := j.Slug + strconv.FormatInt(j.CreatedAt.Unix(), 10)
-	hash := md5.New()
-	_, _ = hash.Write([]byte(data))
-	sign := hash.Sum([]byte(secret))
-	return string(sign)
+	return hex.EncodeToString(j.sign(secret))
 }
 
+// CheckSign reports whether the signature is built by the secret.
 func (j *JwtAuthInfo) CheckSign(secret string) bool {
-	sign := j.BuildSign(secret)
-	return j.Signature == sign
+	got, err := hex.DecodeString(j.Signature)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	return hmac.Equal(got, j.sign(secret))
+}
+
+func (j *JwtAuthInfo) sign(secret string) []byte {
+	// 使用分隔符避免不同字段拼接后产生相同的内容
+	data := strings.Join([]string{
+		j.Slug,
+		j.Scope,
+		j.Instance,
+		strconv.FormatInt(j.CreatedAt.Unix(), 10),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
 }
 
 func JwtCreate(claims JwtClaims, secret string) (string, error) {
@@ -0,0 +1,53 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJwtAuthInfo_CheckSign(t *testing.T) {
+	createdAt := time.Unix(1654070400, 0)
+	auth := JwtAuthInfo{Slug: "group/project", CreatedAt: createdAt}
+	auth.Signature = auth.BuildSign("secret")
+
+	tests := []struct {
+		name   string
+		modify func(j *JwtAuthInfo)
+		secret string
+		want   bool
+	}{
+		{name: "valid", secret: "secret", want: true},
+		{name: "other secret", secret: "other", want: false},
+		{name: "empty signature", modify: func(j *JwtAuthInfo) { j.Signature = "" }, secret: "secret", want: false},
+		{name: "invalid hex", modify: func(j *JwtAuthInfo) { j.Signature = "not-hex" }, secret: "secret", want: false},
+		{name: "other slug", modify: func(j *JwtAuthInfo) { j.Slug = "group/other" }, secret: "secret", want: false},
+		{name: "other scope", modify: func(j *JwtAuthInfo) { j.Scope = JwtScopeSystem }, secret: "secret", want: false},
+		{name: "other instance", modify: func(j *JwtAuthInfo) { j.Instance = "other" }, secret: "secret", want: false},
+		{name: "other time", modify: func(j *JwtAuthInfo) { j.CreatedAt = createdAt.Add(time.Second) }, secret: "secret", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := auth
+			if tt.modify != nil {
+				tt.modify(&j)
+			}
+			if got := j.CheckSign(tt.secret); got != tt.want {
+				t.Errorf("CheckSign() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}